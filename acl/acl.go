@@ -0,0 +1,578 @@
+// Package acl authenticates the API tokens of users and decides which
+// commands and keys each of them may access.
+package acl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/glob"
+)
+
+// the user requests without a token are made as, if it exists and has nopass
+const DefaultUser = "default"
+
+var (
+	// the token is unknown, belongs to a disabled user, or none was given
+	// and there is no default user to fall back to
+	ErrUnauthenticated = errors.New("invalid or missing token")
+	// matched by every PermissionError
+	ErrNoPermission = errors.New("no permission")
+	ErrInvalidRule  = errors.New("invalid ACL rule")
+)
+
+// a denied command, naming the user, the command and, if a key was the
+// reason, the key. It matches ErrNoPermission with errors.Is.
+type PermissionError struct {
+	User    string
+	Command string
+	// the key the user may not access, "*" for commands reaching every key,
+	// empty if the command itself is not allowed
+	Key string
+}
+
+func (e *PermissionError) Error() string {
+	switch e.Key {
+	case "":
+		return fmt.Sprintf("user %s has no permission to run %s", e.User, e.Command)
+	case "*":
+		return fmt.Sprintf("user %s has no permission to run %s, which needs access to every key", e.User, e.Command)
+	}
+	return fmt.Sprintf("user %s has no permission to access key %s", e.User, e.Key)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrNoPermission
+}
+
+// return the categories of a command: read, write, admin and blocking by its
+// flags and the group it is documented in, such as queue or string
+func Categories(spec commandparser.Spec) []string {
+	var categories []string
+	for _, flag := range []struct{ flag, category string }{
+		{commandparser.FlagReadOnly, "read"},
+		{commandparser.FlagWrite, "write"},
+		{commandparser.FlagAdmin, "admin"},
+		{commandparser.FlagBlocking, "blocking"},
+	} {
+		if spec.HasFlag(flag.flag) {
+			categories = append(categories, flag.category)
+		}
+	}
+	if spec.Group != "" {
+		categories = append(categories, spec.Group)
+	}
+	return categories
+}
+
+// a rule allowing or denying a command by name or a category of commands
+type commandRule struct {
+	allow bool
+	// the upper case name of the command, or the category prefixed with @
+	name string
+}
+
+func (r commandRule) String() string {
+	if r.allow {
+		return "+" + r.name
+	}
+	return "-" + r.name
+}
+
+// report whether the rule applies to the command
+func (r commandRule) matches(spec commandparser.Spec) bool {
+	if !strings.HasPrefix(r.name, "@") {
+		return r.name == spec.Name
+	}
+	category := r.name[1:]
+	if category == "all" {
+		return true
+	}
+	for _, c := range Categories(spec) {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// a user: whether it may log in, the hashes of its tokens, the key patterns
+// it may access and the commands it may run. A user is never changed once
+// created, so requests keep a consistent view while it is replaced.
+type User struct {
+	Name    string
+	enabled bool
+	// authenticates requests without a token, only used for DefaultUser
+	nopass bool
+	// hex encoded SHA-256 hashes of the tokens
+	tokens []string
+	keys   []string
+	// applied in order, the last one matching a command decides
+	commands []commandRule
+}
+
+// report whether the user may log in
+func (u *User) Enabled() bool {
+	return u.enabled
+}
+
+// report whether the user may run the command, ignoring its keys
+func (u *User) CanRun(spec commandparser.Spec) bool {
+	allowed := false
+	for _, rule := range u.commands {
+		if rule.matches(spec) {
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// report whether the key matches one of the key patterns of the user
+func (u *User) CanAccess(key string) bool {
+	for _, pattern := range u.keys {
+		if glob.Match(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// report whether the user may access every key
+func (u *User) AllKeys() bool {
+	for _, pattern := range u.keys {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// check that the user may run the command with the arguments. Commands that
+// reach keys which are not among their arguments, such as KEYS or FLUSHDB,
+// need access to every key. The error is a *PermissionError.
+func (u *User) Check(spec commandparser.Spec, args []string) error {
+	if !u.CanRun(spec) {
+		return &PermissionError{User: u.Name, Command: spec.Name}
+	}
+	if spec.HasFlag(commandparser.FlagAllKeys) && !u.AllKeys() {
+		return &PermissionError{User: u.Name, Command: spec.Name, Key: "*"}
+	}
+	for _, key := range spec.Keys(args) {
+		if !u.CanAccess(key) {
+			return &PermissionError{User: u.Name, Command: spec.Name, Key: key}
+		}
+	}
+	return nil
+}
+
+// return the flags of the user: on or off, and nopass if set
+func (u *User) Flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// return the hashes of the tokens of the user
+func (u *User) TokenHashes() []string {
+	return append([]string(nil), u.tokens...)
+}
+
+// return the key patterns of the user
+func (u *User) KeyPatterns() []string {
+	return append([]string(nil), u.keys...)
+}
+
+// return the command rules of the user in the order they apply
+func (u *User) CommandRules() []string {
+	if len(u.commands) == 0 {
+		return []string{"-@all"}
+	}
+	rules := make([]string, len(u.commands))
+	for i, rule := range u.commands {
+		rules[i] = rule.String()
+	}
+	return rules
+}
+
+// return the rules recreating the user, tokens given by their hashes
+func (u *User) Rules() []string {
+	rules := u.Flags()
+	for _, hash := range u.tokens {
+		rules = append(rules, "#"+hash)
+	}
+	for _, pattern := range u.keys {
+		rules = append(rules, "~"+pattern)
+	}
+	return append(rules, u.CommandRules()...)
+}
+
+// describe the user as a line of an ACL file
+func (u *User) String() string {
+	return "user " + u.Name + " " + strings.Join(u.Rules(), " ")
+}
+
+// return a copy that can be changed without affecting u
+func (u *User) clone() *User {
+	c := *u
+	c.tokens = append([]string(nil), u.tokens...)
+	c.keys = append([]string(nil), u.keys...)
+	c.commands = append([]commandRule(nil), u.commands...)
+	return &c
+}
+
+// change the user according to one rule:
+//
+//	on, off            enable or disable the user
+//	>token, <token     add or remove a token
+//	#hash, !hash       add or remove a token by its SHA-256 hash
+//	nopass, resetpass  let requests without a token in, or remove every token
+//	~pattern, allkeys  allow the keys matching a glob pattern, or every key
+//	resetkeys          allow no keys
+//	+command, -command allow or deny a command
+//	+@category         allow or deny every command of a category, @all for
+//	-@category         every command
+//	allcommands        same as +@all
+//	nocommands         same as -@all
+//	reset              disable the user and remove every token, key and command
+func (u *User) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.tokens = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.tokens = nil
+		return nil
+	case "allkeys":
+		u.keys = []string{"*"}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allcommands":
+		return u.apply("+@all")
+	case "nocommands":
+		return u.apply("-@all")
+	case "reset":
+		*u = User{Name: u.Name}
+		return nil
+	}
+
+	if len(rule) < 2 {
+		return fmt.Errorf("%w: %q", ErrInvalidRule, rule)
+	}
+	value := rule[1:]
+	switch rule[0] {
+	case '>':
+		u.tokens = addString(u.tokens, HashToken(value))
+		u.nopass = false
+	case '<':
+		u.tokens = removeString(u.tokens, HashToken(value))
+	case '#':
+		hash := strings.ToLower(value)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("%w: %q is not a SHA-256 hash", ErrInvalidRule, rule)
+		}
+		u.tokens = addString(u.tokens, hash)
+		u.nopass = false
+	case '!':
+		u.tokens = removeString(u.tokens, strings.ToLower(value))
+	case '~':
+		u.keys = addString(u.keys, value)
+	case '+', '-':
+		name := strings.ToUpper(value)
+		if strings.HasPrefix(value, "@") {
+			name = strings.ToLower(value)
+		}
+		if name == "@" || strings.ContainsAny(name, " \t\r\n") {
+			return fmt.Errorf("%w: %q", ErrInvalidRule, rule)
+		}
+		if name == "@all" {
+			// every earlier rule is overridden
+			u.commands = nil
+		}
+		u.commands = append(u.commands, commandRule{allow: rule[0] == '+', name: name})
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidRule, rule)
+	}
+	return nil
+}
+
+// return the hex encoded SHA-256 hash of a token, as stored by the #hash rule
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// replace the tokens given in clear text by rules with a placeholder, so that
+// the rules can be logged
+func Redact(rules []string) []string {
+	redacted := make([]string, len(rules))
+	for i, rule := range rules {
+		if strings.HasPrefix(rule, ">") || strings.HasPrefix(rule, "<") {
+			rule = rule[:1] + "***"
+		}
+		redacted[i] = rule
+	}
+	return redacted
+}
+
+func addString(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func removeString(values []string, value string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// the users of a server by name, safe for concurrent use
+type ACL struct {
+	lock  sync.RWMutex
+	users map[string]*User
+}
+
+// create an ACL holding only the default user, which needs no token and may
+// run every command on every key, so that every request is allowed until
+// the rules are tightened
+func New() *ACL {
+	a := &ACL{users: make(map[string]*User)}
+	a.SetUser(DefaultUser, "on", "nopass", "allkeys", "allcommands")
+	return a
+}
+
+// create the user or change an existing one by applying the rules in order.
+// A new user starts disabled, without tokens, keys or commands. Either every
+// rule applies or, if any is invalid, the user stays unchanged.
+func (a *ACL) SetUser(name string, rules ...string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("%w: invalid user name %q", ErrInvalidRule, name)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := &User{Name: name}
+	if existing, exists := a.users[name]; exists {
+		user = existing.clone()
+	}
+	for _, rule := range rules {
+		if err := user.apply(rule); err != nil {
+			return err
+		}
+	}
+	if err := checkTokens(a.users, user); err != nil {
+		return err
+	}
+	a.users[name] = user
+	return nil
+}
+
+// make sure no token of user belongs to another user
+func checkTokens(users map[string]*User, user *User) error {
+	for _, other := range users {
+		if other.Name == user.Name {
+			continue
+		}
+		for _, hash := range user.tokens {
+			for _, otherHash := range other.tokens {
+				if hash == otherHash {
+					return fmt.Errorf("%w: user %s already has the token", ErrInvalidRule, other.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// remove the users and return how many of them existed
+func (a *ACL) DeleteUser(names ...string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	deleted := 0
+	for _, name := range names {
+		if _, exists := a.users[name]; exists {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// return the user with the name
+func (a *ACL) User(name string) (*User, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	user, exists := a.users[name]
+	return user, exists
+}
+
+// return every user sorted by name
+func (a *ACL) Users() []*User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	users := make([]*User, 0, len(a.users))
+	for _, user := range a.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// return the enabled user the token belongs to. Without a token, the default
+// user is returned if it is enabled and has nopass.
+func (a *ACL) Authenticate(token string) (*User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if token == "" {
+		if user, exists := a.users[DefaultUser]; exists && user.enabled && user.nopass {
+			return user, nil
+		}
+		return nil, ErrUnauthenticated
+	}
+
+	hash := []byte(HashToken(token))
+	for _, user := range a.users {
+		for _, stored := range user.tokens {
+			if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+				if !user.enabled {
+					return nil, ErrUnauthenticated
+				}
+				return user, nil
+			}
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// return the enabled user named by the subject common name of a verified
+// client certificate
+func (a *ACL) AuthenticateCertificate(cert *x509.Certificate) (*User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	name := cert.Subject.CommonName
+	if user, exists := a.users[name]; exists && name != "" && user.enabled {
+		return user, nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+// replace every user by the users of an ACL file: one "user name rules..."
+// line per user, with blank lines and lines starting with # ignored. Either
+// every user is replaced or, if the file is invalid, none is.
+func (a *ACL) Read(r io.Reader) error {
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("line %d: %w: expected user name rules...", line, ErrInvalidRule)
+		}
+		name := fields[1]
+		if _, exists := users[name]; exists {
+			return fmt.Errorf("line %d: %w: user %s given twice", line, ErrInvalidRule, name)
+		}
+		user := &User{Name: name}
+		for _, rule := range fields[2:] {
+			if err := user.apply(rule); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if err := checkTokens(users, user); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		users[name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.users = users
+	return nil
+}
+
+// write every user as a line of an ACL file, tokens given by their hashes
+func (a *ACL) Write(w io.Writer) error {
+	for _, user := range a.Users() {
+		if _, err := fmt.Fprintln(w, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace every user by the users of the ACL file at path, see Read
+func (a *ACL) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := a.Read(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// write every user to the ACL file at path. The file is written to a
+// temporary file first and renamed, so it always holds every user.
+func (a *ACL) SaveFile(path string) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = a.Write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
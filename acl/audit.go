@@ -0,0 +1,103 @@
+package acl
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// how many entries an audit log keeps for ACL LOG by default
+const DefaultAuditLogSize = 128
+
+// the events recorded in the audit log
+const (
+	// a request with an unknown token, or without one when there is no
+	// default user
+	EventAuth = "auth"
+	// a command the user may not run
+	EventCommand = "command"
+	// a key the user may not access
+	EventKey = "key"
+	// a change of the users, such as ACL SETUSER or ACL LOAD
+	EventChange = "acl"
+)
+
+// an entry of the audit log
+type AuditEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// the user the request was made as, empty for failed authentication
+	User string `json:"user,omitempty"`
+	// the address of the client
+	Client  string `json:"client"`
+	Command string `json:"command,omitempty"`
+	Key     string `json:"key,omitempty"`
+	// further details, such as the redacted rules of an ACL change
+	Detail string `json:"detail,omitempty"`
+}
+
+// a log of denied requests and ACL changes. Every entry is written as a line
+// of JSON and the most recent ones are kept for ACL LOG.
+type AuditLog struct {
+	lock    sync.Mutex
+	w       io.Writer
+	size    int
+	entries []AuditEntry
+}
+
+// create an audit log writing to w, or to the server log if w is nil, and
+// keeping the latest size entries
+func NewAuditLog(w io.Writer, size int) *AuditLog {
+	return &AuditLog{w: w, size: size}
+}
+
+// add an entry, stamped with the current time if it has none
+func (l *AuditLog) Record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Error encoding audit entry:", err)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.w == nil {
+		log.Printf("audit: %s", line)
+	} else if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.Println("Error writing audit entry:", err)
+	}
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.size {
+		l.entries = append([]AuditEntry(nil), l.entries[len(l.entries)-l.size:]...)
+	}
+}
+
+// return up to count of the kept entries, the most recent first, or every
+// kept entry if count is not positive
+func (l *AuditLog) Entries(count int) []AuditEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if count <= 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	entries := make([]AuditEntry, count)
+	for i := range entries {
+		entries[i] = l.entries[len(l.entries)-1-i]
+	}
+	return entries
+}
+
+// forget the kept entries; the written ones are not affected
+func (l *AuditLog) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.entries = nil
+}
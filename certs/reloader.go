@@ -0,0 +1,213 @@
+// Package certs serves TLS with a certificate, and optionally the CAs
+// client certificates are verified against, that are reloaded when their
+// files change.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the files are checked for changes unless Watch is told otherwise
+const DefaultReloadInterval = 10 * time.Second
+
+var ErrNoCertificates = errors.New("no certificates found")
+
+// whether and how client certificates are verified
+type ClientAuth string
+
+const (
+	// client certificates are verified if the client sends one
+	ClientAuthOptional ClientAuth = "optional"
+	// every client must send a valid certificate
+	ClientAuthRequire ClientAuth = "require"
+)
+
+// parse the name of a client authentication mode
+func ParseClientAuth(name string) (ClientAuth, error) {
+	switch mode := ClientAuth(name); mode {
+	case ClientAuthOptional, ClientAuthRequire:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown client auth %q, expected optional or require", name)
+}
+
+// the size and modification time of a file, to notice when it changes
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// stat the files, in order
+func stampFiles(paths ...string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{info.Size(), info.ModTime()}
+	}
+	return stamps, nil
+}
+
+// a certificate and key pair, and optionally a client CA bundle, loaded from
+// files and reloaded when they change. Handshakes always use the latest
+// files that loaded successfully.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	// PEM bundle of the CAs client certificates are verified against,
+	// empty to not ask for client certificates
+	caFile     string
+	clientAuth ClientAuth
+
+	lock   sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+	stamps []fileStamp
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// load the certificate and key, and the client CAs if caFile is not empty
+func NewReloader(certFile, keyFile, caFile string, clientAuth ClientAuth) (*Reloader, error) {
+	r := &Reloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     caFile,
+		clientAuth: clientAuth,
+		done:       make(chan struct{}),
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// return the files the reloader loads
+func (r *Reloader) files() []string {
+	if r.caFile == "" {
+		return []string{r.certFile, r.keyFile}
+	}
+	return []string{r.certFile, r.keyFile, r.caFile}
+}
+
+// load the files again if any of them changed since they were last loaded
+// and report whether they were. If they cannot be loaded, the previous ones
+// stay in use and the error is returned.
+func (r *Reloader) Reload() (bool, error) {
+	stamps, err := stampFiles(r.files()...)
+	if err != nil {
+		return false, err
+	}
+	r.lock.RLock()
+	unchanged := equalStamps(stamps, r.stamps)
+	r.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("%s: %w", r.caFile, ErrNoCertificates)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert, r.pool, r.stamps = &cert, pool, stamps
+	return true, nil
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// check the files for changes every interval until Close is called, logging
+// reloads and failures
+func (r *Reloader) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.done:
+				return
+			}
+			reloaded, err := r.Reload()
+			if err != nil {
+				log.Println("Error reloading TLS certificates, keeping the previous ones:", err)
+			} else if reloaded {
+				log.Println("Reloaded TLS certificates from", r.certFile)
+			}
+		}
+	}()
+}
+
+// stop watching the files
+func (r *Reloader) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+// return the latest certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert
+}
+
+// return a TLS config serving the latest certificate and verifying client
+// certificates against the latest client CAs, negotiating the application
+// protocols in order of preference. The config is cloned for each handshake,
+// so protocols a server adds to its own copy, like the h2 of an http.Server,
+// are not offered and must be given here.
+func (r *Reloader) TLSConfig(nextProtos ...string) *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: nextProtos}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.Certificates = []tls.Certificate{*r.cert}
+		if r.pool != nil {
+			config.ClientCAs = r.pool
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			if r.clientAuth == ClientAuthRequire {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return config, nil
+	}
+	return base
+}
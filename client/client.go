@@ -0,0 +1,257 @@
+// Package client talks to the key value store over its HTTP command endpoint.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// the defaults used for zero Options fields
+const (
+	DefaultMaxRetries   = 3
+	DefaultMinBackoff   = 50 * time.Millisecond
+	DefaultMaxBackoff   = 2 * time.Second
+	DefaultMaxIdleConns = 64
+)
+
+// ErrUnexpectedReply is returned when a reply does not have the type the command answers with
+var ErrUnexpectedReply = errors.New("unexpected reply type")
+
+// the settings of a client
+type Options struct {
+	// the client sending the requests. By default one with its own pool of
+	// MaxIdleConns keep-alive connections is created.
+	HTTPClient   *http.Client
+	MaxIdleConns int
+	// the TLS settings of the default client, such as the CAs the server
+	// certificate is verified against and a client certificate
+	TLSConfig *tls.Config
+	// the namespace commands run in, the default namespace if empty
+	Namespace string
+	// the API token sent as a bearer token, none if empty
+	Token string
+	// how often an idempotent command is retried after a network error or a
+	// 502, 503 or 504 response, -1 for never. The wait before each retry
+	// doubles from MinBackoff up to MaxBackoff, with jitter.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// a connection to a server, safe for concurrent use
+type Client struct {
+	url     string
+	options Options
+}
+
+// an error reply of the server. It matches the sentinel error of its code
+// with errors.Is, e.g. database.ErrNotFound for NOT_FOUND.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	for _, code := range handlers.ErrorCodes() {
+		if code.Code == e.Code {
+			return code.Err
+		}
+	}
+	return nil
+}
+
+// create a client of the server at the base URL, e.g. http://localhost:8080
+func NewClient(baseURL string, options Options) *Client {
+	if options.HTTPClient == nil {
+		if options.MaxIdleConns <= 0 {
+			options.MaxIdleConns = DefaultMaxIdleConns
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = options.MaxIdleConns
+		transport.MaxIdleConnsPerHost = options.MaxIdleConns
+		transport.TLSClientConfig = options.TLSConfig
+		options.HTTPClient = &http.Client{Transport: transport}
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = DefaultMaxRetries
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = DefaultMinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = max(DefaultMaxBackoff, options.MinBackoff)
+	}
+	return &Client{url: strings.TrimSuffix(baseURL, "/") + "/", options: options}
+}
+
+// report whether sending the command twice has the same effect as sending
+// it once, so that it can be retried when the outcome is unknown. A SET with
+// NX or XX is not: a retry of one that succeeded would fail its condition.
+func idempotent(cmd string, args []string) bool {
+	switch cmd {
+	case "SET":
+		for _, arg := range args[min(2, len(args)):] {
+			if option := strings.ToUpper(arg); option == "NX" || option == "XX" {
+				return false
+			}
+		}
+		return true
+	case "MSET":
+		return true
+	}
+	spec, exists := commandparser.Lookup(cmd)
+	return exists && spec.HasFlag(commandparser.FlagReadOnly)
+}
+
+// send a command with its arguments, which are passed verbatim, and return
+// its reply. An error reply is returned as an *Error.
+func (c *Client) Do(ctx context.Context, cmd string, args ...string) (handlers.Reply, error) {
+	cmd = strings.ToUpper(cmd)
+	if args == nil {
+		args = []string{}
+	}
+	body, err := json.Marshal(handlers.RequestBody{Command: cmd, Args: args})
+	if err != nil {
+		return handlers.Reply{}, err
+	}
+
+	retries := 0
+	if idempotent(cmd, args) {
+		retries = max(c.options.MaxRetries, 0)
+	}
+	backoff := c.options.MinBackoff
+	for attempt := 0; ; attempt++ {
+		var reply handlers.Reply
+		err := c.send(ctx, "", body, &reply)
+		if err == nil && reply.Type == "" {
+			err = ErrUnexpectedReply
+		}
+		if err == nil || attempt >= retries || !retryable(err) {
+			return reply, err
+		}
+
+		// wait between half and all of the backoff
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		backoff = min(backoff*2, c.options.MaxBackoff)
+		select {
+		case <-ctx.Done():
+			return handlers.Reply{}, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// post one request to the path and decode its reply into out. A body that
+// is a single error reply is returned as an *Error.
+func (c *Client) send(ctx context.Context, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Response-Format", "typed")
+	if c.options.Namespace != "" {
+		req.Header.Set("X-Namespace", c.options.Namespace)
+	}
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var reply handlers.Reply
+	if json.Unmarshal(data, &reply) == nil && reply.Type == handlers.ReplyError {
+		return &Error{Status: resp.StatusCode, Code: reply.Code, Message: reply.Error}
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(data, out) != nil {
+		// not a reply, e.g. from a proxy in front of the server
+		return &Error{
+			Status:  resp.StatusCode,
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("unexpected response: %s", resp.Status),
+		}
+	}
+	return nil
+}
+
+// send several commands in one request and return their replies in order.
+// Each command is its name followed by its arguments. Commands failing on
+// their own are answered with an error reply and do not stop the others.
+// The batch is not retried.
+func (c *Client) Batch(ctx context.Context, commands [][]string) ([]handlers.Reply, error) {
+	requests := make([]handlers.RequestBody, len(commands))
+	for i, command := range commands {
+		if len(command) == 0 {
+			return nil, commandparser.ErrEmptyCommand
+		}
+		args := command[1:]
+		if args == nil {
+			args = []string{}
+		}
+		requests[i] = handlers.RequestBody{Command: command[0], Args: args}
+	}
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []handlers.Reply
+	if err := c.send(ctx, "batch", body, &replies); err != nil {
+		return nil, err
+	}
+	if len(replies) != len(commands) {
+		return nil, ErrUnexpectedReply
+	}
+	return replies, nil
+}
+
+// report whether the request may not have reached the server, or the server
+// was temporarily unable to answer
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var replyErr *Error
+	if errors.As(err, &replyErr) {
+		switch replyErr.Status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// format a duration as whole seconds, rounding up so that a key never
+// expires earlier than asked
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// the options of Set
+type SetOptions struct {
+	// expire the key after TTL, rounded up to whole seconds, 0 for never
+	TTL time.Duration
+	// only set the key if it does not exist, or only if it exists
+	NX bool
+	XX bool
+}
+
+// the options of Scan
+type ScanOptions struct {
+	Match string
+	Count int
+	// database.TypeString or database.TypeQueue, empty for both
+	Type string
+}
+
+// the options of Range
+type RangeOptions struct {
+	Limit   int
+	Reverse bool
+}
+
+// a key and its value returned by Range
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// return the value of a string reply
+func stringValue(reply handlers.Reply, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	value, ok := reply.Value.(string)
+	if reply.Type != handlers.ReplyString || !ok {
+		return "", ErrUnexpectedReply
+	}
+	return value, nil
+}
+
+// return the value of an integer reply
+func intValue(reply handlers.Reply, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	value, ok := reply.Value.(int64)
+	if reply.Type != handlers.ReplyInteger || !ok {
+		return 0, ErrUnexpectedReply
+	}
+	return value, nil
+}
+
+// return the strings of an array reply
+func stringsValue(reply handlers.Reply, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.Value.([]handlers.Reply)
+	if reply.Type != handlers.ReplyArray || !ok {
+		return nil, ErrUnexpectedReply
+	}
+	values := make([]string, len(items))
+	for i, item := range items {
+		if values[i], err = stringValue(item, nil); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// return the fields of a map reply
+func mapValue(reply handlers.Reply, err error) (map[string]handlers.Reply, error) {
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.Value.(map[string]handlers.Reply)
+	if reply.Type != handlers.ReplyMap || !ok {
+		return nil, ErrUnexpectedReply
+	}
+	return fields, nil
+}
+
+// return only the error of a reply
+func noValue(reply handlers.Reply, err error) error {
+	return err
+}
+
+// set the value of a key. A failed NX or XX condition matches
+// database.ErrConditionFailed.
+func (c *Client) Set(ctx context.Context, key, value string, options *SetOptions) error {
+	args := []string{key, value}
+	if options != nil {
+		if options.TTL > 0 {
+			args = append(args, "EX", seconds(options.TTL))
+		}
+		if options.NX {
+			args = append(args, "NX")
+		}
+		if options.XX {
+			args = append(args, "XX")
+		}
+	}
+	return noValue(c.Do(ctx, "SET", args...))
+}
+
+// get the value of a key
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return stringValue(c.Do(ctx, "GET", key))
+}
+
+// get the value of a key and its revision
+func (c *Client) GetWithRevision(ctx context.Context, key string) (string, uint64, error) {
+	fields, err := mapValue(c.Do(ctx, "GET", key, "WITHREVISION"))
+	if err != nil {
+		return "", 0, err
+	}
+	value, err := stringValue(fields["value"], nil)
+	if err != nil {
+		return "", 0, err
+	}
+	revision, err := intValue(fields["revision"], nil)
+	return value, uint64(revision), err
+}
+
+// set the value of a key if it is still at the revision, 0 meaning it does
+// not exist, and return the new revision
+func (c *Client) CAS(ctx context.Context, key string, revision uint64, value string, ttl time.Duration) (uint64, error) {
+	args := []string{key, strconv.FormatUint(revision, 10), value}
+	if ttl > 0 {
+		args = append(args, "EX", seconds(ttl))
+	}
+	newRevision, err := intValue(c.Do(ctx, "CAS", args...))
+	return uint64(newRevision), err
+}
+
+// delete a key
+func (c *Client) Del(ctx context.Context, key string) error {
+	return noValue(c.Do(ctx, "DEL", key))
+}
+
+// append to the string of a key and return its new length
+func (c *Client) Append(ctx context.Context, key, value string) (int, error) {
+	length, err := intValue(c.Do(ctx, "APPEND", key, value))
+	return int(length), err
+}
+
+// return the length of the string of a key
+func (c *Client) Strlen(ctx context.Context, key string) (int, error) {
+	length, err := intValue(c.Do(ctx, "STRLEN", key))
+	return int(length), err
+}
+
+// return the bytes of the string of a key from start to end inclusive,
+// negative offsets counting from the end
+func (c *Client) GetRange(ctx context.Context, key string, start, end int) (string, error) {
+	return stringValue(c.Do(ctx, "GETRANGE", key, strconv.Itoa(start), strconv.Itoa(end)))
+}
+
+// overwrite the string of a key from the offset and return its new length
+func (c *Client) SetRange(ctx context.Context, key string, offset int, value string) (int, error) {
+	length, err := intValue(c.Do(ctx, "SETRANGE", key, strconv.Itoa(offset), value))
+	return int(length), err
+}
+
+// get the string of a key and delete the key
+func (c *Client) GetDel(ctx context.Context, key string) (string, error) {
+	return stringValue(c.Do(ctx, "GETDEL", key))
+}
+
+// get the string of a key and make it expire at the time, or never for the zero time
+func (c *Client) GetEx(ctx context.Context, key string, expiration time.Time) (string, error) {
+	if expiration.IsZero() {
+		return stringValue(c.Do(ctx, "GETEX", key, "PERSIST"))
+	}
+	return stringValue(c.Do(ctx, "GETEX", key, "PXAT", strconv.FormatInt(expiration.UnixMilli(), 10)))
+}
+
+// get the values of the keys, nil for missing ones
+func (c *Client) MGet(ctx context.Context, keys ...string) ([]*string, error) {
+	reply, err := c.Do(ctx, "MGET", keys...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.Value.([]handlers.Reply)
+	if reply.Type != handlers.ReplyArray || !ok {
+		return nil, ErrUnexpectedReply
+	}
+	values := make([]*string, len(items))
+	for i, item := range items {
+		if item.Type == handlers.ReplyNull {
+			continue
+		}
+		value, err := stringValue(item, nil)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = &value
+	}
+	return values, nil
+}
+
+// return the arguments of MSET and MSETNX
+func pairs(values map[string]string) []string {
+	args := make([]string, 0, 2*len(values))
+	for key, value := range values {
+		args = append(args, key, value)
+	}
+	return args
+}
+
+// set several keys at once
+func (c *Client) MSet(ctx context.Context, values map[string]string) error {
+	return noValue(c.Do(ctx, "MSET", pairs(values)...))
+}
+
+// set several keys at once if none of them exists and report whether they were set
+func (c *Client) MSetNX(ctx context.Context, values map[string]string) (bool, error) {
+	count, err := intValue(c.Do(ctx, "MSETNX", pairs(values)...))
+	return count > 0, err
+}
+
+// return the keys matching the glob pattern
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return stringsValue(c.Do(ctx, "KEYS", pattern))
+}
+
+// run one step of a scan and return the cursor of the next one, 0 once the
+// scan is complete
+func (c *Client) Scan(ctx context.Context, cursor uint64, options *ScanOptions) (uint64, []string, error) {
+	args := []string{strconv.FormatUint(cursor, 10)}
+	if options != nil {
+		if options.Match != "" {
+			args = append(args, "MATCH", options.Match)
+		}
+		if options.Count > 0 {
+			args = append(args, "COUNT", strconv.Itoa(options.Count))
+		}
+		if options.Type != "" {
+			args = append(args, "TYPE", options.Type)
+		}
+	}
+	fields, err := mapValue(c.Do(ctx, "SCAN", args...))
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := stringValue(fields["cursor"], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	keys, err := stringsValue(fields["keys"], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	cursor, err = strconv.ParseUint(next, 10, 64)
+	if err != nil {
+		return 0, nil, ErrUnexpectedReply
+	}
+	return cursor, keys, nil
+}
+
+// return the keys and values from start to end in lexicographic order
+func (c *Client) Range(ctx context.Context, start, end string, options *RangeOptions) ([]Entry, error) {
+	args := []string{start, end}
+	if options != nil {
+		if options.Limit > 0 {
+			args = append(args, "LIMIT", strconv.Itoa(options.Limit))
+		}
+		if options.Reverse {
+			args = append(args, "REV")
+		}
+	}
+	reply, err := c.Do(ctx, "RANGE", args...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.Value.([]handlers.Reply)
+	if reply.Type != handlers.ReplyArray || !ok {
+		return nil, ErrUnexpectedReply
+	}
+	entries := make([]Entry, len(items))
+	for i, item := range items {
+		fields, err := mapValue(item, nil)
+		if err != nil {
+			return nil, err
+		}
+		if entries[i].Key, err = stringValue(fields["key"], nil); err != nil {
+			return nil, err
+		}
+		if entries[i].Value, err = stringValue(fields["value"], nil); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// count the keys starting with the prefix
+func (c *Client) PrefixCount(ctx context.Context, prefix string) (int, error) {
+	count, err := intValue(c.Do(ctx, "PREFIXCOUNT", prefix))
+	return int(count), err
+}
+
+// delete up to limit keys starting with the prefix, all of them for a limit
+// of 0, and return how many were deleted
+func (c *Client) PrefixDel(ctx context.Context, prefix string, limit int) (int, error) {
+	args := []string{prefix}
+	if limit > 0 {
+		args = append(args, "LIMIT", strconv.Itoa(limit))
+	}
+	count, err := intValue(c.Do(ctx, "PREFIXDEL", args...))
+	return int(count), err
+}
+
+// delete every key of the namespace
+func (c *Client) FlushDB(ctx context.Context) error {
+	return noValue(c.Do(ctx, "FLUSHDB"))
+}
+
+// return the statistics of the namespace
+func (c *Client) Info(ctx context.Context) (database.Stats, error) {
+	fields, err := mapValue(c.Do(ctx, "INFO"))
+	if err != nil {
+		return database.Stats{}, err
+	}
+	field := func(name string) int64 {
+		value, _ := fields[name].Value.(int64)
+		return value
+	}
+	return database.Stats{
+		Keys:        int(field("keys")),
+		Volatile:    int(field("volatile")),
+		MemoryUsage: field("memory_usage"),
+		Hits:        uint64(field("hits")),
+		Misses:      uint64(field("misses")),
+		Expired:     uint64(field("expired")),
+		Evicted:     uint64(field("evicted")),
+		Revision:    uint64(field("revision")),
+	}, nil
+}
+
+// send a message to the subscribers of the channel and return how many received it
+func (c *Client) Publish(ctx context.Context, channel, message string) (int, error) {
+	count, err := intValue(c.Do(ctx, "PUBLISH", channel, message))
+	return int(count), err
+}
+
+// append values to a queue
+func (c *Client) QPush(ctx context.Context, key string, values ...string) error {
+	return noValue(c.Do(ctx, "QPUSH", append([]string{key}, values...)...))
+}
+
+// remove and return the last value of a queue. An empty queue matches
+// database.ErrQueueEmpty.
+func (c *Client) QPop(ctx context.Context, key string) (string, error) {
+	return stringValue(c.Do(ctx, "QPOP", key))
+}
+
+// remove and return the last value of a queue, waiting up to the timeout for
+// one to arrive. Returns database.ErrTimeout if none did.
+func (c *Client) BQPop(ctx context.Context, key string, timeout time.Duration) (string, error) {
+	reply, err := c.Do(ctx, "BQPOP", key, strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	if err == nil && reply.Type == handlers.ReplyNull {
+		return "", database.ErrTimeout
+	}
+	return stringValue(reply, err)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the most lines kept in the history
+const maxHistory = 1000
+
+// returned by readLine when the line is abandoned with Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// a line editor with history and completion of command names. It edits the
+// line in raw mode when the input is a terminal and otherwise reads plain
+// lines.
+type editor struct {
+	in       *os.File
+	reader   *bufio.Reader
+	out      io.Writer
+	commands []string
+
+	history     []string
+	historyFile *os.File
+}
+
+func newEditor(in *os.File, out io.Writer, commands []string) *editor {
+	sorted := append([]string(nil), commands...)
+	sort.Strings(sorted)
+	return &editor{in: in, reader: bufio.NewReader(in), out: out, commands: sorted}
+}
+
+// load the history from the file and append the lines entered from now on to it
+func (e *editor) loadHistory(path string) {
+	if content, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if line != "" {
+				e.history = append(e.history, line)
+			}
+		}
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+		}
+	}
+	e.historyFile, _ = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// add the line to the history unless it repeats the previous one
+func (e *editor) addHistory(line string) {
+	if strings.ContainsAny(line, "\r\n") || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[1:]
+	}
+	if e.historyFile != nil {
+		fmt.Fprintln(e.historyFile, line)
+	}
+}
+
+// return the command names starting with the prefix, ignoring case
+func (e *editor) complete(prefix string) []string {
+	var matches []string
+	for _, name := range e.commands {
+		if strings.HasPrefix(name, strings.ToUpper(prefix)) {
+			matches = append(matches, name)
+		}
+	}
+	return matches
+}
+
+// read a line after showing the prompt
+func (e *editor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(int(e.in.Fd()))
+	if err != nil {
+		// not a terminal, so there is nothing to edit
+		fmt.Fprint(e.out, prompt)
+		line, err := e.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+
+	s := &lineState{editor: e, prompt: prompt, index: len(e.history)}
+	s.refresh()
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(s.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.delete()
+		case 127, 8: // backspace
+			if s.cursor > 0 {
+				s.cursor--
+				s.delete()
+			}
+		case 1: // Ctrl-A
+			s.cursor = 0
+		case 5: // Ctrl-E
+			s.cursor = len(s.line)
+		case 21: // Ctrl-U
+			s.line = append([]rune(nil), s.line[s.cursor:]...)
+			s.cursor = 0
+		case 11: // Ctrl-K
+			s.line = s.line[:s.cursor]
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case '\t':
+			s.complete()
+		case 27:
+			s.escape()
+		default:
+			if r >= 32 {
+				s.insert(r)
+			}
+		}
+		s.refresh()
+	}
+}
+
+// the line being edited
+type lineState struct {
+	*editor
+	prompt string
+	line   []rune
+	cursor int
+	// the history entry shown and the line typed before browsing the history
+	index int
+	draft []rune
+}
+
+// redraw the prompt and the line and place the cursor
+func (s *lineState) refresh() {
+	fmt.Fprintf(s.out, "\r%s%s\x1b[K", s.prompt, string(s.line))
+	if back := len(s.line) - s.cursor; back > 0 {
+		fmt.Fprintf(s.out, "\x1b[%dD", back)
+	}
+}
+
+func (s *lineState) insert(r rune) {
+	s.line = append(s.line[:s.cursor], append([]rune{r}, s.line[s.cursor:]...)...)
+	s.cursor++
+}
+
+// delete the rune under the cursor
+func (s *lineState) delete() {
+	if s.cursor < len(s.line) {
+		s.line = append(s.line[:s.cursor], s.line[s.cursor+1:]...)
+	}
+}
+
+// show the history entry at the index, or the draft past the last entry
+func (s *lineState) browse(index int) {
+	if index < 0 || index > len(s.history) {
+		return
+	}
+	if s.index == len(s.history) {
+		s.draft = s.line
+	}
+	s.index = index
+	if index == len(s.history) {
+		s.line = s.draft
+	} else {
+		s.line = []rune(s.history[index])
+	}
+	s.cursor = len(s.line)
+}
+
+// complete the command name under the cursor to the longest common prefix
+// of the names it starts, listing them if that adds nothing
+func (s *lineState) complete() {
+	word := string(s.line[:s.cursor])
+	if strings.ContainsAny(word, " \t") {
+		return
+	}
+	matches := s.editor.complete(word)
+	if len(matches) == 0 {
+		return
+	}
+
+	prefix := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(matches) == 1 {
+		prefix += " "
+	}
+	if len(prefix) > len(word) {
+		s.line = append([]rune(prefix), s.line[s.cursor:]...)
+		s.cursor = len([]rune(prefix))
+		return
+	}
+	fmt.Fprintf(s.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+}
+
+// handle the escape sequence of a special key
+func (s *lineState) escape() {
+	r, _, err := s.reader.ReadRune()
+	if err != nil || r != '[' && r != 'O' {
+		return
+	}
+	r, _, err = s.reader.ReadRune()
+	if err != nil {
+		return
+	}
+	switch r {
+	case 'A': // up
+		s.browse(s.index - 1)
+	case 'B': // down
+		s.browse(s.index + 1)
+	case 'C': // right
+		if s.cursor < len(s.line) {
+			s.cursor++
+		}
+	case 'D': // left
+		if s.cursor > 0 {
+			s.cursor--
+		}
+	case 'H':
+		s.cursor = 0
+	case 'F':
+		s.cursor = len(s.line)
+	case '3': // delete, sent as ESC [ 3 ~
+		if next, _, err := s.reader.ReadRune(); err == nil && next == '~' {
+			s.delete()
+		}
+	}
+}
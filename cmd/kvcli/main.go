@@ -0,0 +1,255 @@
+// kvcli sends commands to the key value store, either interactively, as a
+// single command given on the command line or in bulk from stdin.
+//
+//	kvcli                      start the interactive prompt
+//	kvcli SET greeting hello   run one command and exit
+//	kvcli --pipe < commands    run one command per line of stdin
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/7dpk/keyvaluestore/certs"
+	"github.com/7dpk/keyvaluestore/client"
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// how many piped commands are sent per batch
+const pipeBatchSize = 1000
+
+func main() {
+	serverURL := flag.String("url", "http://localhost:8080", "address of the server")
+	namespace := flag.String("n", "", "namespace to run the commands in")
+	pipe := flag.Bool("pipe", false, "read commands from stdin, one per line, and send them in batches")
+	token := flag.String("token", os.Getenv("KVS_TOKEN"), "API token to authenticate with, KVS_TOKEN by default")
+	caFile := flag.String("cacert", "", "PEM bundle of the CAs to verify an https server with instead of the system ones")
+	certFile := flag.String("cert", "", "PEM client certificate to authenticate with")
+	keyFile := flag.String("key", "", "PEM private key of the client certificate")
+	flag.Parse()
+
+	tlsConfig, err := loadTLSConfig(*caFile, *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	c := client.NewClient(*serverURL, client.Options{Namespace: *namespace, Token: *token, TLSConfig: tlsConfig})
+	switch {
+	case *pipe:
+		os.Exit(runPipe(c, os.Stdin, os.Stdout))
+	case flag.NArg() > 0:
+		os.Exit(runOnce(c, flag.Args(), os.Stdout))
+	default:
+		runREPL(c, prompt(*serverURL, *namespace))
+	}
+}
+
+// return the TLS settings of the flags, nil if none is given
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: %w", caFile, certs.ErrNoCertificates)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// return the prompt of the REPL, the host of the server and the namespace
+func prompt(serverURL, namespace string) string {
+	host := serverURL
+	if u, err := url.Parse(serverURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if namespace != "" {
+		host += "[" + namespace + "]"
+	}
+	return host + "> "
+}
+
+// send a command and return its reply, turning a failed request into an error reply
+func send(c *client.Client, command []string) handlers.Reply {
+	reply, err := c.Do(context.Background(), command[0], command[1:]...)
+	if err != nil {
+		var replyErr *client.Error
+		if errors.As(err, &replyErr) {
+			return handlers.ErrorReply(replyErr.Code, replyErr.Message)
+		}
+		return handlers.ErrorReply("", err.Error())
+	}
+	return reply
+}
+
+// run the command given as arguments and return the exit code, 1 if it failed
+func runOnce(c *client.Client, command []string, w io.Writer) int {
+	reply := send(c, command)
+	fmt.Fprintln(w, formatReply(reply))
+	if reply.Type == handlers.ReplyError {
+		return 1
+	}
+	return 0
+}
+
+// run the commands read from r, one per line, and return the exit code, 1
+// if any of them failed
+func runPipe(c *client.Client, r io.Reader, w io.Writer) int {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var batch [][]string
+	replies, failed := 0, 0
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		results, err := c.Batch(context.Background(), batch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return false
+		}
+		for _, reply := range results {
+			fmt.Fprintln(w, formatReply(reply))
+			if reply.Type == handlers.ReplyError {
+				failed++
+			}
+		}
+		replies += len(results)
+		batch = batch[:0]
+		return true
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		words, err := commandparser.Tokenize(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", line, err)
+			failed++
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		batch = append(batch, words)
+		if len(batch) == pipeBatchSize && !flush() {
+			return 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if !flush() {
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "replies: %d, errors: %d\n", replies, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// return the names of the commands to complete, those of the server if it
+// can list them and otherwise the builtin ones
+func commandNames(c *client.Client) []string {
+	var names []string
+	if reply, err := c.Do(context.Background(), "COMMAND"); err == nil {
+		items, _ := reply.Value.([]handlers.Reply)
+		for _, item := range items {
+			fields, _ := item.Value.(map[string]handlers.Reply)
+			if name, ok := fields["name"].Value.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		for _, spec := range commandparser.Builtins() {
+			names = append(names, spec.Name)
+		}
+	}
+	return names
+}
+
+// print the documentation of the commands, or of every command
+func help(c *client.Client, names []string) {
+	reply, err := c.Do(context.Background(), "COMMAND", append([]string{"DOCS"}, names...)...)
+	if err != nil {
+		fmt.Println(formatReply(handlers.ErrorReply("", err.Error())))
+		return
+	}
+	docs, _ := reply.Value.(map[string]handlers.Reply)
+	for _, name := range sortedKeys(docs) {
+		fields, _ := docs[name].Value.(map[string]handlers.Reply)
+		syntax, _ := fields["syntax"].Value.(string)
+		summary, _ := fields["summary"].Value.(string)
+		if syntax == "" {
+			syntax = name
+		}
+		fmt.Printf("%s\n  %s\n", syntax, summary)
+	}
+}
+
+// read commands from the terminal until EOF or quit
+func runREPL(c *client.Client, prompt string) {
+	e := newEditor(os.Stdin, os.Stdout, commandNames(c))
+	if home, err := os.UserHomeDir(); err == nil {
+		e.loadHistory(filepath.Join(home, ".kvcli_history"))
+	}
+
+	for {
+		line, err := e.readLine(prompt)
+		if err == errInterrupted {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			}
+			return
+		}
+
+		words, err := commandparser.Tokenize(line)
+		if err != nil {
+			fmt.Println(formatReply(handlers.ErrorReply("SYNTAX_ERROR", err.Error())))
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		e.addHistory(line)
+
+		switch strings.ToUpper(words[0]) {
+		case "QUIT", "EXIT":
+			return
+		case "HELP":
+			help(c, words[1:])
+		default:
+			fmt.Println(formatReply(send(c, words)))
+		}
+	}
+}
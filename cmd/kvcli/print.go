@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// format a reply for people the way redis-cli does: quoted strings, typed
+// numbers and numbered items of arrays and maps, nested ones indented
+func formatReply(reply handlers.Reply) string {
+	return strings.Join(replyLines(reply), "\n")
+}
+
+// return the lines of a formatted reply
+func replyLines(reply handlers.Reply) []string {
+	switch reply.Type {
+	case handlers.ReplyString:
+		value, _ := reply.Value.(string)
+		return []string{strconv.Quote(value)}
+	case handlers.ReplyInteger:
+		return []string{fmt.Sprintf("(integer) %v", reply.Value)}
+	case handlers.ReplyFloat:
+		return []string{fmt.Sprintf("(float) %v", reply.Value)}
+	case handlers.ReplyNull:
+		return []string{"(nil)"}
+	case handlers.ReplyError:
+		if reply.Code == "" {
+			return []string{"(error) " + reply.Error}
+		}
+		return []string{"(error) " + reply.Code + " " + reply.Error}
+	case handlers.ReplyArray:
+		items, _ := reply.Value.([]handlers.Reply)
+		if len(items) == 0 {
+			return []string{"(empty array)"}
+		}
+		digits := len(strconv.Itoa(len(items)))
+		labels := make([]string, len(items))
+		for i := range items {
+			labels[i] = fmt.Sprintf("%*d) ", digits, i+1)
+		}
+		return itemLines(labels, items)
+	case handlers.ReplyMap:
+		fields, _ := reply.Value.(map[string]handlers.Reply)
+		if len(fields) == 0 {
+			return []string{"(empty map)"}
+		}
+		names := sortedKeys(fields)
+		digits := len(strconv.Itoa(len(names)))
+		labels := make([]string, len(names))
+		items := make([]handlers.Reply, len(names))
+		for i, name := range names {
+			labels[i] = fmt.Sprintf("%*d# %s => ", digits, i+1, name)
+			items[i] = fields[name]
+		}
+		return itemLines(labels, items)
+	}
+	return []string{fmt.Sprintf("(%s) %v", reply.Type, reply.Value)}
+}
+
+// return the lines of the items each preceded by its label, the lines of
+// nested items indented below it
+func itemLines(labels []string, items []handlers.Reply) []string {
+	var lines []string
+	for i, item := range items {
+		label := labels[i]
+		for j, line := range replyLines(item) {
+			if j == 0 {
+				lines = append(lines, label+line)
+			} else {
+				lines = append(lines, strings.Repeat(" ", len(label))+line)
+			}
+		}
+	}
+	return lines
+}
+
+// return the keys of the map in order
+func sortedKeys(fields map[string]handlers.Reply) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,23 +1,163 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/certs"
+	"github.com/7dpk/keyvaluestore/config"
 	"github.com/7dpk/keyvaluestore/database"
 	"github.com/7dpk/keyvaluestore/handlers"
-	"github.com/gorilla/mux"
+	"github.com/7dpk/keyvaluestore/memcached"
 )
 
 func main() {
-	database := database.NewDatabase()
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.LogFile != "" {
+		logFile, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	db := database.NewDatabase()
+	db.SetMaxMemory(cfg.MaxMemory, cfg.MaxMemoryPolicy)
+	db.SetExpiryInterval(cfg.ExpiryInterval)
+	namespaces := database.NewNamespaces(db)
+	if cfg.SnapshotPath != "" {
+		if err := namespaces.LoadSnapshot(cfg.SnapshotPath); err != nil {
+			log.Fatal(err)
+		}
+	}
 	handler := &handlers.HTTPHandler{
-		Database: database,
+		Database:        db,
+		Namespaces:      namespaces,
+		LegacyResponses: cfg.LegacyResponses,
+		Config:          cfg,
+	}
+	if cfg.ACLFile != "" {
+		handler.ACL = acl.New()
+		if err := handler.ACL.LoadFile(cfg.ACLFile); err != nil {
+			log.Fatal(err)
+		}
+		if cfg.MemcachedAddr != "" && !cfg.MemcachedInsecure {
+			log.Fatal("the memcached protocol does not authenticate clients: set memcached-addr to \"\" to disable it, or memcached-insecure to serve it anyway")
+		}
+	}
+	if cfg.AuditFile != "" {
+		auditFile, err := os.OpenFile(cfg.AuditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer auditFile.Close()
+		handler.Audit = acl.NewAuditLog(auditFile, acl.DefaultAuditLogSize)
+	}
+
+	router := handlers.NewRouter(handler)
+	reloader := loadCertificates(cfg)
+	if cfg.MemcachedTLS && reloader == nil {
+		log.Fatal("memcached-tls needs tls-cert-file and tls-key-file")
 	}
 
-	router := mux.NewRouter()
-	router.HandleFunc("/", handler.HandleRequest).Methods("POST")
+	var memcachedListener net.Listener
+	if cfg.MemcachedAddr != "" {
+		memcachedListener, err = net.Listen("tcp", cfg.MemcachedAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.MemcachedTLS {
+			memcachedListener = tls.NewListener(memcachedListener, reloader.TLSConfig())
+		}
+		memcachedServer := &memcached.Server{
+			Database: db,
+		}
+		go memcachedServer.Serve(memcachedListener)
+	}
+
+	server := &http.Server{Addr: cfg.HTTPAddr, Handler: router}
+	if reloader != nil {
+		server.TLSConfig = reloader.TLSConfig("h2", "http/1.1")
+	}
+	go func() {
+		log.Println("Server started on", cfg.HTTPAddr)
+		var err error
+		if reloader != nil {
+			// the certificate is served by the TLS config
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Println("Server started")
-	log.Fatal(http.ListenAndServe(":8080", router))
+	// shut down on the first SIGINT or SIGTERM, a second one kills the server
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+	shutdown(server, memcachedListener, namespaces, cfg)
+}
+
+// return the certificate of the settings, reloaded when its files change, or
+// nil to serve plaintext
+func loadCertificates(cfg *config.Config) *certs.Reloader {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			log.Fatal("tls-client-ca-file needs tls-cert-file and tls-key-file")
+		}
+		return nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		log.Fatal("tls-cert-file and tls-key-file must be given together")
+	}
+	reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, cfg.TLSClientAuth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.Watch(cfg.TLSReloadInterval)
+	return reloader
+}
+
+// stop accepting connections, wake blocked BQPOP callers, wait for the
+// requests in flight up to the shutdown timeout and save the snapshot
+func shutdown(server *http.Server, memcachedListener net.Listener, namespaces *database.Namespaces, cfg *config.Config) {
+	if memcachedListener != nil {
+		memcachedListener.Close()
+	}
+	// blocked pops answer right away rather than holding up the shutdown
+	namespaces.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Closing requests still in flight:", err)
+		server.Close()
+	}
+
+	if cfg.SnapshotPath != "" {
+		if err := namespaces.SaveSnapshot(cfg.SnapshotPath); err != nil {
+			log.Fatal("Saving snapshot: ", err)
+		}
+		log.Println("Snapshot saved to", cfg.SnapshotPath)
+	}
 }
@@ -2,58 +2,164 @@ package commandparser
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
-// parses the command string and returns the command keyword and parameters
-func ParseCommand(command string) (string, []string, error) {
-	// Trim leading and trailing whitespaces
-	command = strings.TrimSpace(command)
+var (
+	ErrEmptyCommand   = errors.New("empty command")
+	ErrInvalidCommand = errors.New("invalid command")
+	// matched by every ParseError
+	ErrSyntax = errors.New("syntax error")
+	// the arguments have the right count but a malformed or out of range value
+	ErrInvalidArgument = errors.New("invalid argument")
+)
 
-	// Split the command into words
-	words := strings.Fields(command)
-	if len(words) == 0 {
-		return "", nil, errors.New("empty command")
-	}
+// describe a malformed command string and where in it the problem was found
+type ParseError struct {
+	// 1-based byte position of the offending character
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
 
-	// Extract the command keyword and parameters
-	cmd := strings.ToUpper(words[0])
-	params := words[1:]
+func (e *ParseError) Unwrap() error {
+	return ErrSyntax
+}
 
-	// Check the validity of the command and parameters
-	if err := validateCommand(cmd, params); err != nil {
-		return "", nil, err
-	}
+// an invalid argument described by its own message, matching ErrInvalidArgument
+type argumentError string
 
-	return cmd, params, nil
+func (e argumentError) Error() string {
+	return string(e)
 }
 
-// validateCommand checks the validity of the command and parameters
-func validateCommand(cmd string, params []string) error {
-	switch cmd {
-	case "SET":
-		if len(params) < 2 {
-			return errors.New("invalid command")
-		}
-	case "GET":
-		if len(params) != 1 {
-			return errors.New("invalid command")
-		}
-	case "QPUSH":
-		if len(params) < 2 {
-			return errors.New("invalid command")
+func (e argumentError) Unwrap() error {
+	return ErrInvalidArgument
+}
+
+// return an error with the message that matches ErrInvalidArgument with errors.Is
+func InvalidArgument(msg string) error {
+	return argumentError(msg)
+}
+
+// split the command string into words. Runs of whitespace separate words.
+// Double quoted strings may contain the escapes \" \\ \n \r \t \b \a and
+// \xHH, single quoted strings are taken literally apart from \'. A closing
+// quote must be followed by whitespace or the end of the command.
+func Tokenize(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '"' || c == '\'':
+			end, err := readQuoted(command, i, &word)
+			if err != nil {
+				return nil, err
+			}
+			if end+1 < len(command) && !isSpace(command[end+1]) {
+				return nil, &ParseError{Pos: end + 2, Msg: "closing quote must be followed by a space"}
+			}
+			inWord = true
+			i = end
+		default:
+			word.WriteByte(c)
+			inWord = true
 		}
-	case "QPOP":
-		if len(params) != 1 {
-			return errors.New("invalid command")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// read the quoted string opening at start into word and return the index of the closing quote
+func readQuoted(command string, start int, word *strings.Builder) (int, error) {
+	quote := command[start]
+	for i := start + 1; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == quote:
+			return i, nil
+		case c == '\\' && quote == '\'':
+			if i+1 < len(command) && command[i+1] == '\'' {
+				word.WriteByte('\'')
+				i++
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\':
+			if i+1 >= len(command) {
+				return 0, &ParseError{Pos: i + 1, Msg: "unterminated escape sequence"}
+			}
+			n, err := readEscape(command, i, word)
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		default:
+			word.WriteByte(c)
 		}
-	case "BQPOP":
-		if len(params) != 2 {
-			return errors.New("invalid command")
+	}
+	return 0, &ParseError{Pos: start + 1, Msg: "unterminated quoted string"}
+}
+
+// decode the escape sequence starting at the backslash at index i and return
+// how many bytes after the backslash it consumed
+func readEscape(command string, i int, word *strings.Builder) (int, error) {
+	switch command[i+1] {
+	case 'n':
+		word.WriteByte('\n')
+	case 'r':
+		word.WriteByte('\r')
+	case 't':
+		word.WriteByte('\t')
+	case 'b':
+		word.WriteByte('\b')
+	case 'a':
+		word.WriteByte('\a')
+	case '"', '\\', '\'':
+		word.WriteByte(command[i+1])
+	case 'x':
+		if i+3 >= len(command) || !isHex(command[i+2]) || !isHex(command[i+3]) {
+			return 0, &ParseError{Pos: i + 1, Msg: "invalid hex escape sequence"}
 		}
+		word.WriteByte(unhex(command[i+2])<<4 | unhex(command[i+3]))
+		return 3, nil
 	default:
-		return errors.New("invalid command")
+		return 0, &ParseError{Pos: i + 1, Msg: fmt.Sprintf("invalid escape sequence \\%c", command[i+1])}
 	}
+	return 1, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
 
-	return nil
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
 }
@@ -0,0 +1,332 @@
+package commandparser
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// flags describing how a command behaves
+const (
+	// the command modifies keys
+	FlagWrite = "write"
+	// the command only reads keys
+	FlagReadOnly = "readonly"
+	// the command may wait for data to arrive
+	FlagBlocking = "blocking"
+	// the command is handled by the session, such as its transaction,
+	// namespace or user, instead of running against a database
+	FlagSession = "session"
+	// the command delivers messages to subscribers
+	FlagPubSub = "pubsub"
+	// the command inspects or changes how the server runs
+	FlagAdmin = "admin"
+	// the command reaches keys that are not among its arguments, such as the
+	// keys matching a pattern or every key of a namespace
+	FlagAllKeys = "allkeys"
+)
+
+var (
+	ErrCommandExists = errors.New("command already registered")
+	ErrInvalidSpec   = errors.New("invalid command spec")
+)
+
+// the declaration of a command: its name, the arguments it accepts, how it
+// behaves and where its keys are
+type Spec struct {
+	Name string
+	// the number of arguments after the name, MaxArgs is -1 for no limit
+	MinArgs int
+	MaxArgs int
+	Flags   []string
+	// the 1-based positions of the first and last key among the arguments
+	// and the step between keys. FirstKey is 0 for commands without keys and
+	// a negative LastKey counts from the end, -1 being the last argument.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	// further checks of the arguments, nil if the count is all that matters
+	Validate func(args []string) error
+
+	// documentation returned by COMMAND DOCS
+	Group   string
+	Syntax  string
+	Summary string
+}
+
+// report whether the spec has the flag
+func (s Spec) HasFlag(flag string) bool {
+	for _, f := range s.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// check the arguments against the spec
+func (s Spec) Check(args []string) error {
+	if len(args) < s.MinArgs || s.MaxArgs >= 0 && len(args) > s.MaxArgs {
+		return ErrInvalidCommand
+	}
+	if s.Validate != nil {
+		return s.Validate(args)
+	}
+	return nil
+}
+
+// return the keys among the arguments
+func (s Spec) Keys(args []string) []string {
+	if s.FirstKey <= 0 || s.FirstKey > len(args) {
+		return nil
+	}
+	last := s.LastKey
+	if last < 0 {
+		last += len(args) + 1
+	}
+	last = min(last, len(args))
+	step := max(s.KeyStep, 1)
+
+	var keys []string
+	for i := s.FirstKey; i <= last; i += step {
+		keys = append(keys, args[i-1])
+	}
+	return keys
+}
+
+// a set of command specs looked up by name
+type Registry struct {
+	lock  sync.RWMutex
+	specs map[string]Spec
+}
+
+// create a registry holding the specs
+func NewRegistry(specs ...Spec) *Registry {
+	r := &Registry{specs: make(map[string]Spec)}
+	for _, spec := range specs {
+		if err := r.Register(spec); err != nil {
+			panic(spec.Name + ": " + err.Error())
+		}
+	}
+	return r
+}
+
+// add a spec. The name is case insensitive and may not be taken already.
+func (r *Registry) Register(spec Spec) error {
+	spec.Name = strings.ToUpper(strings.TrimSpace(spec.Name))
+	if spec.Name == "" || strings.ContainsAny(spec.Name, " \t\r\n") ||
+		spec.MinArgs < 0 || spec.MaxArgs >= 0 && spec.MaxArgs < spec.MinArgs {
+		return ErrInvalidSpec
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exists := r.specs[spec.Name]; exists {
+		return ErrCommandExists
+	}
+	r.specs[spec.Name] = spec
+	return nil
+}
+
+// return the spec of the command
+func (r *Registry) Lookup(name string) (Spec, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	spec, exists := r.specs[strings.ToUpper(name)]
+	return spec, exists
+}
+
+// return every spec sorted by name
+func (r *Registry) Specs() []Spec {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	specs := make([]Spec, 0, len(r.specs))
+	for _, spec := range r.specs {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs
+}
+
+// return a new registry holding the same specs
+func (r *Registry) Clone() *Registry {
+	return NewRegistry(r.Specs()...)
+}
+
+// parse the command string and return the command keyword and parameters
+func (r *Registry) ParseCommand(command string) (string, []string, error) {
+	words, err := Tokenize(command)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(words) == 0 {
+		return "", nil, ErrEmptyCommand
+	}
+	return r.ParseArgs(words[0], words[1:])
+}
+
+// validate a command whose arguments are already split and return the
+// normalized command keyword and parameters
+func (r *Registry) ParseArgs(command string, args []string) (string, []string, error) {
+	cmd := strings.ToUpper(strings.TrimSpace(command))
+	if cmd == "" {
+		return "", nil, ErrEmptyCommand
+	}
+	spec, exists := r.Lookup(cmd)
+	if !exists {
+		return "", nil, ErrInvalidCommand
+	}
+	if err := spec.Check(args); err != nil {
+		return "", nil, err
+	}
+	return cmd, args, nil
+}
+
+// require an even number of arguments, for commands taking key value pairs
+func evenArgs(args []string) error {
+	if len(args)%2 != 0 {
+		return ErrInvalidCommand
+	}
+	return nil
+}
+
+// the number of arguments after the subcommand each ACL subcommand takes,
+// the maximum is -1 for no limit
+var aclSubcommands = map[string][2]int{
+	"SETUSER": {1, -1},
+	"DELUSER": {1, -1},
+	"GETUSER": {1, 1},
+	"LIST":    {0, 0},
+	"USERS":   {0, 0},
+	"CAT":     {0, 1},
+	"LOG":     {0, 1},
+	"LOAD":    {0, 0},
+	"SAVE":    {0, 0},
+}
+
+// require a known ACL subcommand with the arguments it takes
+func aclArgs(args []string) error {
+	arity, exists := aclSubcommands[strings.ToUpper(args[0])]
+	n := len(args) - 1
+	if !exists || n < arity[0] || arity[1] >= 0 && n > arity[1] {
+		return ErrInvalidCommand
+	}
+	return nil
+}
+
+// require CONFIG GET with a pattern or CONFIG SET with setting value pairs
+func configArgs(args []string) error {
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) == 2 {
+			return nil
+		}
+	case "SET":
+		if len(args)%2 == 1 {
+			return nil
+		}
+	}
+	return ErrInvalidCommand
+}
+
+// the specs of the commands every server supports
+var builtins = NewRegistry(
+	Spec{Name: "SET", MinArgs: 2, MaxArgs: -1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "SET key value [EX seconds] [NX|XX]", Summary: "Set the value of a key"},
+	Spec{Name: "GET", MinArgs: 1, MaxArgs: 2, Flags: []string{FlagReadOnly}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "GET key [WITHREVISION]", Summary: "Get the value of a key, and optionally its revision"},
+	Spec{Name: "CAS", MinArgs: 3, MaxArgs: 5, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "CAS key revision value [EX seconds]", Summary: "Set the value of a key if it is still at the revision"},
+	Spec{Name: "DEL", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Syntax: "DEL key", Summary: "Delete a key"},
+	Spec{Name: "APPEND", MinArgs: 2, MaxArgs: 2, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "APPEND key value", Summary: "Append to the string of a key"},
+	Spec{Name: "STRLEN", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagReadOnly}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "STRLEN key", Summary: "Get the length of the string of a key"},
+	Spec{Name: "GETRANGE", MinArgs: 3, MaxArgs: 3, Flags: []string{FlagReadOnly}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "GETRANGE key start end", Summary: "Get a range of bytes of the string of a key"},
+	Spec{Name: "SETRANGE", MinArgs: 3, MaxArgs: 3, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "SETRANGE key offset value", Summary: "Overwrite part of the string of a key"},
+	Spec{Name: "GETDEL", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "GETDEL key", Summary: "Get the string of a key and delete the key"},
+	Spec{Name: "GETEX", MinArgs: 1, MaxArgs: 3, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Syntax: "GETEX key [EX seconds|PX milliseconds|EXAT unix-seconds|PXAT unix-milliseconds|PERSIST]", Summary: "Get the string of a key and replace its expiration"},
+	Spec{Name: "MGET", MinArgs: 1, MaxArgs: -1, Flags: []string{FlagReadOnly}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Group: "string", Syntax: "MGET key [key ...]", Summary: "Get the values of several keys"},
+	Spec{Name: "MSET", MinArgs: 2, MaxArgs: -1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: -1, KeyStep: 2, Validate: evenArgs,
+		Group: "string", Syntax: "MSET key value [key value ...]", Summary: "Set several keys"},
+	Spec{Name: "MSETNX", MinArgs: 2, MaxArgs: -1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: -1, KeyStep: 2, Validate: evenArgs,
+		Group: "string", Syntax: "MSETNX key value [key value ...]", Summary: "Set several keys if none of them exists"},
+	Spec{Name: "QPUSH", MinArgs: 2, MaxArgs: -1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "queue", Syntax: "QPUSH key value [value ...]", Summary: "Append values to a queue"},
+	Spec{Name: "QPOP", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "queue", Syntax: "QPOP key", Summary: "Remove and return the last value of a queue"},
+	Spec{Name: "BQPOP", MinArgs: 2, MaxArgs: 2, Flags: []string{FlagWrite, FlagBlocking}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "queue", Syntax: "BQPOP key timeout", Summary: "Remove and return the last value of a queue, waiting for one up to the timeout"},
+	Spec{Name: "KEYS", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagReadOnly, FlagAllKeys},
+		Group: "keyspace", Syntax: "KEYS pattern", Summary: "List the keys matching a pattern"},
+	Spec{Name: "SCAN", MinArgs: 1, MaxArgs: -1, Flags: []string{FlagReadOnly, FlagAllKeys},
+		Group: "keyspace", Syntax: "SCAN cursor [MATCH pattern] [COUNT count] [TYPE string|queue]", Summary: "Iterate over the keys a few at a time"},
+	Spec{Name: "RANGE", MinArgs: 2, MaxArgs: -1, Flags: []string{FlagReadOnly, FlagAllKeys},
+		Group: "keyspace", Syntax: "RANGE start end [LIMIT count] [REV]", Summary: "List the keys and values in a lexicographic range"},
+	Spec{Name: "PREFIXCOUNT", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagReadOnly, FlagAllKeys},
+		Group: "keyspace", Syntax: "PREFIXCOUNT prefix", Summary: "Count the keys starting with a prefix"},
+	Spec{Name: "PREFIXDEL", MinArgs: 1, MaxArgs: -1, Flags: []string{FlagWrite, FlagAllKeys},
+		Group: "keyspace", Syntax: "PREFIXDEL prefix [LIMIT count]", Summary: "Delete the keys starting with a prefix"},
+	Spec{Name: "FLUSHDB", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagWrite, FlagAllKeys},
+		Group: "namespace", Syntax: "FLUSHDB", Summary: "Delete every key of the selected namespace"},
+	Spec{Name: "INFO", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagReadOnly},
+		Group: "namespace", Syntax: "INFO", Summary: "Get the statistics of the selected namespace"},
+	Spec{Name: "SELECT", MinArgs: 1, MaxArgs: 1, Flags: []string{FlagSession},
+		Group: "namespace", Syntax: "SELECT namespace", Summary: "Switch the namespace of the session"},
+	Spec{Name: "SWAPDB", MinArgs: 2, MaxArgs: 2, Flags: []string{FlagWrite, FlagSession, FlagAllKeys},
+		Group: "namespace", Syntax: "SWAPDB namespace namespace", Summary: "Exchange the keys of two namespaces"},
+	Spec{Name: "MULTI", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagSession},
+		Group: "transaction", Syntax: "MULTI", Summary: "Start queueing commands for a transaction"},
+	Spec{Name: "EXEC", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagSession},
+		Group: "transaction", Syntax: "EXEC", Summary: "Run the queued commands atomically"},
+	Spec{Name: "DISCARD", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagSession},
+		Group: "transaction", Syntax: "DISCARD", Summary: "Drop the queued commands"},
+	Spec{Name: "WATCH", MinArgs: 1, MaxArgs: -1, Flags: []string{FlagSession}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Group: "transaction", Syntax: "WATCH key [key ...]", Summary: "Abort the next EXEC if any of the keys changes"},
+	Spec{Name: "UNWATCH", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagSession},
+		Group: "transaction", Syntax: "UNWATCH", Summary: "Forget the watched keys"},
+	Spec{Name: "PUBLISH", MinArgs: 2, MaxArgs: 2, Flags: []string{FlagPubSub},
+		Group: "pubsub", Syntax: "PUBLISH channel message", Summary: "Send a message to the subscribers of a channel"},
+	Spec{Name: "CONFIG", MinArgs: 2, MaxArgs: -1, Flags: []string{FlagAdmin}, Validate: configArgs,
+		Group: "server", Syntax: "CONFIG GET pattern | CONFIG SET setting value [setting value ...]", Summary: "Read or change the settings of the server"},
+	Spec{Name: "COMMAND", MinArgs: 0, MaxArgs: -1, Flags: []string{FlagReadOnly},
+		Group: "server", Syntax: "COMMAND [COUNT|DOCS [command ...]]", Summary: "Describe the registered commands"},
+	Spec{Name: "ACL", MinArgs: 1, MaxArgs: -1, Flags: []string{FlagAdmin, FlagSession}, Validate: aclArgs,
+		Group: "server", Syntax: "ACL SETUSER user [rule ...] | DELUSER user [user ...] | GETUSER user | LIST | USERS | CAT [category] | LOG [count|RESET] | LOAD | SAVE", Summary: "Manage the users and what they may access"},
+	Spec{Name: "WHOAMI", MinArgs: 0, MaxArgs: 0, Flags: []string{FlagSession},
+		Group: "server", Syntax: "WHOAMI", Summary: "Get the name of the user the request is made as"},
+)
+
+// return the specs of the builtin commands sorted by name
+func Builtins() []Spec {
+	return builtins.Specs()
+}
+
+// return the spec of a builtin command
+func Lookup(name string) (Spec, bool) {
+	return builtins.Lookup(name)
+}
+
+// parses the command string and returns the command keyword and parameters
+// of a builtin command
+func ParseCommand(command string) (string, []string, error) {
+	return builtins.ParseCommand(command)
+}
+
+// validates a builtin command whose arguments are already split and returns
+// the normalized command keyword and parameters
+func ParseArgs(command string, args []string) (string, []string, error) {
+	return builtins.ParseArgs(command, args)
+}
@@ -0,0 +1,623 @@
+// Package config loads the settings of the server from its defaults, a
+// config file, environment variables and command line flags, and lets the
+// settings that can change safely be changed while it runs.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/certs"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/glob"
+	"github.com/7dpk/keyvaluestore/ratelimit"
+)
+
+// the prefix of the environment variables, e.g. KVS_HTTP_ADDR for http-addr
+const EnvPrefix = "KVS_"
+
+// how many namespaces each client may create unless configured otherwise
+const DefaultNamespacesPerClient = 16
+
+var (
+	ErrUnknownSetting = errors.New("unknown setting")
+	// the setting can only be given when the server starts
+	ErrReadOnlySetting = errors.New("setting can not be changed at runtime")
+	ErrInvalidValue    = errors.New("invalid value")
+)
+
+// the settings of the server. The fields may be read directly until the
+// server starts serving; afterwards Get, Set and Snapshot keep them consistent.
+type Config struct {
+	lock sync.RWMutex
+
+	// the address of the HTTP API
+	HTTPAddr string
+	// the address of the memcached protocol, empty to disable it
+	MemcachedAddr string
+	// serve the memcached protocol, which does not authenticate clients,
+	// even though ACLFile is set
+	MemcachedInsecure bool
+	// serve the memcached protocol over TLS with the certificate of the HTTP API
+	MemcachedTLS bool
+	// how often expired keys are removed
+	ExpiryInterval time.Duration
+	// memory limit in bytes, zero for none, and the eviction policy
+	MaxMemory       int64
+	MaxMemoryPolicy database.EvictionPolicy
+	// answer commands in the untyped format of earlier versions
+	LegacyResponses bool
+	// the file logs are appended to, empty for stderr
+	LogFile string
+	// log every HTTP request
+	LogRequests bool
+	// the file the keys are loaded from on startup and saved to on
+	// shutdown, empty to keep them in memory only
+	SnapshotPath string
+	// how long requests in flight may take to finish on shutdown
+	ShutdownTimeout time.Duration
+	// the file the users are loaded from on startup and by ACL LOAD and
+	// saved to by ACL SAVE, empty to start with a default user allowed
+	// everything
+	ACLFile string
+	// the file denied requests and ACL changes are appended to, empty for
+	// the server log
+	AuditFile string
+	// the certificate and key the HTTP API, and the memcached protocol if
+	// MemcachedTLS is set, are served with over TLS, empty to serve plaintext
+	TLSCertFile string
+	TLSKeyFile  string
+	// the CAs client certificates are verified against, empty to not ask
+	// for them, and whether every client must send one
+	TLSClientCAFile string
+	TLSClientAuth   certs.ClientAuth
+	// how often the certificate files are checked for changes
+	TLSReloadInterval time.Duration
+	// the commands each client may send per second, by class
+	RateLimitRead     ratelimit.Limit
+	RateLimitWrite    ratelimit.Limit
+	RateLimitBlocking ratelimit.Limit
+	// how many blocking commands each client may have waiting, zero for any number
+	RateLimitWaiters int
+	// how many namespaces each client may create, zero for any number
+	NamespacesPerClient int
+}
+
+// a setting: how it is named, read and written, and whether it may change at runtime
+type setting struct {
+	name    string
+	usage   string
+	mutable bool
+	boolean bool
+	get     func(c *Config) string
+	set     func(c *Config, value string) error
+}
+
+// every setting in the order they are documented
+var settings = []setting{
+	{
+		name:  "http-addr",
+		usage: "address the HTTP API listens on",
+		get:   func(c *Config) string { return c.HTTPAddr },
+		set:   func(c *Config, value string) error { c.HTTPAddr = value; return nil },
+	},
+	{
+		name:  "memcached-addr",
+		usage: "address the memcached protocol listens on, empty to disable it",
+		get:   func(c *Config) string { return c.MemcachedAddr },
+		set:   func(c *Config, value string) error { c.MemcachedAddr = value; return nil },
+	},
+	{
+		name:    "memcached-insecure",
+		usage:   "serve the memcached protocol, which does not authenticate clients, even though acl-file is set",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.MemcachedInsecure) },
+		set: func(c *Config, value string) error {
+			enabled, err := parseBool(value)
+			c.MemcachedInsecure = enabled
+			return err
+		},
+	},
+	{
+		name:    "memcached-tls",
+		usage:   "serve the memcached protocol over TLS with the certificate of tls-cert-file",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.MemcachedTLS) },
+		set: func(c *Config, value string) error {
+			enabled, err := parseBool(value)
+			c.MemcachedTLS = enabled
+			return err
+		},
+	},
+	{
+		name:    "expiry-interval",
+		usage:   "how often expired keys are removed, e.g. 1s or 250ms",
+		mutable: true,
+		get:     func(c *Config) string { return c.ExpiryInterval.String() },
+		set: func(c *Config, value string) error {
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return errors.New("invalid duration " + value)
+			}
+			c.ExpiryInterval = interval
+			return nil
+		},
+	},
+	{
+		name:    "maxmemory",
+		usage:   "memory limit for keys and values in bytes, with an optional kb, mb or gb suffix, 0 for none",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.FormatInt(c.MaxMemory, 10) },
+		set: func(c *Config, value string) error {
+			size, err := ParseSize(value)
+			c.MaxMemory = size
+			return err
+		},
+	},
+	{
+		name:    "maxmemory-policy",
+		usage:   "eviction policy once the memory limit is reached",
+		mutable: true,
+		get:     func(c *Config) string { return string(c.MaxMemoryPolicy) },
+		set: func(c *Config, value string) error {
+			policy, err := database.ParseEvictionPolicy(value)
+			c.MaxMemoryPolicy = policy
+			return err
+		},
+	},
+	{
+		name:    "legacy-responses",
+		usage:   "answer commands in the untyped response format of earlier versions",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.LegacyResponses) },
+		set: func(c *Config, value string) error {
+			enabled, err := parseBool(value)
+			c.LegacyResponses = enabled
+			return err
+		},
+	},
+	{
+		name:  "log-file",
+		usage: "file logs are appended to, empty for stderr",
+		get:   func(c *Config) string { return c.LogFile },
+		set:   func(c *Config, value string) error { c.LogFile = value; return nil },
+	},
+	{
+		name:    "log-requests",
+		usage:   "log every HTTP request",
+		mutable: true,
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.LogRequests) },
+		set: func(c *Config, value string) error {
+			enabled, err := parseBool(value)
+			c.LogRequests = enabled
+			return err
+		},
+	},
+	{
+		name:  "snapshot-path",
+		usage: "file the keys are loaded from on startup and saved to on shutdown, empty to disable persistence",
+		get:   func(c *Config) string { return c.SnapshotPath },
+		set:   func(c *Config, value string) error { c.SnapshotPath = value; return nil },
+	},
+	{
+		name:  "shutdown-timeout",
+		usage: "how long requests in flight may take to finish on shutdown",
+		get:   func(c *Config) string { return c.ShutdownTimeout.String() },
+		set: func(c *Config, value string) error {
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				return errors.New("invalid duration " + value)
+			}
+			c.ShutdownTimeout = timeout
+			return nil
+		},
+	},
+	{
+		name:  "acl-file",
+		usage: "file of the users and what they may access, empty to let every request run every command",
+		get:   func(c *Config) string { return c.ACLFile },
+		set:   func(c *Config, value string) error { c.ACLFile = value; return nil },
+	},
+	{
+		name:  "audit-file",
+		usage: "file denied requests and ACL changes are appended to, empty for the server log",
+		get:   func(c *Config) string { return c.AuditFile },
+		set:   func(c *Config, value string) error { c.AuditFile = value; return nil },
+	},
+	{
+		name:  "tls-cert-file",
+		usage: "PEM certificate to serve TLS with, empty to serve plaintext",
+		get:   func(c *Config) string { return c.TLSCertFile },
+		set:   func(c *Config, value string) error { c.TLSCertFile = value; return nil },
+	},
+	{
+		name:  "tls-key-file",
+		usage: "PEM private key of the TLS certificate",
+		get:   func(c *Config) string { return c.TLSKeyFile },
+		set:   func(c *Config, value string) error { c.TLSKeyFile = value; return nil },
+	},
+	{
+		name:  "tls-client-ca-file",
+		usage: "PEM bundle of the CAs client certificates are verified against, empty to not ask for client certificates",
+		get:   func(c *Config) string { return c.TLSClientCAFile },
+		set:   func(c *Config, value string) error { c.TLSClientCAFile = value; return nil },
+	},
+	{
+		name:  "tls-client-auth",
+		usage: "whether client certificates are verified if given (optional) or required of every client (require)",
+		get:   func(c *Config) string { return string(c.TLSClientAuth) },
+		set: func(c *Config, value string) error {
+			mode, err := certs.ParseClientAuth(value)
+			c.TLSClientAuth = mode
+			return err
+		},
+	},
+	{
+		name:  "tls-reload-interval",
+		usage: "how often the TLS certificate, key and client CA files are checked for changes",
+		get:   func(c *Config) string { return c.TLSReloadInterval.String() },
+		set: func(c *Config, value string) error {
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return errors.New("invalid duration " + value)
+			}
+			c.TLSReloadInterval = interval
+			return nil
+		},
+	},
+	{
+		name:    "ratelimit-read",
+		usage:   "read commands each client may send per second, as rate or rate/burst, 0 for no limit",
+		mutable: true,
+		get:     func(c *Config) string { return c.RateLimitRead.String() },
+		set: func(c *Config, value string) error {
+			limit, err := ratelimit.ParseLimit(value)
+			c.RateLimitRead = limit
+			return err
+		},
+	},
+	{
+		name:    "ratelimit-write",
+		usage:   "write commands each client may send per second, as rate or rate/burst, 0 for no limit",
+		mutable: true,
+		get:     func(c *Config) string { return c.RateLimitWrite.String() },
+		set: func(c *Config, value string) error {
+			limit, err := ratelimit.ParseLimit(value)
+			c.RateLimitWrite = limit
+			return err
+		},
+	},
+	{
+		name:    "ratelimit-blocking",
+		usage:   "blocking commands each client may send per second, as rate or rate/burst, 0 for no limit",
+		mutable: true,
+		get:     func(c *Config) string { return c.RateLimitBlocking.String() },
+		set: func(c *Config, value string) error {
+			limit, err := ratelimit.ParseLimit(value)
+			c.RateLimitBlocking = limit
+			return err
+		},
+	},
+	{
+		name:    "ratelimit-waiters",
+		usage:   "blocking commands each client may have waiting at once, 0 for any number",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.Itoa(c.RateLimitWaiters) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("invalid count " + value)
+			}
+			c.RateLimitWaiters = n
+			return nil
+		},
+	},
+	{
+		name:    "namespaces-per-client",
+		usage:   "namespaces each client may create, 0 for any number",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.Itoa(c.NamespacesPerClient) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("invalid count " + value)
+			}
+			c.NamespacesPerClient = n
+			return nil
+		},
+	},
+}
+
+// return the setting with the name
+func lookup(name string) (setting, error) {
+	for _, s := range settings {
+		if s.name == strings.ToLower(name) {
+			return s, nil
+		}
+	}
+	return setting{}, fmt.Errorf("%w %s", ErrUnknownSetting, name)
+}
+
+// return the name of the environment variable of a setting
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// return the default settings
+func Default() *Config {
+	return &Config{
+		HTTPAddr:            ":8080",
+		MemcachedAddr:       ":11211",
+		ExpiryInterval:      database.DefaultExpiryInterval,
+		MaxMemoryPolicy:     database.NoEviction,
+		ShutdownTimeout:     10 * time.Second,
+		TLSClientAuth:       certs.ClientAuthOptional,
+		TLSReloadInterval:   certs.DefaultReloadInterval,
+		NamespacesPerClient: DefaultNamespacesPerClient,
+	}
+}
+
+// load the settings from, in increasing order of precedence, the defaults,
+// the config file, the environment and the command line arguments. The file
+// is named by the -config flag or the KVS_CONFIG variable. lookupEnv is
+// normally os.LookupEnv.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+
+	flags := flag.NewFlagSet("keyvaluestore", flag.ContinueOnError)
+	defaultPath, _ := lookupEnv(EnvPrefix + "CONFIG")
+	path := flags.String("config", defaultPath, "config file with one \"setting value\" per line")
+	given := make(map[string]string)
+	var order []string
+	for _, s := range settings {
+		flags.Var(&flagValue{s.name, s.boolean, given, &order}, s.name, s.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		file, err := os.Open(*path)
+		if err != nil {
+			return nil, err
+		}
+		err = c.ReadFile(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+	for _, s := range settings {
+		if value, ok := lookupEnv(EnvName(s.name)); ok {
+			if err := s.set(c, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", EnvName(s.name), err)
+			}
+		}
+	}
+	for _, name := range order {
+		s, _ := lookup(name)
+		if err := s.set(c, given[name]); err != nil {
+			return nil, fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+// apply the settings of a config file: one setting and its value per line,
+// separated by whitespace, with blank lines and lines starting with # ignored.
+// Values may be double quoted, e.g. to give an empty one.
+func (c *Config) ReadFile(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value := text, ""
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			name, value = text[:i], strings.TrimSpace(text[i:])
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		s, err := lookup(name)
+		if err == nil {
+			err = s.set(c, value)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// return the value of a setting
+func (c *Config) Get(name string) (string, error) {
+	s, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return s.get(c), nil
+}
+
+// return the settings whose names match the glob pattern, with their values
+func (c *Config) Match(pattern string) map[string]string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	values := make(map[string]string)
+	for _, s := range settings {
+		if glob.Match(strings.ToLower(pattern), s.name) {
+			values[s.name] = s.get(c)
+		}
+	}
+	return values
+}
+
+// change settings at runtime, given as name value pairs. Either all of them
+// change or, if any is unknown, read-only or invalid, none does.
+func (c *Config) Set(pairs ...string) error {
+	if len(pairs)%2 != 0 {
+		return errors.New("settings must be given as name value pairs")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	changed := c.copy()
+	for i := 0; i < len(pairs); i += 2 {
+		s, err := lookup(pairs[i])
+		if err != nil {
+			return err
+		}
+		if !s.mutable {
+			return fmt.Errorf("%w: %s", ErrReadOnlySetting, s.name)
+		}
+		if err := s.set(&changed, pairs[i+1]); err != nil {
+			return fmt.Errorf("%w for %s: %v", ErrInvalidValue, s.name, err)
+		}
+	}
+	c.assign(&changed)
+	return nil
+}
+
+// return a copy of the settings that is safe to read while they change
+func (c *Config) Snapshot() Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.copy()
+}
+
+// set the fields to those of another config. Callers must hold the lock.
+func (c *Config) assign(from *Config) {
+	c.HTTPAddr = from.HTTPAddr
+	c.MemcachedAddr = from.MemcachedAddr
+	c.MemcachedInsecure = from.MemcachedInsecure
+	c.MemcachedTLS = from.MemcachedTLS
+	c.ExpiryInterval = from.ExpiryInterval
+	c.MaxMemory = from.MaxMemory
+	c.MaxMemoryPolicy = from.MaxMemoryPolicy
+	c.LegacyResponses = from.LegacyResponses
+	c.LogFile = from.LogFile
+	c.LogRequests = from.LogRequests
+	c.SnapshotPath = from.SnapshotPath
+	c.ShutdownTimeout = from.ShutdownTimeout
+	c.ACLFile = from.ACLFile
+	c.AuditFile = from.AuditFile
+	c.TLSCertFile = from.TLSCertFile
+	c.TLSKeyFile = from.TLSKeyFile
+	c.TLSClientCAFile = from.TLSClientCAFile
+	c.TLSClientAuth = from.TLSClientAuth
+	c.TLSReloadInterval = from.TLSReloadInterval
+	c.RateLimitRead = from.RateLimitRead
+	c.RateLimitWrite = from.RateLimitWrite
+	c.RateLimitBlocking = from.RateLimitBlocking
+	c.RateLimitWaiters = from.RateLimitWaiters
+	c.NamespacesPerClient = from.NamespacesPerClient
+}
+
+// copy the fields without the lock. Callers must hold the lock.
+func (c *Config) copy() Config {
+	return Config{
+		HTTPAddr:            c.HTTPAddr,
+		MemcachedAddr:       c.MemcachedAddr,
+		MemcachedInsecure:   c.MemcachedInsecure,
+		MemcachedTLS:        c.MemcachedTLS,
+		ExpiryInterval:      c.ExpiryInterval,
+		MaxMemory:           c.MaxMemory,
+		MaxMemoryPolicy:     c.MaxMemoryPolicy,
+		LegacyResponses:     c.LegacyResponses,
+		LogFile:             c.LogFile,
+		LogRequests:         c.LogRequests,
+		SnapshotPath:        c.SnapshotPath,
+		ShutdownTimeout:     c.ShutdownTimeout,
+		ACLFile:             c.ACLFile,
+		AuditFile:           c.AuditFile,
+		TLSCertFile:         c.TLSCertFile,
+		TLSKeyFile:          c.TLSKeyFile,
+		TLSClientCAFile:     c.TLSClientCAFile,
+		TLSClientAuth:       c.TLSClientAuth,
+		TLSReloadInterval:   c.TLSReloadInterval,
+		RateLimitRead:       c.RateLimitRead,
+		RateLimitWrite:      c.RateLimitWrite,
+		RateLimitBlocking:   c.RateLimitBlocking,
+		RateLimitWaiters:    c.RateLimitWaiters,
+		NamespacesPerClient: c.NamespacesPerClient,
+	}
+}
+
+// parse a size in bytes with an optional kb, mb or gb suffix, e.g. 100mb.
+// Negative sizes and sizes that do not fit in an int64 are rejected.
+func ParseSize(value string) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text, multiplier = strings.TrimSuffix(text, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size " + value)
+	}
+	if size > math.MaxInt64/multiplier {
+		return 0, errors.New("size too large " + value)
+	}
+	return size * multiplier, nil
+}
+
+// parse a boolean, also accepting yes and no like redis.conf
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid boolean " + value)
+	}
+	return enabled, nil
+}
+
+// a command line flag recording its value so that flags are applied after
+// the file and the environment
+type flagValue struct {
+	name    string
+	boolean bool
+	given   map[string]string
+	order   *[]string
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+func (f *flagValue) Set(value string) error {
+	if _, exists := f.given[f.name]; !exists {
+		*f.order = append(*f.order, f.name)
+	}
+	f.given[f.name] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.boolean
+}
@@ -0,0 +1,254 @@
+package database
+
+import "sort"
+
+// minimum degree of the B-tree: every node but the root holds between
+// btreeDegree-1 and 2*btreeDegree-1 keys
+const btreeDegree = 16
+
+// a B-tree of keys in lexicographic order
+type btree struct {
+	root *btreeNode
+	size int
+}
+
+type btreeNode struct {
+	keys []string
+	// nil for leaves, otherwise one more than keys
+	children []*btreeNode
+}
+
+func (n *btreeNode) leaf() bool {
+	return n.children == nil
+}
+
+// add key to the tree, doing nothing if it is already there
+func (t *btree) insert(key string) {
+	if t.root == nil {
+		t.root = &btreeNode{keys: []string{key}}
+		t.size++
+		return
+	}
+	if len(t.root.keys) == 2*btreeDegree-1 {
+		root := &btreeNode{children: []*btreeNode{t.root}}
+		root.split(0)
+		t.root = root
+	}
+	if t.root.insert(key) {
+		t.size++
+	}
+}
+
+// insert key below a node that is not full and report whether it was added
+func (n *btreeNode) insert(key string) bool {
+	i := sort.SearchStrings(n.keys, key)
+	if i < len(n.keys) && n.keys[i] == key {
+		return false
+	}
+	if n.leaf() {
+		n.keys = append(n.keys, "")
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = key
+		return true
+	}
+
+	if len(n.children[i].keys) == 2*btreeDegree-1 {
+		n.split(i)
+		switch {
+		case key == n.keys[i]:
+			return false
+		case key > n.keys[i]:
+			i++
+		}
+	}
+	return n.children[i].insert(key)
+}
+
+// split the full child i in two around its median, which moves up into n
+func (n *btreeNode) split(i int) {
+	child := n.children[i]
+	median := child.keys[btreeDegree-1]
+	right := &btreeNode{
+		keys: append([]string{}, child.keys[btreeDegree:]...),
+	}
+	if !child.leaf() {
+		right.children = append([]*btreeNode{}, child.children[btreeDegree:]...)
+		child.children = child.children[:btreeDegree]
+	}
+	child.keys = child.keys[:btreeDegree-1]
+
+	n.keys = append(n.keys, "")
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = median
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+// remove key from the tree, doing nothing if it is not there
+func (t *btree) delete(key string) {
+	if t.root == nil {
+		return
+	}
+	if t.root.delete(key) {
+		t.size--
+	}
+	if len(t.root.keys) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+}
+
+// remove key below n and report whether it was found. Every node descended
+// into is first given at least btreeDegree keys, so that removing one never
+// leaves it short.
+func (n *btreeNode) delete(key string) bool {
+	i := sort.SearchStrings(n.keys, key)
+	found := i < len(n.keys) && n.keys[i] == key
+
+	if n.leaf() {
+		if found {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		}
+		return found
+	}
+
+	if found {
+		switch {
+		case len(n.children[i].keys) >= btreeDegree:
+			// replace the key by its predecessor
+			predecessor := n.children[i].max()
+			n.keys[i] = predecessor
+			return n.children[i].delete(predecessor)
+		case len(n.children[i+1].keys) >= btreeDegree:
+			// replace the key by its successor
+			successor := n.children[i+1].min()
+			n.keys[i] = successor
+			return n.children[i+1].delete(successor)
+		default:
+			n.merge(i)
+			return n.children[i].delete(key)
+		}
+	}
+
+	if len(n.children[i].keys) < btreeDegree {
+		switch {
+		case i > 0 && len(n.children[i-1].keys) >= btreeDegree:
+			n.rotateRight(i)
+		case i < len(n.keys) && len(n.children[i+1].keys) >= btreeDegree:
+			n.rotateLeft(i)
+		case i < len(n.keys):
+			n.merge(i)
+		default:
+			n.merge(i - 1)
+			i--
+		}
+	}
+	return n.children[i].delete(key)
+}
+
+// merge child i+1 and the key between them into child i
+func (n *btreeNode) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.keys = append(left.keys, n.keys[i])
+	left.keys = append(left.keys, right.keys...)
+	if !left.leaf() {
+		left.children = append(left.children, right.children...)
+	}
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+}
+
+// move the last key of child i-1 up into n and the key between them down into child i
+func (n *btreeNode) rotateRight(i int) {
+	child, sibling := n.children[i], n.children[i-1]
+	child.keys = append([]string{n.keys[i-1]}, child.keys...)
+	n.keys[i-1] = sibling.keys[len(sibling.keys)-1]
+	sibling.keys = sibling.keys[:len(sibling.keys)-1]
+	if !child.leaf() {
+		child.children = append([]*btreeNode{sibling.children[len(sibling.children)-1]}, child.children...)
+		sibling.children = sibling.children[:len(sibling.children)-1]
+	}
+}
+
+// move the first key of child i+1 up into n and the key between them down into child i
+func (n *btreeNode) rotateLeft(i int) {
+	child, sibling := n.children[i], n.children[i+1]
+	child.keys = append(child.keys, n.keys[i])
+	n.keys[i] = sibling.keys[0]
+	sibling.keys = append([]string{}, sibling.keys[1:]...)
+	if !child.leaf() {
+		child.children = append(child.children, sibling.children[0])
+		sibling.children = append([]*btreeNode{}, sibling.children[1:]...)
+	}
+}
+
+// return the smallest key below n
+func (n *btreeNode) min() string {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.keys[0]
+}
+
+// return the largest key below n
+func (n *btreeNode) max() string {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
+
+// call fn for every key not less than start in ascending order until it
+// returns false
+func (t *btree) ascend(start string, fn func(key string) bool) {
+	if t.root != nil {
+		t.root.ascend(start, fn)
+	}
+}
+
+func (n *btreeNode) ascend(start string, fn func(key string) bool) bool {
+	i := sort.SearchStrings(n.keys, start)
+	for ; i < len(n.keys); i++ {
+		if !n.leaf() && !n.children[i].ascend(start, fn) {
+			return false
+		}
+		if !fn(n.keys[i]) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.keys)].ascend(start, fn)
+	}
+	return true
+}
+
+// call fn for every key less than end, or every key if end is empty, in
+// descending order until it returns false
+func (t *btree) descend(end string, fn func(key string) bool) {
+	if t.root != nil {
+		t.root.descend(end, fn)
+	}
+}
+
+func (n *btreeNode) descend(end string, fn func(key string) bool) bool {
+	i := len(n.keys)
+	if end != "" {
+		i = sort.SearchStrings(n.keys, end)
+	}
+	if !n.leaf() && !n.children[i].descend(end, fn) {
+		return false
+	}
+	for i--; i >= 0; i-- {
+		if !fn(n.keys[i]) {
+			return false
+		}
+		if !n.leaf() && !n.children[i].descend(end, fn) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,92 +1,430 @@
 package database
 
 import (
-	"fmt"
+	"errors"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrNotFound   = errors.New("key not found")
+	ErrNotNumber  = errors.New("value is not a number")
+	ErrQueueEmpty = errors.New("queue is empty")
+	ErrTimeout    = errors.New("timeout")
+	// returned to blocked and new blocking pops once the database is closed
+	ErrClosed = errors.New("database is closed")
+	// matched by the errors of every failed NX, XX or revision condition
+	ErrConditionFailed = errors.New("condition failed")
+)
+
+// the errors of failed write conditions, all matching ErrConditionFailed
+var (
+	ErrKeyExists        error = conditionError("key already exists")
+	ErrKeyNotExist      error = conditionError("key does not exist")
+	ErrRevisionMismatch error = conditionError("revision mismatch")
+)
+
+// a failed write condition described by its own message, matching
+// ErrConditionFailed with errors.Is
+type conditionError string
+
+func (e conditionError) Error() string {
+	return string(e)
+}
+
+func (e conditionError) Unwrap() error {
+	return ErrConditionFailed
+}
+
 type KeyValuePair struct {
-	Value      string
+	Value string
+	// items of a queue in insertion order, nil for plain values
+	Queue      []string
 	Expiration time.Time
+	// opaque client flags, stored and returned untouched
+	Flags uint32
+	// revision of the last mutation, unique across the database
+	Revision uint64
+
+	// bytes accounted for the pair in the memory limit
+	size int64
+	// recency and frequency of accesses for eviction, shared by copies
+	access *accessStats
+}
+
+// return a copy of the pair that shares no memory with the stored one
+func (kv *KeyValuePair) clone() KeyValuePair {
+	c := *kv
+	if kv.Queue != nil {
+		c.Queue = append([]string{}, kv.Queue...)
+	}
+	return c
+}
+
+// return the value of the pair, or the items joined by spaces for a queue
+func (kv KeyValuePair) String() string {
+	if kv.Queue != nil {
+		return concatValues(kv.Queue)
+	}
+	return kv.Value
+}
+
+// report whether the pair has an expiration in the past
+func (kv *KeyValuePair) expired(now time.Time) bool {
+	return kv.Expiration != (time.Time{}) && now.After(kv.Expiration)
 }
 
 // struct to store key-value pairs
 type Database struct {
-	data   map[string]*KeyValuePair
-	lock   sync.RWMutex
-	ticker *time.Ticker
+	data     map[string]*KeyValuePair
+	lock     sync.RWMutex
+	ticker   *time.Ticker
+	revision uint64
+	// how often expired keys are removed
+	expiryInterval time.Duration
+	// the counter revisions are allocated from, shared by every namespace
+	revisions *uint64
+	// the keys of data by scan bucket
+	index keyIndex
+	// the keys of data with an expiration, sampled by the volatile-* policies
+	volatile keyIndex
+	// the keys of data in lexicographic order
+	ordered btree
+	// closed and replaced on every push to wake blocked poppers
+	pushed chan struct{}
+	// closed by Close to stop the expiry cleanup and wake blocked poppers
+	closed    chan struct{}
+	closeOnce sync.Once
+	// subscribers of keyspace events
+	notifier notifier
+	// recent changes for revision based watches
+	history history
+
+	// memory limit shared with the other namespaces, and the bytes accounted
+	// for the pairs of this database
+	memory *memoryBudget
+	used   int64
+
+	// statistics, hits and misses are updated atomically under the read lock
+	hits        uint64
+	misses      uint64
+	expiredKeys uint64
+	evictedKeys uint64
 }
 
+// how often expired keys are removed unless SetExpiryInterval says otherwise
+const DefaultExpiryInterval = time.Second
+
 // create a new instance of Database
 func NewDatabase() *Database {
+	return newDatabase(new(uint64), new(memoryBudget))
+}
+
+// create a database allocating revisions from the given counter and
+// accounting its memory to the given budget
+func newDatabase(revisions *uint64, memory *memoryBudget) *Database {
 	ds := &Database{
-		data: make(map[string]*KeyValuePair),
+		data:      make(map[string]*KeyValuePair),
+		revisions: revisions,
+		memory:    memory,
+		pushed:    make(chan struct{}),
+		closed:    make(chan struct{}),
+		history:   newHistory(DefaultHistorySize),
 	}
 	ds.startExpiryCleanup()
 	return ds
 }
 
+// return the live pair stored under key, ignoring pairs that have expired
+// but not been cleaned up yet. Callers must hold the lock.
+func (ds *Database) lookup(key string) (*KeyValuePair, bool) {
+	kv, exists := ds.data[key]
+	if !exists || kv.expired(time.Now()) {
+		return nil, false
+	}
+	kv.access.touch()
+	return kv, true
+}
+
+// allocate the next revision. Callers must hold the write lock.
+func (ds *Database) nextRevision() uint64 {
+	ds.revision = atomic.AddUint64(ds.revisions, 1)
+	return ds.revision
+}
+
 // set the value in the database for the given key
 func (ds *Database) Set(key, value string, expiry time.Duration, condition string) error {
-	ds.lock.Lock()
-	defer ds.lock.Unlock()
-
-	if condition == "NX" {
-		if _, exists := ds.data[key]; exists {
-			return fmt.Errorf("key already exists")
-		}
-	} else if condition == "XX" {
-		if _, exists := ds.data[key]; !exists {
-			return fmt.Errorf("key does not exist")
-		}
-	}
 	// log.Println("Adding key:value -> " + key + " : " + value + " with expiry: " + expiry.String() + " condition: " + condition)
+	_, _, err := ds.SetItem(key, newItem(value, expiry), condition)
+	return err
+}
+
+// build a pair holding value that expires after expiry, or never if expiry is zero
+func newItem(value string, expiry time.Duration) KeyValuePair {
 	expiration := time.Time{}
 	if expiry > 0 {
 		expiration = time.Now().Add(expiry)
 	}
 
-	ds.data[key] = &KeyValuePair{
+	return KeyValuePair{
 		Value:      value,
 		Expiration: expiration,
 	}
+}
 
-	return nil
+// store the value, expiration and flags of item under key and return the new
+// revision and whether the key was created. The condition is either empty, NX
+// (only if the key is absent) or XX (only if it is present).
+func (ds *Database) SetItem(key string, item KeyValuePair, condition string) (revision uint64, created bool, err error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.set(key, item, condition)
+}
+
+// store item under key. Callers must hold the write lock.
+func (ds *Database) set(key string, item KeyValuePair, condition string) (uint64, bool, error) {
+	_, exists := ds.lookup(key)
+	if condition == "NX" && exists {
+		return 0, false, ErrKeyExists
+	} else if condition == "XX" && !exists {
+		return 0, false, ErrKeyNotExist
+	}
+
+	revision, err := ds.store(key, item)
+	return revision, !exists, err
+}
+
+// replace whatever is stored under key with the value, expiration and flags
+// of item and return the new revision. Callers must hold the write lock.
+func (ds *Database) store(key string, item KeyValuePair) (uint64, error) {
+	kv := newPair(item)
+	if err := ds.makeRoom(key, entrySize(key, kv)-ds.sizeOf(key)); err != nil {
+		return 0, err
+	}
+	return ds.put(key, kv), nil
+}
+
+// copy the value, expiration and flags of item into a new pair
+func newPair(item KeyValuePair) *KeyValuePair {
+	return &KeyValuePair{
+		Value:      item.Value,
+		Expiration: item.Expiration,
+		Flags:      item.Flags,
+	}
+}
+
+// store kv under key without making room for it and return its revision.
+// Callers must hold the write lock.
+func (ds *Database) put(key string, kv *KeyValuePair) uint64 {
+	kv.Revision = ds.nextRevision()
+	ds.link(key, kv)
+	ds.changed(key, "set", ClassString, kv)
+	return kv.Revision
+}
+
+// store item under key only if the stored revision still equals revision and
+// return the new revision. A revision of zero means the key must not exist.
+func (ds *Database) CompareAndSet(key string, item KeyValuePair, revision uint64) (uint64, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.compareAndSet(key, item, revision)
 }
 
-// retrieve the value from the database for the given key
+// store item under key if its revision matches. Callers must hold the write lock.
+func (ds *Database) compareAndSet(key string, item KeyValuePair, revision uint64) (uint64, error) {
+	kv, exists := ds.lookup(key)
+	switch {
+	case !exists && revision != 0:
+		return 0, ErrNotFound
+	case exists && kv.Revision != revision:
+		return 0, ErrRevisionMismatch
+	}
+
+	return ds.store(key, item)
+}
+
+// remove key only if its revision still equals revision
+func (ds *Database) CompareAndDelete(key string, revision uint64) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	kv, exists := ds.lookup(key)
+	if !exists {
+		return ErrNotFound
+	}
+	if kv.Revision != revision {
+		return ErrRevisionMismatch
+	}
+	return ds.remove(key)
+}
+
+// retrieve the value from the database for the given key. Queues are
+// returned as their items joined by spaces.
 func (ds *Database) Get(key string) (string, error) {
+	kv, err := ds.GetItem(key)
+	if err != nil {
+		return "", err
+	}
+	return kv.String(), nil
+}
+
+// retrieve a copy of the pair stored under key, including flags and revision
+func (ds *Database) GetItem(key string) (KeyValuePair, error) {
 	ds.lock.RLock()
 	defer ds.lock.RUnlock()
 
-	if kv, exists := ds.data[key]; exists {
-		return kv.Value, nil
+	return ds.get(key)
+}
+
+// retrieve a copy of the pair stored under key. Callers must hold the lock.
+func (ds *Database) get(key string) (KeyValuePair, error) {
+	if kv, exists := ds.lookup(key); exists {
+		atomic.AddUint64(&ds.hits, 1)
+		return kv.clone(), nil
 	}
 
-	return "", fmt.Errorf("key not found")
+	atomic.AddUint64(&ds.misses, 1)
+	return KeyValuePair{}, ErrNotFound
 }
 
-// append values to the queue in the database for the given key
-func (ds *Database) QPush(key string, values []string) {
-	for {
-		if ds.lock.TryLock() {
-			if kv, exists := ds.data[key]; exists {
-				kv.Value += " " + concatValues(values)
-			} else {
-				ds.data[key] = &KeyValuePair{
-					Value:      concatValues(values),
-					Expiration: time.Time{},
-				}
-			}
-			ds.lock.Unlock()
-			break // Exit the loop if the lock was acquired successfully
+// return the revision of key, or zero if the key does not exist
+func (ds *Database) Revision(key string) uint64 {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	if kv, exists := ds.lookup(key); exists {
+		return kv.Revision
+	}
+	return 0
+}
+
+// remove the key from the database
+func (ds *Database) Delete(key string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.remove(key)
+}
+
+// remove the key from the database. Callers must hold the write lock.
+func (ds *Database) remove(key string) error {
+	if _, exists := ds.lookup(key); !exists {
+		return ErrNotFound
+	}
+	ds.unlink(key)
+	ds.nextRevision()
+	ds.changed(key, "del", ClassGeneric, nil)
+
+	return nil
+}
+
+// replace the expiration of key without touching its value
+func (ds *Database) Touch(key string, expiration time.Time) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	kv, exists := ds.lookup(key)
+	if !exists {
+		return ErrNotFound
+	}
+	ds.setExpiration(key, kv, expiration)
+	kv.Revision = ds.nextRevision()
+	ds.changed(key, "expire", ClassGeneric, kv)
+
+	return nil
+}
+
+// add delta to the unsigned decimal stored under key, wrapping around at 2^64
+func (ds *Database) Incr(key string, delta uint64) (uint64, error) {
+	return ds.adjust(key, "incr", func(n uint64) uint64 {
+		return n + delta
+	})
+}
+
+// subtract delta from the unsigned decimal stored under key, stopping at zero
+func (ds *Database) Decr(key string, delta uint64) (uint64, error) {
+	return ds.adjust(key, "decr", func(n uint64) uint64 {
+		if delta > n {
+			return 0
 		}
+		return n - delta
+	})
+}
 
-		// Add a short delay before retrying to acquire the lock
-		time.Sleep(100 * time.Millisecond)
+// apply op to the number stored under key and store the result. The name of
+// the operation is reported to keyspace event subscribers.
+func (ds *Database) adjust(key, name string, op func(uint64) uint64) (uint64, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	kv, exists := ds.lookup(key)
+	if !exists {
+		return 0, ErrNotFound
+	}
+	n, err := strconv.ParseUint(kv.Value, 10, 64)
+	if err != nil {
+		return 0, ErrNotNumber
 	}
+	n = op(n)
+	value := strconv.FormatUint(n, 10)
+	if err := ds.makeRoom(key, int64(len(value)-len(kv.Value))); err != nil {
+		return 0, err
+	}
+	kv.Value = value
+	ds.resize(key, kv)
+	kv.Revision = ds.nextRevision()
+	ds.changed(key, name, ClassString, kv)
+
+	return n, nil
+}
+
+// append values to the queue in the database for the given key
+func (ds *Database) QPush(key string, values []string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.push(key, values)
+}
+
+// append values to the queue under key. Callers must hold the write lock.
+func (ds *Database) push(key string, values []string) error {
+	kv, exists := ds.lookup(key)
+	growth := entrySize("", &KeyValuePair{Queue: values}) - entryOverhead
+	if !exists {
+		growth += entryOverhead + int64(len(key)) - ds.sizeOf(key)
+	}
+	if err := ds.makeRoom(key, growth); err != nil {
+		return err
+	}
+
+	if exists {
+		if kv.Queue == nil {
+			// a plain value becomes a queue of its words
+			kv.Queue = splitValues(kv.Value)
+			kv.Value = ""
+		}
+		kv.Queue = append(kv.Queue, values...)
+		kv.Revision = ds.nextRevision()
+		ds.resize(key, kv)
+	} else {
+		kv = &KeyValuePair{
+			Queue:      append([]string{}, values...),
+			Expiration: time.Time{},
+			Revision:   ds.nextRevision(),
+		}
+		ds.link(key, kv)
+	}
+	ds.changed(key, "qpush", ClassQueue, kv)
+
+	// wake up every BQPop waiting for a value
+	close(ds.pushed)
+	ds.pushed = make(chan struct{})
+	return nil
 }
 
 // retrieve and removes the last inserted value from the queue in the database for the given key
@@ -94,90 +432,78 @@ func (ds *Database) QPop(key string) (string, error) {
 	ds.lock.Lock()
 	defer ds.lock.Unlock()
 
-	if kv, exists := ds.data[key]; exists {
-		values := splitValues(kv.Value)
-		if len(values) > 0 {
-			lastIndex := len(values) - 1
-			lastValue := values[lastIndex]
-			values = values[:lastIndex]
-			newValue := concatValues(values)
-			kv.Value = newValue
-			return lastValue, nil
-		}
-		return "", fmt.Errorf("queue is empty")
+	return ds.pop(key)
+}
+
+// remove the last inserted value of the queue under key. Callers must hold the write lock.
+func (ds *Database) pop(key string) (string, error) {
+	kv, exists := ds.lookup(key)
+	if !exists {
+		return "", ErrNotFound
+	}
+	if kv.Queue == nil {
+		kv.Queue = splitValues(kv.Value)
+		kv.Value = ""
+		ds.resize(key, kv)
+	}
+	if len(kv.Queue) == 0 {
+		return "", ErrQueueEmpty
 	}
 
-	return "", fmt.Errorf("key not found")
+	lastIndex := len(kv.Queue) - 1
+	lastValue := kv.Queue[lastIndex]
+	kv.Queue = kv.Queue[:lastIndex]
+	ds.resize(key, kv)
+	kv.Revision = ds.nextRevision()
+	ds.changed(key, "qpop", ClassQueue, kv)
+	return lastValue, nil
 }
 
 // retrieve and removes the last inserted value from the queue in the database for the given key.
 // If the queue is empty, it blocks the request until a value is available or the timeout is reached.
 func (ds *Database) BQPop(key string, timeout time.Duration) (string, error) {
-	ds.lock.RLock()
-	queue, exists := ds.data[key]
-	ds.lock.RUnlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	if exists {
-		if ds.lock.TryLock() {
-			values := splitValues(queue.Value)
-			if len(values) > 0 {
-				lastIndex := len(values) - 1
-				lastValue := values[lastIndex]
-				values = values[:lastIndex]
-				newValue := concatValues(values)
-				queue.Value = newValue
-				ds.lock.Unlock()
-				return lastValue, nil
-			}
-			ds.lock.Unlock()
-		}
+	for {
+		ds.lock.Lock()
+		value, err := ds.pop(key)
+		pushed := ds.pushed
+		ds.lock.Unlock()
 
-		timer := time.NewTimer(timeout)
-		valueCh := make(chan string, 1)
-
-		go func() {
-			for {
-				if ds.lock.TryLock() {
-					queue, exists := ds.data[key]
-					if exists {
-						values := splitValues(queue.Value)
-						if len(values) > 0 {
-							lastIndex := len(values) - 1
-							lastValue := values[lastIndex]
-							values = values[:lastIndex]
-							newValue := concatValues(values)
-							queue.Value = newValue
-							ds.lock.Unlock()
-							valueCh <- lastValue
-							return
-						}
-					}
-					ds.lock.Unlock()
-				}
-				time.Sleep(500 * time.Millisecond)
-			}
-		}()
+		if err != ErrQueueEmpty {
+			return value, err
+		}
 
 		select {
-		case value := <-valueCh:
-			return value, nil
+		case <-pushed:
 		case <-timer.C:
-			return "", nil
+			return "", ErrTimeout
+		case <-ds.closed:
+			return "", ErrClosed
 		}
 	}
-	ds.lock.Unlock()
-	return "", fmt.Errorf("key not found")
 }
 
 // start a goroutine that periodically checks and removes expired keys from the database
 func (ds *Database) startExpiryCleanup() {
-	ds.ticker = time.NewTicker(time.Second)
+	ds.expiryInterval = DefaultExpiryInterval
+	ds.ticker = time.NewTicker(ds.expiryInterval)
 	go func() {
-		for range ds.ticker.C {
+		for {
+			select {
+			case <-ds.ticker.C:
+			case <-ds.closed:
+				return
+			}
 			ds.lock.Lock()
+			now := time.Now()
 			for key, kv := range ds.data {
-				if kv.Expiration != (time.Time{}) && time.Now().After(kv.Expiration) {
-					delete(ds.data, key)
+				if kv.expired(now) {
+					ds.unlink(key)
+					ds.expiredKeys++
+					ds.nextRevision()
+					ds.changed(key, "expired", ClassExpired, nil)
 				}
 			}
 			ds.lock.Unlock()
@@ -185,6 +511,36 @@ func (ds *Database) startExpiryCleanup() {
 	}()
 }
 
+// stop the expiry cleanup and make blocked and later blocking pops fail with
+// ErrClosed. Every other operation keeps working so that requests in flight
+// can finish. Closing a closed database does nothing.
+func (ds *Database) Close() {
+	ds.closeOnce.Do(func() {
+		ds.lock.Lock()
+		defer ds.lock.Unlock()
+
+		ds.ticker.Stop()
+		close(ds.closed)
+	})
+}
+
+// change how often expired keys are removed. Expired keys are never
+// returned either way, the interval only bounds how long they use memory.
+func (ds *Database) SetExpiryInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultExpiryInterval
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.expiryInterval = interval
+	select {
+	case <-ds.closed:
+	default:
+		ds.ticker.Reset(interval)
+	}
+}
+
 func concatValues(values []string) string {
 	return strings.Join(values, " ")
 }
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/glob"
+)
+
+// number of undelivered events a subscriber may hold before it is disconnected
+const DefaultEventBufferSize = 256
+
+// the class of a keyspace event, used to filter subscriptions
+type EventClass string
+
+const (
+	// a plain value was written: set, incr, decr, append, setrange
+	ClassString EventClass = "string"
+	// a queue was modified: qpush, qpop
+	ClassQueue EventClass = "queue"
+	// a key was deleted or its expiration changed: del, expire
+	ClassGeneric EventClass = "generic"
+	// a key was removed because it expired: expired
+	ClassExpired EventClass = "expired"
+	// a key was removed to stay below the memory limit: evicted
+	ClassEvicted EventClass = "evicted"
+)
+
+// describe one change to the keyspace
+type Event struct {
+	Key   string
+	Op    string
+	Class EventClass
+	// time left to live after the change, zero if the key does not expire or is gone
+	TTL      time.Duration
+	Revision uint64
+	// the new value of a plain key, empty for queues and removed keys
+	Value string
+}
+
+// a subscriber's filter and its bounded buffer of pending events
+type EventSubscription struct {
+	pattern string
+	classes map[EventClass]bool
+	events  chan Event
+	done    chan struct{}
+	// set when the subscription was closed because its buffer filled up
+	slow bool
+}
+
+// the keyspace event subscribers of a database
+type notifier struct {
+	lock        sync.Mutex
+	subscribers map[*EventSubscription]struct{}
+}
+
+// subscribe to changes of keys matching the glob pattern. An empty pattern
+// matches every key and no classes selects every class.
+func (ds *Database) SubscribeEvents(pattern string, classes []EventClass) *EventSubscription {
+	sub := &EventSubscription{
+		pattern: pattern,
+		events:  make(chan Event, DefaultEventBufferSize),
+		done:    make(chan struct{}),
+	}
+	if len(classes) > 0 {
+		sub.classes = make(map[EventClass]bool, len(classes))
+		for _, class := range classes {
+			sub.classes[class] = true
+		}
+	}
+
+	ds.notifier.lock.Lock()
+	if ds.notifier.subscribers == nil {
+		ds.notifier.subscribers = make(map[*EventSubscription]struct{})
+	}
+	ds.notifier.subscribers[sub] = struct{}{}
+	ds.notifier.lock.Unlock()
+
+	return sub
+}
+
+// stop delivering events to the subscription
+func (ds *Database) UnsubscribeEvents(sub *EventSubscription) {
+	ds.notifier.lock.Lock()
+	defer ds.notifier.lock.Unlock()
+
+	ds.notifier.remove(sub, false)
+}
+
+// remove the subscription and signal its end. Callers must hold the notifier lock.
+func (n *notifier) remove(sub *EventSubscription, slow bool) {
+	if _, exists := n.subscribers[sub]; !exists {
+		return
+	}
+	delete(n.subscribers, sub)
+	sub.slow = slow
+	close(sub.done)
+}
+
+// deliver the event to the matching subscribers. It is called with the write
+// lock held, so it never blocks: subscribers whose buffer is full are
+// disconnected instead.
+func (ds *Database) notify(event Event) {
+	ds.notifier.lock.Lock()
+	defer ds.notifier.lock.Unlock()
+
+	for sub := range ds.notifier.subscribers {
+		if sub.classes != nil && !sub.classes[event.Class] {
+			continue
+		}
+		if sub.pattern != "" && !glob.Match(sub.pattern, event.Key) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			ds.notifier.remove(sub, true)
+		}
+	}
+}
+
+// return the channel of pending events
+func (s *EventSubscription) Events() <-chan Event {
+	return s.events
+}
+
+// return a channel that is closed once the subscription ends
+func (s *EventSubscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// report whether the subscription ended because the subscriber fell behind.
+// Only meaningful once Done is closed.
+func (s *EventSubscription) Slow() bool {
+	return s.slow
+}
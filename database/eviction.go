@@ -0,0 +1,276 @@
+package database
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrOutOfMemory = errors.New("out of memory: command not allowed when used memory > maxmemory")
+
+// how keys are chosen for eviction once the memory limit is reached
+type EvictionPolicy string
+
+const (
+	// reject writes that need more memory
+	NoEviction EvictionPolicy = "noeviction"
+	// evict the least recently used key
+	AllKeysLRU EvictionPolicy = "allkeys-lru"
+	// evict the least frequently used key
+	AllKeysLFU EvictionPolicy = "allkeys-lfu"
+	// evict the least recently used key among keys with an expiration
+	VolatileLRU EvictionPolicy = "volatile-lru"
+	// evict the key with an expiration that is closest to expiring
+	VolatileTTL EvictionPolicy = "volatile-ttl"
+	// evict a random key
+	AllKeysRandom EvictionPolicy = "random"
+)
+
+const (
+	// number of keys sampled to pick each victim
+	evictionSamples = 5
+	// bytes accounted for every key on top of its key and value
+	entryOverhead = 64
+	// the access count of a new key, so that it is not evicted before it had
+	// a chance to be read
+	lfuInitialHits = 5
+	// the access count of a key halves after every idle period
+	lfuDecayPeriod = time.Minute
+)
+
+// convert a policy name into an EvictionPolicy
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(name); policy {
+	case NoEviction, AllKeysLRU, AllKeysLFU, VolatileLRU, VolatileTTL, AllKeysRandom:
+		return policy, nil
+	}
+	return "", errors.New("unknown eviction policy " + name)
+}
+
+// how recently and how often a key was accessed. Reads update it under the
+// read lock, so it is kept outside the pair and only touched atomically.
+type accessStats struct {
+	// unix nanoseconds of the last access
+	lastAccess int64
+	// logarithmic access counter
+	hits uint32
+}
+
+// record an access to the key
+func (a *accessStats) touch() {
+	atomic.StoreInt64(&a.lastAccess, time.Now().UnixNano())
+
+	// the counter grows more slowly the larger it is, so that it separates
+	// cold keys from hot ones without overflowing
+	hits := atomic.LoadUint32(&a.hits)
+	if hits < 255 && rand.Intn(int(hits)*10+1) == 0 {
+		atomic.CompareAndSwapUint32(&a.hits, hits, hits+1)
+	}
+}
+
+// return the access counter decayed by the time the key has been idle
+func (a *accessStats) frequency(now time.Time) uint32 {
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&a.lastAccess)))
+	periods := idle / lfuDecayPeriod
+	if periods >= 32 {
+		return 0
+	}
+	return atomic.LoadUint32(&a.hits) >> uint(periods)
+}
+
+// the number of bytes accounted for the pair stored under key
+func entrySize(key string, kv *KeyValuePair) int64 {
+	size := int64(entryOverhead + len(key) + len(kv.Value))
+	for _, item := range kv.Queue {
+		size += int64(len(item)) + 16
+	}
+	return size
+}
+
+// the memory limit of a database and the namespaces created alongside it,
+// which bounds their keys together
+type memoryBudget struct {
+	// bytes accounted for the pairs of every database, updated atomically
+	used int64
+
+	lock sync.Mutex
+	// limit in bytes, zero for none, and how to stay below it
+	maxMemory int64
+	policy    EvictionPolicy
+}
+
+// return the limit and the policy
+func (m *memoryBudget) limit() (int64, EvictionPolicy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.maxMemory, m.policy
+}
+
+// limit the memory used by keys and values to maxMemory bytes, evicting keys
+// according to policy when it is exceeded. A limit of zero removes the limit.
+// The limit is shared with every namespace of the registry the database
+// belongs to and bounds their keys together, but a write only ever evicts
+// keys of its own database. Keys are evicted right away if the memory in use
+// is already above the new limit.
+func (ds *Database) SetMaxMemory(maxMemory int64, policy EvictionPolicy) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.memory.lock.Lock()
+	ds.memory.maxMemory = maxMemory
+	ds.memory.policy = policy
+	ds.memory.lock.Unlock()
+	ds.makeRoom("", 0)
+}
+
+// return the number of bytes accounted for the keys and values of the database
+func (ds *Database) MemoryUsage() int64 {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.used
+}
+
+// evict keys until size more bytes fit within the memory limit, never evicting
+// except. ErrOutOfMemory is returned if there is nothing left to evict or the
+// policy does not allow it. Callers must hold the write lock.
+func (ds *Database) makeRoom(except string, size int64) error {
+	return ds.makeRoomExcept(size, func(key string) bool { return key == except })
+}
+
+// like makeRoom, but never evicting the keys keep reports. Callers must hold
+// the write lock.
+func (ds *Database) makeRoomExcept(size int64, keep func(key string) bool) error {
+	maxMemory, policy := ds.memory.limit()
+	if maxMemory <= 0 {
+		return nil
+	}
+	for atomic.LoadInt64(&ds.memory.used)+size > maxMemory {
+		if policy == NoEviction || policy == "" {
+			return ErrOutOfMemory
+		}
+		key, ok := ds.victim(policy, keep)
+		if !ok {
+			return ErrOutOfMemory
+		}
+		ds.unlink(key)
+		ds.evictedKeys++
+		ds.nextRevision()
+		ds.changed(key, "evicted", ClassEvicted, nil)
+	}
+	return nil
+}
+
+// pick the key to evict from a small sample of keys the policy applies to.
+// The volatile-* policies sample the keys with an expiration only, the others
+// every key. Iteration starts at a random position, which makes the sample
+// random.
+func (ds *Database) victim(policy EvictionPolicy, keep func(key string) bool) (string, bool) {
+	now := time.Now()
+	victim, found := "", false
+	var worst float64
+	sampled := 0
+	consider := func(key string) bool {
+		if keep(key) {
+			return true
+		}
+		kv := ds.data[key]
+
+		// a higher score makes a better victim
+		var score float64
+		switch policy {
+		case AllKeysLRU, VolatileLRU:
+			score = float64(now.UnixNano() - atomic.LoadInt64(&kv.access.lastAccess))
+		case AllKeysLFU:
+			score = -float64(kv.access.frequency(now))
+		case VolatileTTL:
+			score = -float64(kv.Expiration.Sub(now))
+		}
+		if !found || score > worst {
+			victim, worst, found = key, score, true
+		}
+
+		sampled++
+		return sampled < evictionSamples && policy != AllKeysRandom
+	}
+
+	if policy == VolatileLRU || policy == VolatileTTL {
+		ds.volatile.sample(consider)
+		return victim, found
+	}
+	for key := range ds.data {
+		if !consider(key) {
+			break
+		}
+	}
+	return victim, found
+}
+
+// store kv under key, replacing any previous pair, account for its size and
+// add the key to the indexes. Callers must hold the write lock.
+func (ds *Database) link(key string, kv *KeyValuePair) {
+	if old, exists := ds.data[key]; exists {
+		ds.account(-old.size)
+	} else {
+		ds.index.add(key)
+		ds.ordered.insert(key)
+	}
+	if kv.access == nil {
+		kv.access = &accessStats{hits: lfuInitialHits}
+		kv.access.touch()
+	}
+	kv.size = entrySize(key, kv)
+	ds.account(kv.size)
+	ds.data[key] = kv
+	ds.setExpiration(key, kv, kv.Expiration)
+}
+
+// set the expiration of the pair under key and keep the key in the volatile
+// index only while it has one. Callers must hold the write lock.
+func (ds *Database) setExpiration(key string, kv *KeyValuePair, expiration time.Time) {
+	kv.Expiration = expiration
+	if expiration.IsZero() {
+		ds.volatile.remove(key)
+	} else {
+		ds.volatile.add(key)
+	}
+}
+
+// remove key from the data and the indexes and release its size. Callers
+// must hold the write lock.
+func (ds *Database) unlink(key string) {
+	if kv, exists := ds.data[key]; exists {
+		ds.account(-kv.size)
+		delete(ds.data, key)
+		ds.index.remove(key)
+		ds.volatile.remove(key)
+		ds.ordered.delete(key)
+	}
+}
+
+// update the accounted size of the pair under key after it was modified in
+// place. Callers must hold the write lock.
+func (ds *Database) resize(key string, kv *KeyValuePair) {
+	size := entrySize(key, kv)
+	ds.account(size - kv.size)
+	kv.size = size
+}
+
+// add delta bytes to the memory accounted for the database and its budget.
+// Callers must hold the write lock.
+func (ds *Database) account(delta int64) {
+	ds.used += delta
+	atomic.AddInt64(&ds.memory.used, delta)
+}
+
+// return the number of bytes accounted for the pair under key, zero if there
+// is none. Callers must hold the lock.
+func (ds *Database) sizeOf(key string) int64 {
+	if kv, exists := ds.data[key]; exists {
+		return kv.size
+	}
+	return 0
+}
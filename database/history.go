@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// number of changes kept for watchers by default
+const DefaultHistorySize = 10000
+
+var ErrCompacted = errors.New("required revision has been compacted")
+
+// a bounded ring of the most recent changes, oldest first
+type history struct {
+	events []Event
+	start  int
+	count  int
+	// revision of the newest change that was dropped from the ring, zero
+	// while none was
+	compacted uint64
+	// closed and replaced on every change to wake watchers
+	changed chan struct{}
+}
+
+func newHistory(size int) history {
+	return history{
+		events:  make([]Event, size),
+		changed: make(chan struct{}),
+	}
+}
+
+// return the i-th oldest retained change
+func (h *history) at(i int) Event {
+	return h.events[(h.start+i)%len(h.events)]
+}
+
+// append a change, dropping the oldest one if the ring is full
+func (h *history) record(event Event) {
+	if h.count == len(h.events) {
+		h.compacted = h.events[h.start].Revision
+		h.events[h.start] = event
+		h.start = (h.start + 1) % len(h.events)
+	} else {
+		h.events[(h.start+h.count)%len(h.events)] = event
+		h.count++
+	}
+
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// drop every retained change as if the history had been compacted up to
+// revision, so that watchers from before it fail with ErrCompacted and resync
+func (h *history) compact(revision uint64) {
+	h.start, h.count = 0, 0
+	h.compacted = revision
+
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// record a change of key in the history and deliver it to event subscribers.
+// Every mutation calls this right after allocating its revision, with the
+// pair as it is now stored or nil if the key is gone. Callers must hold the
+// write lock.
+func (ds *Database) changed(key, op string, class EventClass, kv *KeyValuePair) {
+	event := Event{
+		Key:      key,
+		Op:       op,
+		Class:    class,
+		Revision: ds.revision,
+	}
+	if kv != nil {
+		if kv.Expiration != (time.Time{}) {
+			event.TTL = time.Until(kv.Expiration)
+		}
+		if kv.Queue == nil {
+			event.Value = kv.Value
+		}
+	}
+
+	ds.history.record(event)
+	ds.notify(event)
+}
+
+// return the changes of key, or of every key starting with key if prefix is
+// set, whose revision is at least fromRevision, along with the current
+// revision. ErrCompacted is returned if changes from fromRevision onwards
+// are no longer fully retained.
+func (ds *Database) Changes(key string, prefix bool, fromRevision uint64) ([]Event, uint64, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	events, err := ds.changes(key, prefix, fromRevision)
+	return events, ds.revision, err
+}
+
+// collect the matching changes. Callers must hold the lock.
+func (ds *Database) changes(key string, prefix bool, fromRevision uint64) ([]Event, error) {
+	h := &ds.history
+	// nothing is missing before the first change is dropped
+	if h.compacted > 0 && fromRevision <= h.compacted {
+		return nil, ErrCompacted
+	}
+
+	first := sort.Search(h.count, func(i int) bool {
+		return h.at(i).Revision >= fromRevision
+	})
+	var events []Event
+	for i := first; i < h.count; i++ {
+		event := h.at(i)
+		if event.Key == key || prefix && strings.HasPrefix(event.Key, key) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// like Changes, but wait until there is at least one matching change or the
+// context is done, in which case no changes and no error are returned
+func (ds *Database) WaitChanges(ctx context.Context, key string, prefix bool, fromRevision uint64) ([]Event, uint64, error) {
+	for {
+		ds.lock.RLock()
+		events, err := ds.changes(key, prefix, fromRevision)
+		revision := ds.revision
+		changed := ds.history.changed
+		ds.lock.RUnlock()
+
+		if err != nil || len(events) > 0 {
+			return events, revision, err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, revision, nil
+		}
+	}
+}
+
+// return the revision of the latest change
+func (ds *Database) CurrentRevision() uint64 {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.revision
+}
+
+// return the revision of the newest change dropped from the history. Watches
+// must start after it.
+func (ds *Database) CompactedRevision() uint64 {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.history.compacted
+}
@@ -0,0 +1,81 @@
+package database
+
+// retrieve the values of several keys at once, nil for keys that do not exist
+func (ds *Database) MGet(keys []string) []*string {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.mget(keys)
+}
+
+// retrieve the values of keys. Callers must hold the lock.
+func (ds *Database) mget(keys []string) []*string {
+	values := make([]*string, len(keys))
+	for i, key := range keys {
+		if kv, err := ds.get(key); err == nil {
+			value := kv.String()
+			values[i] = &value
+		}
+	}
+	return values
+}
+
+// store the items of several keys at once. If a key appears twice the last
+// item wins.
+func (ds *Database) MSet(entries []Entry) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.mset(entries)
+}
+
+// store the entries. Callers must hold the write lock.
+func (ds *Database) mset(entries []Entry) error {
+	if err := ds.reserve(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ds.put(entry.Key, newPair(entry.Item))
+	}
+	return nil
+}
+
+// store the items of several keys at once only if none of the keys exists,
+// and report whether they were stored
+func (ds *Database) MSetNX(entries []Entry) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.msetnx(entries)
+}
+
+// store the entries if none exists. Callers must hold the write lock.
+func (ds *Database) msetnx(entries []Entry) (bool, error) {
+	for _, entry := range entries {
+		if _, exists := ds.lookup(entry.Key); exists {
+			return false, nil
+		}
+	}
+	if err := ds.mset(entries); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// make room for all entries up front, so that running out of memory does not
+// leave only some of them stored. The keys of the batch are never evicted and
+// only the last entry of a key counts. Callers must hold the write lock.
+func (ds *Database) reserve(entries []Entry) error {
+	last := make(map[string]*KeyValuePair, len(entries))
+	for i := range entries {
+		last[entries[i].Key] = &entries[i].Item
+	}
+	var growth int64
+	for key, item := range last {
+		growth += entrySize(key, item) - ds.sizeOf(key)
+	}
+	return ds.makeRoomExcept(growth, func(key string) bool {
+		_, inBatch := last[key]
+		return inBatch
+	})
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the namespace holding the database the registry was created with
+const DefaultNamespace = "default"
+
+// the largest number of namespaces a registry creates
+const MaxNamespaces = 1024
+
+var (
+	ErrInvalidNamespace  = errors.New("invalid namespace name")
+	ErrTooManyNamespaces = errors.New("too many namespaces")
+	ErrNamespaceQuota    = errors.New("namespace creation limit of the client reached")
+	ErrNamespaceNotFound = errors.New("namespace not found")
+)
+
+// a registry of isolated keyspaces by name. Every namespace is a Database of
+// its own, with its own expiry cleanup, events and statistics, but all of
+// them draw revisions from one counter so that a revision never refers to two
+// different writes, not even after SWAPDB, and share one memory limit.
+type Namespaces struct {
+	lock      sync.Mutex
+	databases map[string]*Database
+	// namespaces created by each client with Create, and how many a client
+	// may create, zero for any number
+	created     map[string]int
+	clientLimit int
+	// set by Close, namespaces created afterwards are closed as well
+	closed bool
+}
+
+// create a registry holding db as the default namespace. Other namespaces are
+// created on first write and share the memory limit and inherit the expiry
+// interval of db.
+func NewNamespaces(db *Database) *Namespaces {
+	return &Namespaces{
+		databases: map[string]*Database{DefaultNamespace: db},
+		created:   make(map[string]int),
+	}
+}
+
+// set how many namespaces Create lets each client create, 0 for any number.
+// Namespaces are never removed, so the count is over the life of the registry.
+func (ns *Namespaces) SetClientLimit(n int) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	ns.clientLimit = n
+}
+
+// report whether name can be used as a namespace: 1 to 64 letters, digits,
+// '-' or '_'
+func ValidNamespace(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// return the database of the namespace, creating it if it does not exist yet
+func (ns *Namespaces) Get(name string) (*Database, error) {
+	return ns.Create(name, "")
+}
+
+// return the database of the namespace, creating it on behalf of client if it
+// does not exist yet. ErrNamespaceQuota is returned once the client created
+// as many namespaces as SetClientLimit allows; an empty client is not limited.
+func (ns *Namespaces) Create(name, client string) (*Database, error) {
+	if !ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	if db, exists := ns.databases[name]; exists {
+		return db, nil
+	}
+	if len(ns.databases) >= MaxNamespaces {
+		return nil, ErrTooManyNamespaces
+	}
+	if client != "" && ns.clientLimit > 0 && ns.created[client] >= ns.clientLimit {
+		return nil, ErrNamespaceQuota
+	}
+	db := ns.databases[DefaultNamespace].sibling()
+	if ns.closed {
+		db.Close()
+	}
+	ns.databases[name] = db
+	if client != "" {
+		ns.created[client]++
+	}
+	return db, nil
+}
+
+// return the database of the namespace if it exists. Otherwise an empty
+// database is returned that is not registered, so that reading a namespace
+// never creates it. Writes to that database are lost.
+func (ns *Namespaces) Lookup(name string) (*Database, error) {
+	if !ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	if db, exists := ns.databases[name]; exists {
+		return db, nil
+	}
+	return ns.databases[DefaultNamespace].placeholder(), nil
+}
+
+// return the database of the namespace, or ErrNamespaceNotFound if it does
+// not exist. Unlike Lookup the database is never a placeholder, so it can be
+// waited on for changes.
+func (ns *Namespaces) Existing(name string) (*Database, error) {
+	if !ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	if db, exists := ns.databases[name]; exists {
+		return db, nil
+	}
+	return nil, ErrNamespaceNotFound
+}
+
+// return the names of the existing namespaces in lexicographic order
+func (ns *Namespaces) Names() []string {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	names := make([]string, 0, len(ns.databases))
+	for name := range ns.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// close the database of every namespace, see Database.Close
+func (ns *Namespaces) Close() {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	ns.closed = true
+	for _, db := range ns.databases {
+		db.Close()
+	}
+}
+
+// atomically exchange the keys of two namespaces. Clients of either namespace
+// see the other one's keys from then on, while the events and statistics stay
+// with the namespaces. Watches of either namespace from before the swap fail
+// with ErrCompacted.
+func (ns *Namespaces) Swap(a, b string) error {
+	first, err := ns.Get(a)
+	if err != nil {
+		return err
+	}
+	second, err := ns.Get(b)
+	if err != nil {
+		return err
+	}
+	if first == second {
+		return nil
+	}
+
+	// lock in a fixed order so that concurrent swaps cannot deadlock
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if a > b {
+		first, second = second, first
+	}
+	first.lock.Lock()
+	defer first.lock.Unlock()
+	second.lock.Lock()
+	defer second.lock.Unlock()
+
+	first.data, second.data = second.data, first.data
+	first.index, second.index = second.index, first.index
+	first.volatile, second.volatile = second.volatile, first.volatile
+	first.ordered, second.ordered = second.ordered, first.ordered
+	first.used, second.used = second.used, first.used
+	for _, db := range []*Database{first, second} {
+		// the keys now carry revisions of the other database
+		db.revision = atomic.LoadUint64(db.revisions)
+		// there is no change per key, so watchers have to resync
+		db.history.compact(db.revision)
+		db.makeRoom("", 0)
+		// queues may have gained values
+		close(db.pushed)
+		db.pushed = make(chan struct{})
+	}
+	return nil
+}
+
+// create an empty database sharing the revision counter, memory limit and
+// expiry interval of ds
+func (ds *Database) sibling() *Database {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	db := newDatabase(ds.revisions, ds.memory)
+	db.SetExpiryInterval(ds.expiryInterval)
+	return db
+}
+
+// create an empty database standing in for a namespace that does not exist.
+// It has no expiry cleanup and keeps a single change of history, since it
+// only serves reads and is dropped afterwards.
+func (ds *Database) placeholder() *Database {
+	return &Database{
+		data:      make(map[string]*KeyValuePair),
+		revisions: ds.revisions,
+		memory:    ds.memory,
+		pushed:    make(chan struct{}),
+		closed:    make(chan struct{}),
+		history:   newHistory(1),
+	}
+}
+
+// remove every key of the database. Unlike deleting them one by one, it does
+// not produce an event per key; watches from before the flush fail with
+// ErrCompacted instead.
+func (ds *Database) Flush() {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.flush()
+}
+
+// remove every key. Callers must hold the write lock.
+func (ds *Database) flush() {
+	ds.data = make(map[string]*KeyValuePair)
+	ds.index = keyIndex{}
+	ds.volatile = keyIndex{}
+	ds.ordered = btree{}
+	ds.account(-ds.used)
+	ds.history.compact(ds.nextRevision())
+}
+
+// statistics of a database
+type Stats struct {
+	// number of keys, and how many of them have an expiration
+	Keys     int
+	Volatile int
+	// bytes accounted for the keys and values
+	MemoryUsage int64
+	// reads that found their key and reads that did not
+	Hits   uint64
+	Misses uint64
+	// keys removed by the expiry cleanup and by eviction
+	Expired uint64
+	Evicted uint64
+	// revision of the latest change
+	Revision uint64
+}
+
+// return the statistics of the database
+func (ds *Database) Stats() Stats {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.stats()
+}
+
+// collect the statistics. Callers must hold the lock.
+func (ds *Database) stats() Stats {
+	stats := Stats{
+		Keys:        len(ds.data),
+		MemoryUsage: ds.used,
+		Hits:        atomic.LoadUint64(&ds.hits),
+		Misses:      atomic.LoadUint64(&ds.misses),
+		Expired:     ds.expiredKeys,
+		Evicted:     ds.evictedKeys,
+		Revision:    ds.revision,
+	}
+	for _, kv := range ds.data {
+		if kv.Expiration != (time.Time{}) {
+			stats.Volatile++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// a key along with a copy of its pair
+type Entry struct {
+	Key  string
+	Item KeyValuePair
+}
+
+// return the live keys from start (inclusive) to end (exclusive) in
+// lexicographic order, or in reverse order if reverse is set. An empty end
+// means no upper bound. At most limit entries are returned, all of them if
+// limit is zero.
+func (ds *Database) Range(start, end string, limit int, reverse bool) []Entry {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.rangeEntries(start, end, limit, reverse)
+}
+
+// collect the entries of a range. Callers must hold the lock.
+func (ds *Database) rangeEntries(start, end string, limit int, reverse bool) []Entry {
+	now := time.Now()
+	entries := []Entry{}
+	visit := func(key string) bool {
+		if end != "" && key >= end || key < start {
+			// outside the range, which is only possible at the far end
+			return false
+		}
+		if kv := ds.data[key]; !kv.expired(now) {
+			entries = append(entries, Entry{Key: key, Item: kv.clone()})
+		}
+		return limit == 0 || len(entries) < limit
+	}
+
+	if reverse {
+		ds.ordered.descend(end, visit)
+	} else {
+		ds.ordered.ascend(start, visit)
+	}
+	return entries
+}
+
+// return the number of live keys starting with prefix
+func (ds *Database) CountPrefix(prefix string) int {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.countPrefix(prefix)
+}
+
+// count the keys with prefix. Callers must hold the lock.
+func (ds *Database) countPrefix(prefix string) int {
+	now := time.Now()
+	count := 0
+	ds.ordered.ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if !ds.data[key].expired(now) {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// remove the live keys starting with prefix in lexicographic order, at most
+// limit of them unless limit is zero, and return how many were removed
+func (ds *Database) DeletePrefix(prefix string, limit int) int {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.deletePrefix(prefix, limit)
+}
+
+// remove the keys with prefix. Callers must hold the write lock.
+func (ds *Database) deletePrefix(prefix string, limit int) int {
+	now := time.Now()
+	var keys []string
+	ds.ordered.ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if !ds.data[key].expired(now) {
+			keys = append(keys, key)
+		}
+		return limit == 0 || len(keys) < limit
+	})
+
+	for _, key := range keys {
+		ds.remove(key)
+	}
+	return len(keys)
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/glob"
+)
+
+// the types of value a key can hold
+const (
+	TypeString = "string"
+	TypeQueue  = "queue"
+)
+
+const (
+	// number of buckets keys are spread over for scanning. It never changes,
+	// so a key stays in the same bucket however much the database grows.
+	scanBuckets = 1024
+	// number of keys a scan step looks at by default
+	DefaultScanCount = 10
+)
+
+// return the type of value held by the pair
+func (kv KeyValuePair) Type() string {
+	if kv.Queue != nil {
+		return TypeQueue
+	}
+	return TypeString
+}
+
+// a side index spreading keys over a fixed number of buckets, so that a scan
+// can resume from a position that stays meaningful while keys come and go
+type keyIndex struct {
+	buckets [scanBuckets]map[string]struct{}
+	// number of keys over all buckets
+	count int
+}
+
+// return the bucket of key using FNV-1a
+func bucketOf(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % scanBuckets)
+}
+
+func (idx *keyIndex) add(key string) {
+	b := bucketOf(key)
+	if idx.buckets[b] == nil {
+		idx.buckets[b] = make(map[string]struct{})
+	}
+	if _, exists := idx.buckets[b][key]; !exists {
+		idx.buckets[b][key] = struct{}{}
+		idx.count++
+	}
+}
+
+func (idx *keyIndex) remove(key string) {
+	b := bucketOf(key)
+	if _, exists := idx.buckets[b][key]; exists {
+		delete(idx.buckets[b], key)
+		idx.count--
+	}
+}
+
+// call visit with the keys of the index starting from a random bucket until
+// it returns false or every key was visited
+func (idx *keyIndex) sample(visit func(key string) bool) {
+	if idx.count == 0 {
+		return
+	}
+	start := rand.Intn(scanBuckets)
+	for i := 0; i < scanBuckets; i++ {
+		for key := range idx.buckets[(start+i)%scanBuckets] {
+			if !visit(key) {
+				return
+			}
+		}
+	}
+}
+
+// return every live key matching the glob pattern in lexicographic order. It
+// holds the lock for the whole keyspace, so it is meant for debugging only.
+func (ds *Database) Keys(pattern string) []string {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.keys(pattern)
+}
+
+// collect the keys matching pattern. Callers must hold the lock.
+func (ds *Database) keys(pattern string) []string {
+	now := time.Now()
+	keys := []string{}
+	for key, kv := range ds.data {
+		if !kv.expired(now) && glob.Match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// return a batch of keys matching the glob pattern and holding a value of
+// type typ (any type if empty), and the cursor to pass to the next call. A
+// scan starts and ends with cursor zero. Every call looks at roughly count
+// keys and takes the lock only for its own batch, so a full scan never blocks
+// writers for long. Keys present for the whole scan are returned at least
+// once; keys added or removed meanwhile may or may not be.
+func (ds *Database) Scan(cursor uint64, pattern string, count int, typ string) (uint64, []string) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.scan(cursor, pattern, count, typ)
+}
+
+// scan whole buckets from cursor on. Callers must hold the lock.
+func (ds *Database) scan(cursor uint64, pattern string, count int, typ string) (uint64, []string) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+
+	now := time.Now()
+	keys := []string{}
+	visited := 0
+	for b := cursor; b < scanBuckets; b++ {
+		for key := range ds.index.buckets[b] {
+			visited++
+			kv := ds.data[key]
+			if kv.expired(now) || typ != "" && kv.Type() != typ {
+				continue
+			}
+			if pattern == "" || glob.Match(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		if visited >= count && b+1 < scanBuckets {
+			return b + 1, keys
+		}
+	}
+	return 0, keys
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// the version of the snapshot format written by WriteSnapshot
+const snapshotVersion = 1
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// the keys of every namespace at one point, as written to a snapshot file
+type snapshot struct {
+	Version int `json:"version"`
+	// the revision counter, so that revisions keep increasing after a restart
+	Revision   uint64                     `json:"revision"`
+	Namespaces map[string][]snapshotEntry `json:"namespaces"`
+}
+
+// a key and its pair in a snapshot. Queue is null for plain values.
+type snapshotEntry struct {
+	Key        string    `json:"key"`
+	Value      string    `json:"value,omitempty"`
+	Queue      []string  `json:"queue"`
+	Expiration time.Time `json:"expiration"`
+	Flags      uint32    `json:"flags,omitempty"`
+	Revision   uint64    `json:"revision"`
+}
+
+// write the keys of every namespace as JSON. Each namespace is copied under
+// its own lock, so writes to other namespaces may happen in between.
+func (ns *Namespaces) WriteSnapshot(w io.Writer) error {
+	ns.lock.Lock()
+	databases := make(map[string]*Database, len(ns.databases))
+	for name, db := range ns.databases {
+		databases[name] = db
+	}
+	ns.lock.Unlock()
+
+	s := snapshot{
+		Version:    snapshotVersion,
+		Namespaces: make(map[string][]snapshotEntry, len(databases)),
+	}
+	now := time.Now()
+	for name, db := range databases {
+		db.lock.RLock()
+		entries := make([]snapshotEntry, 0, len(db.data))
+		for key, kv := range db.data {
+			if kv.expired(now) {
+				continue
+			}
+			entry := snapshotEntry{
+				Key:        key,
+				Value:      kv.Value,
+				Expiration: kv.Expiration,
+				Flags:      kv.Flags,
+				Revision:   kv.Revision,
+			}
+			if kv.Queue != nil {
+				entry.Queue = append([]string{}, kv.Queue...)
+			}
+			entries = append(entries, entry)
+		}
+		db.lock.RUnlock()
+		s.Namespaces[name] = entries
+	}
+	// read last so that it is at least the revision of every key
+	s.Revision = atomic.LoadUint64(databases[DefaultNamespace].revisions)
+	return json.NewEncoder(w).Encode(s)
+}
+
+// add the keys of a snapshot written by WriteSnapshot, replacing keys of the
+// same name and creating the namespaces it holds. Keys keep their
+// revisions and expirations; keys that expired in the meantime are skipped.
+// No events are produced.
+func (ns *Namespaces) ReadSnapshot(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidSnapshot, s.Version)
+	}
+
+	// revisions must never be handed out twice
+	ns.lock.Lock()
+	revisions := ns.databases[DefaultNamespace].revisions
+	ns.lock.Unlock()
+	for {
+		current := atomic.LoadUint64(revisions)
+		if current >= s.Revision || atomic.CompareAndSwapUint64(revisions, current, s.Revision) {
+			break
+		}
+	}
+
+	now := time.Now()
+	for name, entries := range s.Namespaces {
+		db, err := ns.Get(name)
+		if err != nil {
+			return err
+		}
+		db.lock.Lock()
+		for _, entry := range entries {
+			kv := &KeyValuePair{
+				Value:      entry.Value,
+				Queue:      entry.Queue,
+				Expiration: entry.Expiration,
+				Flags:      entry.Flags,
+				Revision:   entry.Revision,
+			}
+			if kv.expired(now) {
+				continue
+			}
+			db.link(entry.Key, kv)
+			db.revision = max(db.revision, entry.Revision)
+		}
+		db.makeRoom("", 0)
+		db.lock.Unlock()
+	}
+	return nil
+}
+
+// write a snapshot to the file at path. The snapshot is written to a
+// temporary file first and renamed, so the file always holds a complete one.
+func (ns *Namespaces) SaveSnapshot(path string) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = ns.WriteSnapshot(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// read the snapshot file at path if it exists, see ReadSnapshot
+func (ns *Namespaces) LoadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := ns.ReadSnapshot(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
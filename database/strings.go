@@ -0,0 +1,217 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWrongType     = errors.New("operation against a key holding the wrong kind of value")
+	ErrOffsetTooLong = errors.New("offset is out of range")
+)
+
+// the longest string SETRANGE may create
+const MaxStringLength = 512 << 20
+
+// return the plain value under key for a string operation. Callers must hold the lock.
+func (ds *Database) lookupString(key string) (*KeyValuePair, bool, error) {
+	kv, exists := ds.lookup(key)
+	if exists && kv.Queue != nil {
+		return nil, false, ErrWrongType
+	}
+	return kv, exists, nil
+}
+
+// replace the value of the existing pair under key in place, keeping its
+// expiration, and report the change as op. Callers must hold the write lock.
+func (ds *Database) rewrite(key, op string, kv *KeyValuePair, value string) error {
+	if err := ds.makeRoom(key, int64(len(value)-len(kv.Value))); err != nil {
+		return err
+	}
+	kv.Value = value
+	ds.resize(key, kv)
+	kv.Revision = ds.nextRevision()
+	ds.changed(key, op, ClassString, kv)
+	return nil
+}
+
+// append value to the string under key, creating it if it does not exist,
+// and return the new length
+func (ds *Database) Append(key, value string) (int, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.append(key, value)
+}
+
+// append to the string under key. Callers must hold the write lock.
+func (ds *Database) append(key, value string) (int, error) {
+	kv, exists, err := ds.lookupString(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if _, err := ds.store(key, KeyValuePair{Value: value}); err != nil {
+			return 0, err
+		}
+		return len(value), nil
+	}
+	if err := ds.rewrite(key, "append", kv, kv.Value+value); err != nil {
+		return 0, err
+	}
+	return len(kv.Value), nil
+}
+
+// return the length of the string under key, zero if it does not exist
+func (ds *Database) Strlen(key string) (int, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.strlen(key)
+}
+
+// return the length of the string under key. Callers must hold the lock.
+func (ds *Database) strlen(key string) (int, error) {
+	kv, exists, err := ds.lookupString(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return len(kv.Value), nil
+}
+
+// return the bytes of the string under key from start to end, both
+// inclusive. Negative offsets count from the end of the string, -1 being the
+// last byte. Offsets beyond the string are clamped, and a missing key reads
+// as the empty string.
+func (ds *Database) GetRange(key string, start, end int) (string, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	return ds.getRange(key, start, end)
+}
+
+// read a range of the string under key. Callers must hold the lock.
+func (ds *Database) getRange(key string, start, end int) (string, error) {
+	kv, exists, err := ds.lookupString(key)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	length := len(kv.Value)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end {
+		return "", nil
+	}
+	return kv.Value[start : end+1], nil
+}
+
+// overwrite the string under key with value starting at offset, padding it
+// with zero bytes if it is shorter, and return the new length. A missing key
+// is created unless value is empty.
+func (ds *Database) SetRange(key string, offset int, value string) (int, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.setRange(key, offset, value)
+}
+
+// overwrite part of the string under key. Callers must hold the write lock.
+func (ds *Database) setRange(key string, offset int, value string) (int, error) {
+	// offset+len(value) could overflow
+	if offset < 0 || offset > MaxStringLength-len(value) {
+		return 0, ErrOffsetTooLong
+	}
+
+	kv, exists, err := ds.lookupString(key)
+	if err != nil {
+		return 0, err
+	}
+	current := ""
+	if exists {
+		current = kv.Value
+	}
+	if value == "" {
+		return len(current), nil
+	}
+
+	var b strings.Builder
+	b.WriteString(current[:min(offset, len(current))])
+	if offset > len(current) {
+		b.WriteString(strings.Repeat("\x00", offset-len(current)))
+	}
+	b.WriteString(value)
+	if end := offset + len(value); end < len(current) {
+		b.WriteString(current[end:])
+	}
+	updated := b.String()
+
+	if !exists {
+		if _, err := ds.store(key, KeyValuePair{Value: updated}); err != nil {
+			return 0, err
+		}
+		return len(updated), nil
+	}
+	if err := ds.rewrite(key, "setrange", kv, updated); err != nil {
+		return 0, err
+	}
+	return len(updated), nil
+}
+
+// return the string under key and remove the key
+func (ds *Database) GetDel(key string) (string, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.getDel(key)
+}
+
+// read and remove the string under key. Callers must hold the write lock.
+func (ds *Database) getDel(key string) (string, error) {
+	kv, exists, err := ds.lookupString(key)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrNotFound
+	}
+	value := kv.Value
+	return value, ds.remove(key)
+}
+
+// return the string under key and replace its expiration. A zero expiration
+// clears the TTL and keeps the key, like PERSIST.
+func (ds *Database) GetEx(key string, expiration time.Time) (string, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.getEx(key, expiration)
+}
+
+// read the string under key and replace its expiration. Callers must hold the write lock.
+func (ds *Database) getEx(key string, expiration time.Time) (string, error) {
+	kv, exists, err := ds.lookupString(key)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrNotFound
+	}
+	if !kv.Expiration.Equal(expiration) {
+		ds.setExpiration(key, kv, expiration)
+		kv.Revision = ds.nextRevision()
+		ds.changed(key, "expire", ClassGeneric, kv)
+	}
+	return kv.Value, nil
+}
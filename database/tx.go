@@ -0,0 +1,170 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrTxAborted = errors.New("transaction aborted: watched key changed")
+
+// a view of the database that runs operations while Atomic holds the write
+// lock. It must not be used after the function passed to Atomic returns.
+type Tx struct {
+	ds *Database
+}
+
+// run fn with exclusive access to the database so that every operation it
+// performs through tx is applied atomically. watched maps keys to the
+// revisions the caller observed (zero for missing keys); if any of them has
+// changed, fn is not run and ErrTxAborted is returned.
+func (ds *Database) Atomic(watched map[string]uint64, fn func(tx *Tx)) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for key, revision := range watched {
+		current := uint64(0)
+		if kv, exists := ds.lookup(key); exists {
+			current = kv.Revision
+		}
+		if current != revision {
+			return ErrTxAborted
+		}
+	}
+
+	fn(&Tx{ds: ds})
+	return nil
+}
+
+// set the value for the given key, see Database.Set
+func (tx *Tx) Set(key, value string, expiry time.Duration, condition string) error {
+	_, _, err := tx.ds.set(key, newItem(value, expiry), condition)
+	return err
+}
+
+// store item under key, see Database.SetItem
+func (tx *Tx) SetItem(key string, item KeyValuePair, condition string) (uint64, bool, error) {
+	return tx.ds.set(key, item, condition)
+}
+
+// store item under key if its revision matches, see Database.CompareAndSet
+func (tx *Tx) CompareAndSet(key string, item KeyValuePair, revision uint64) (uint64, error) {
+	return tx.ds.compareAndSet(key, item, revision)
+}
+
+// retrieve the value for the given key, see Database.Get
+func (tx *Tx) Get(key string) (string, error) {
+	kv, err := tx.ds.get(key)
+	if err != nil {
+		return "", err
+	}
+	return kv.String(), nil
+}
+
+// retrieve a copy of the pair stored under key, see Database.GetItem
+func (tx *Tx) GetItem(key string) (KeyValuePair, error) {
+	return tx.ds.get(key)
+}
+
+// retrieve the values of several keys, see Database.MGet
+func (tx *Tx) MGet(keys []string) []*string {
+	return tx.ds.mget(keys)
+}
+
+// store several keys, see Database.MSet
+func (tx *Tx) MSet(entries []Entry) error {
+	return tx.ds.mset(entries)
+}
+
+// store several keys if none exists, see Database.MSetNX
+func (tx *Tx) MSetNX(entries []Entry) (bool, error) {
+	return tx.ds.msetnx(entries)
+}
+
+// append to the string under key, see Database.Append
+func (tx *Tx) Append(key, value string) (int, error) {
+	return tx.ds.append(key, value)
+}
+
+// return the length of the string under key, see Database.Strlen
+func (tx *Tx) Strlen(key string) (int, error) {
+	return tx.ds.strlen(key)
+}
+
+// read a range of the string under key, see Database.GetRange
+func (tx *Tx) GetRange(key string, start, end int) (string, error) {
+	return tx.ds.getRange(key, start, end)
+}
+
+// overwrite part of the string under key, see Database.SetRange
+func (tx *Tx) SetRange(key string, offset int, value string) (int, error) {
+	return tx.ds.setRange(key, offset, value)
+}
+
+// read and remove the string under key, see Database.GetDel
+func (tx *Tx) GetDel(key string) (string, error) {
+	return tx.ds.getDel(key)
+}
+
+// read the string under key and replace its expiration, see Database.GetEx
+func (tx *Tx) GetEx(key string, expiration time.Time) (string, error) {
+	return tx.ds.getEx(key, expiration)
+}
+
+// remove the key, see Database.Delete
+func (tx *Tx) Delete(key string) error {
+	return tx.ds.remove(key)
+}
+
+// return the keys matching pattern, see Database.Keys
+func (tx *Tx) Keys(pattern string) []string {
+	return tx.ds.keys(pattern)
+}
+
+// return a batch of matching keys, see Database.Scan
+func (tx *Tx) Scan(cursor uint64, pattern string, count int, typ string) (uint64, []string) {
+	return tx.ds.scan(cursor, pattern, count, typ)
+}
+
+// return the entries of a key range, see Database.Range
+func (tx *Tx) Range(start, end string, limit int, reverse bool) []Entry {
+	return tx.ds.rangeEntries(start, end, limit, reverse)
+}
+
+// count the keys with prefix, see Database.CountPrefix
+func (tx *Tx) CountPrefix(prefix string) int {
+	return tx.ds.countPrefix(prefix)
+}
+
+// remove the keys with prefix, see Database.DeletePrefix
+func (tx *Tx) DeletePrefix(prefix string, limit int) int {
+	return tx.ds.deletePrefix(prefix, limit)
+}
+
+// remove every key, see Database.Flush
+func (tx *Tx) Flush() {
+	tx.ds.flush()
+}
+
+// return the statistics, see Database.Stats
+func (tx *Tx) Stats() Stats {
+	return tx.ds.stats()
+}
+
+// append values to the queue for the given key, see Database.QPush
+func (tx *Tx) QPush(key string, values []string) error {
+	return tx.ds.push(key, values)
+}
+
+// remove the last inserted value from the queue, see Database.QPop
+func (tx *Tx) QPop(key string) (string, error) {
+	return tx.ds.pop(key)
+}
+
+// a transaction cannot wait for other clients, so an empty queue times out immediately
+func (tx *Tx) BQPop(key string, timeout time.Duration) (string, error) {
+	value, err := tx.ds.pop(key)
+	if err == ErrQueueEmpty {
+		return "", ErrTimeout
+	}
+	return value, err
+}
@@ -0,0 +1,94 @@
+package glob
+
+// report whether s matches the glob pattern. In the pattern '*' matches any
+// sequence of bytes including none, '?' matches any single byte, "[abc]"
+// matches one byte from the set, "[^abc]" one byte outside it, "[a-z]" one
+// byte in the range, and '\' makes the next byte match literally.
+//
+// Unlike path.Match, '*' also matches '/' and a malformed pattern simply
+// fails to match instead of returning an error.
+func Match(pattern, s string) bool {
+	// position to resume from when the last * has to swallow one more byte
+	starPattern, starS := -1, 0
+
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starS = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern, p, s[i]); ok {
+					p = end
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starPattern < 0 {
+			return false
+		}
+		starS++
+		p, i = starPattern+1, starS
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// report whether c matches the class opening at pattern[start] and return the
+// index just past the closing bracket
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	p := start + 1
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+
+	matched := false
+	for first := true; p < len(pattern); first = false {
+		if pattern[p] == ']' && !first {
+			return p + 1, matched != negate
+		}
+		lo := pattern[p]
+		if lo == '\\' && p+1 < len(pattern) {
+			p++
+			lo = pattern[p]
+		}
+		hi := lo
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			hi = pattern[p+2]
+			p += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		p++
+	}
+
+	// unterminated class
+	return 0, false
+}
@@ -1,5 +1,5 @@
 module github.com/7dpk/keyvaluestore
 
-go 1.20
+go 1.21
 
-require github.com/gorilla/mux v1.8.0 // indirect
+require github.com/gorilla/mux v1.8.0
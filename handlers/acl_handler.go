@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/gorilla/mux"
+)
+
+// the key of the authenticated user in the request context
+type userContextKey struct{}
+
+// the specs the routes without a command of their own are authorized as
+var routeSpecs = map[string]commandparser.Spec{
+	// GET /subscribe
+	"SUBSCRIBE": {Name: "SUBSCRIBE", Flags: []string{commandparser.FlagPubSub}, Group: "pubsub"},
+	// GET /keyspace/events and GET /watch?prefix=true
+	"EVENTS": {Name: "EVENTS", Flags: []string{commandparser.FlagReadOnly, commandparser.FlagAllKeys}, Group: "keyspace"},
+}
+
+// represent a user in the GETUSER response JSON structure
+type ResponseUser struct {
+	Flags    []string `json:"flags"`
+	Tokens   []string `json:"tokens"`
+	Keys     []string `json:"keys"`
+	Commands []string `json:"commands"`
+}
+
+// return the users, creating an ACL that allows everything if none was set
+func (h *HTTPHandler) acl() *acl.ACL {
+	h.aclOnce.Do(func() {
+		if h.ACL == nil {
+			h.ACL = acl.New()
+		}
+	})
+	return h.ACL
+}
+
+// return the audit log, creating one writing to the server log if none was set
+func (h *HTTPHandler) audit() *acl.AuditLog {
+	h.auditOnce.Do(func() {
+		if h.Audit == nil {
+			h.Audit = acl.NewAuditLog(nil, acl.DefaultAuditLogSize)
+		}
+	})
+	return h.Audit
+}
+
+// return the token of the Authorization: Bearer header, empty if there is none
+func bearerToken(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// return the user a request is made as: the owner of its bearer token or,
+// without one, the user named by its verified client certificate. Only a
+// request with neither falls back to the default user; a certificate naming
+// an unknown or disabled user is refused.
+func (h *HTTPHandler) identify(r *http.Request) (*acl.User, error) {
+	token := bearerToken(r)
+	if token == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return h.acl().AuthenticateCertificate(r.TLS.VerifiedChains[0][0])
+	}
+	return h.acl().Authenticate(token)
+}
+
+// authenticate every request by its bearer token or client certificate and
+// answer 401 if neither names an enabled user and there is no default user
+func (h *HTTPHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := h.identify(r)
+		if err != nil {
+			h.audit().Record(acl.AuditEntry{Event: acl.EventAuth, Client: r.RemoteAddr})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="keyvaluestore"`)
+			res := errorResult(err)
+			writeJSONResponse(w, res.response(h.legacyResponses(r)), res.statusCode)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// return the user the request is made as, nil if it is not authenticated
+func (h *HTTPHandler) requestUser(r *http.Request) *acl.User {
+	if user, ok := r.Context().Value(userContextKey{}).(*acl.User); ok {
+		return user
+	}
+	// the handler is served without its router
+	user, _ := h.identify(r)
+	return user
+}
+
+// return the spec of a command or of a route without a command of its own
+func (h *HTTPHandler) lookupSpec(cmd string) commandparser.Spec {
+	if spec, exists := h.commands().specs.Lookup(cmd); exists {
+		return spec
+	}
+	return routeSpecs[cmd]
+}
+
+// check that the user of the request may run the command with the arguments
+// and record a denial in the audit log. WHOAMI is allowed to every user.
+func (h *HTTPHandler) authorize(r *http.Request, cmd string, params []string) error {
+	user := h.requestUser(r)
+	if user == nil {
+		return acl.ErrUnauthenticated
+	}
+	if cmd == "WHOAMI" {
+		return nil
+	}
+
+	err := user.Check(h.lookupSpec(cmd), params)
+	if denied, ok := err.(*acl.PermissionError); ok {
+		entry := acl.AuditEntry{Event: acl.EventCommand, User: user.Name, Client: r.RemoteAddr, Command: cmd}
+		if denied.Key != "" {
+			entry.Event, entry.Key = acl.EventKey, denied.Key
+		}
+		h.audit().Record(entry)
+	}
+	return err
+}
+
+// authorize and rate limit the requests of a route as the command, with the
+// key of the route as its argument, before serving them
+func (h *HTTPHandler) guard(cmd string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var params []string
+		if key, ok := mux.Vars(r)["key"]; ok {
+			params = []string{key}
+		}
+		err := h.authorize(r, cmd, params)
+		if err == nil {
+			err = h.limit(r, cmd)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if h.lookupSpec(cmd).HasFlag(commandparser.FlagBlocking) {
+			release, err := h.waitSlot(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			defer release()
+		}
+		next(w, r)
+	}
+}
+
+// execute WHOAMI and the ACL subcommands, which act on the users instead of a database
+func (h *HTTPHandler) access(r *http.Request, cmd string, params []string) result {
+	if cmd == "WHOAMI" {
+		return valueResult(h.requestUser(r).Name)
+	}
+
+	users := h.acl()
+	switch subcommand := strings.ToUpper(params[0]); subcommand {
+	case "SETUSER", "DELUSER", "LOAD":
+		res := h.changeUsers(subcommand, params[1:])
+		if res.statusCode == http.StatusOK {
+			h.audit().Record(acl.AuditEntry{
+				Event:   acl.EventChange,
+				User:    h.requestUser(r).Name,
+				Client:  r.RemoteAddr,
+				Command: "ACL " + subcommand,
+				Detail:  strings.Join(acl.Redact(params[1:]), " "),
+			})
+		}
+		return res
+	case "GETUSER":
+		user, exists := users.User(params[1])
+		if !exists {
+			return okResult(NullReply(), nil)
+		}
+		response := ResponseUser{
+			Flags:    user.Flags(),
+			Tokens:   user.TokenHashes(),
+			Keys:     user.KeyPatterns(),
+			Commands: user.CommandRules(),
+		}
+		return okResult(MapReply(map[string]Reply{
+			"flags":    stringsReply(response.Flags),
+			"tokens":   stringsReply(response.Tokens),
+			"keys":     stringsReply(response.Keys),
+			"commands": stringsReply(response.Commands),
+		}), response)
+	case "LIST", "USERS":
+		lines := []string{}
+		for _, user := range users.Users() {
+			if subcommand == "LIST" {
+				lines = append(lines, user.String())
+			} else {
+				lines = append(lines, user.Name)
+			}
+		}
+		return okResult(stringsReply(lines), lines)
+	case "CAT":
+		names := h.categories(params[1:])
+		return okResult(stringsReply(names), names)
+	case "LOG":
+		return h.auditLog(params[1:])
+	default: // SAVE
+		path := h.config().Snapshot().ACLFile
+		if path == "" {
+			return errorResult(stateError("ACL SAVE needs the acl-file setting"))
+		}
+		if err := users.SaveFile(path); err != nil {
+			return errorResult(err)
+		}
+		return blankResult()
+	}
+}
+
+// execute ACL SETUSER, DELUSER and LOAD
+func (h *HTTPHandler) changeUsers(subcommand string, params []string) result {
+	users := h.acl()
+	switch subcommand {
+	case "SETUSER":
+		if err := users.SetUser(params[0], params[1:]...); err != nil {
+			return errorResult(err)
+		}
+		return blankResult()
+	case "DELUSER":
+		return countResult(users.DeleteUser(params...))
+	default: // LOAD
+		path := h.config().Snapshot().ACLFile
+		if path == "" {
+			return errorResult(stateError("ACL LOAD needs the acl-file setting"))
+		}
+		if err := users.LoadFile(path); err != nil {
+			return errorResult(err)
+		}
+		return blankResult()
+	}
+}
+
+// return the categories of every command, or the commands of one category, sorted
+func (h *HTTPHandler) categories(params []string) []string {
+	specs := h.commands().specs.Specs()
+	for _, spec := range routeSpecs {
+		specs = append(specs, spec)
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, spec := range specs {
+		for _, category := range acl.Categories(spec) {
+			name := category
+			if len(params) > 0 {
+				if category != strings.ToLower(params[0]) {
+					continue
+				}
+				name = spec.Name
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// execute ACL LOG [count | RESET]
+func (h *HTTPHandler) auditLog(params []string) result {
+	count := 10
+	if len(params) > 0 {
+		if strings.ToUpper(params[0]) == "RESET" {
+			h.audit().Reset()
+			return blankResult()
+		}
+		n, err := strconv.Atoi(params[0])
+		if err != nil || n <= 0 {
+			return errorResult(commandparser.InvalidArgument("invalid count"))
+		}
+		count = n
+	}
+
+	entries := h.audit().Entries(count)
+	items := make([]Reply, len(entries))
+	for i, entry := range entries {
+		items[i] = MapReply(map[string]Reply{
+			"time":    StringReply(entry.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")),
+			"event":   StringReply(entry.Event),
+			"user":    StringReply(entry.User),
+			"client":  StringReply(entry.Client),
+			"command": StringReply(entry.Command),
+			"key":     StringReply(entry.Key),
+			"detail":  StringReply(entry.Detail),
+		})
+	}
+	return okResult(ArrayReply(items...), entries)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handle POST /batch. The body is a JSON array of commands which are executed
+// in order and answered with a JSON array of results in the same order. Errors
+// are reported per command and do not stop the batch.
+//
+// With the application/x-ndjson content type the body is a stream of commands,
+// one JSON object per line, and each result is written as its own line as soon
+// as the command completes.
+func (h *HTTPHandler) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		h.handleStream(w, r)
+		return
+	}
+
+	sess, res := h.lookupSession(r)
+	if sess == nil {
+		writeJSONResponse(w, res.response(h.legacyResponses(r)), res.statusCode)
+		return
+	}
+
+	var requestBodies []RequestBody
+	err := json.NewDecoder(r.Body).Decode(&requestBodies)
+	if err != nil {
+		writeError(w, ErrInvalidRequest)
+		return
+	}
+
+	legacy := h.legacyResponses(r)
+	responses := make([]interface{}, len(requestBodies))
+	var wait time.Duration
+	for i, requestBody := range requestBodies {
+		res := h.run(sess, r, requestBody)
+		responses[i] = res.response(legacy)
+		wait = max(wait, res.retryAfter)
+	}
+	// the batch succeeds even if some of its commands were rate limited
+	if wait > 0 {
+		setRetryAfter(w, wait)
+	}
+	writeJSONResponse(w, responses, http.StatusOK)
+}
+
+// execute newline delimited commands as they arrive and flush each result
+func (h *HTTPHandler) handleStream(w http.ResponseWriter, r *http.Request) {
+	sess, res := h.lookupSession(r)
+	if sess == nil {
+		writeJSONResponse(w, res.response(h.legacyResponses(r)), res.statusCode)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	// HTTP/1.x only lets us keep reading the body after responding in full duplex mode
+	if err := controller.EnableFullDuplex(); err != nil && r.ProtoMajor == 1 {
+		log.Println("Error enabling full duplex:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	legacy := h.legacyResponses(r)
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	for {
+		var requestBody RequestBody
+		err := decoder.Decode(&requestBody)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// the stream cannot be resynchronized after malformed JSON
+			encoder.Encode(errorResult(ErrInvalidRequest).response(legacy))
+			return
+		}
+
+		if err := encoder.Encode(h.run(sess, r, requestBody).response(legacy)); err != nil {
+			log.Println("Error encoding JSON response:", err)
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
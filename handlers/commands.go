@@ -0,0 +1,579 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+)
+
+// run a custom command against the store of the request, which is a
+// transaction when the command was queued with MULTI. The reply is sent in
+// the typed form whatever the requested format.
+type CommandFunc func(st Store, args []string) (Reply, error)
+
+// run a builtin command against the store
+type commandFunc func(h *HTTPHandler, st Store, params []string) result
+
+// the commands a handler knows: their specs, used to parse and describe
+// them, and the functions running them. Commands with the session flag have
+// no function, they are run by the handler itself.
+type commandTable struct {
+	specs *commandparser.Registry
+
+	lock  sync.RWMutex
+	funcs map[string]commandFunc
+}
+
+// the functions of the builtin commands
+var builtinFuncs = map[string]commandFunc{
+	"SET":         runSet,
+	"GET":         runGet,
+	"CAS":         runCAS,
+	"APPEND":      runAppend,
+	"STRLEN":      runStrlen,
+	"SETRANGE":    runSetRange,
+	"GETRANGE":    runGetRange,
+	"GETDEL":      runGetDel,
+	"GETEX":       runGetEx,
+	"MGET":        runMGet,
+	"MSET":        runMSet,
+	"MSETNX":      runMSetNX,
+	"DEL":         runDel,
+	"FLUSHDB":     runFlushDB,
+	"INFO":        runInfo,
+	"KEYS":        runKeys,
+	"SCAN":        runScan,
+	"RANGE":       runRange,
+	"PREFIXCOUNT": runPrefixCount,
+	"PREFIXDEL":   runPrefixDel,
+	"PUBLISH":     runPublish,
+	"QPUSH":       runQPush,
+	"QPOP":        runQPop,
+	"BQPOP":       runBQPop,
+	"CONFIG":      runConfig,
+}
+
+// represent a command in the response of GET /commands and COMMAND
+type ResponseCommand struct {
+	Name     string   `json:"name"`
+	MinArgs  int      `json:"min_args"`
+	MaxArgs  int      `json:"max_args"`
+	Flags    []string `json:"flags"`
+	FirstKey int      `json:"first_key"`
+	LastKey  int      `json:"last_key"`
+	KeyStep  int      `json:"key_step"`
+	Group    string   `json:"group,omitempty"`
+	Syntax   string   `json:"syntax,omitempty"`
+	Summary  string   `json:"summary,omitempty"`
+}
+
+// represent the response JSON structure of COMMAND in the legacy format
+type ResponseCommands struct {
+	Commands []ResponseCommand `json:"commands"`
+}
+
+func newResponseCommand(spec commandparser.Spec) ResponseCommand {
+	flags := spec.Flags
+	if flags == nil {
+		flags = []string{}
+	}
+	return ResponseCommand{
+		Name:     spec.Name,
+		MinArgs:  spec.MinArgs,
+		MaxArgs:  spec.MaxArgs,
+		Flags:    flags,
+		FirstKey: spec.FirstKey,
+		LastKey:  spec.LastKey,
+		KeyStep:  spec.KeyStep,
+		Group:    spec.Group,
+		Syntax:   spec.Syntax,
+		Summary:  spec.Summary,
+	}
+}
+
+// return the command as a typed map with the keys of ResponseCommand
+func commandReply(spec commandparser.Spec) Reply {
+	return MapReply(map[string]Reply{
+		"name":      StringReply(spec.Name),
+		"min_args":  IntegerReply(int64(spec.MinArgs)),
+		"max_args":  IntegerReply(int64(spec.MaxArgs)),
+		"flags":     stringsReply(spec.Flags),
+		"first_key": IntegerReply(int64(spec.FirstKey)),
+		"last_key":  IntegerReply(int64(spec.LastKey)),
+		"key_step":  IntegerReply(int64(spec.KeyStep)),
+		"group":     StringReply(spec.Group),
+		"syntax":    StringReply(spec.Syntax),
+		"summary":   StringReply(spec.Summary),
+	})
+}
+
+// return the commands of the handler, starting with the builtin ones
+func (h *HTTPHandler) commands() *commandTable {
+	h.commandsOnce.Do(func() {
+		funcs := make(map[string]commandFunc, len(builtinFuncs))
+		for name, fn := range builtinFuncs {
+			funcs[name] = fn
+		}
+		// COMMAND reads the table itself so it cannot be among builtinFuncs
+		funcs["COMMAND"] = runCommand
+		h.commandTable = &commandTable{
+			specs: commandparser.NewRegistry(commandparser.Builtins()...),
+			funcs: funcs,
+		}
+	})
+	return h.commandTable
+}
+
+// add a custom command, which can then be sent like any builtin one. The
+// spec declares how the arguments are checked before fn is called. Names
+// already taken and commands with the session flag are refused.
+func (h *HTTPHandler) RegisterCommand(spec commandparser.Spec, fn CommandFunc) error {
+	if fn == nil || spec.HasFlag(commandparser.FlagSession) {
+		return commandparser.ErrInvalidSpec
+	}
+	table := h.commands()
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	if err := table.specs.Register(spec); err != nil {
+		return err
+	}
+	table.funcs[strings.ToUpper(strings.TrimSpace(spec.Name))] = func(h *HTTPHandler, st Store, params []string) result {
+		reply, err := fn(st, params)
+		if err != nil {
+			return errorResult(err)
+		}
+		return okResult(reply, reply)
+	}
+	return nil
+}
+
+// return the specs of every command the handler knows, sorted by name
+func (h *HTTPHandler) Commands() []commandparser.Spec {
+	return h.commands().specs.Specs()
+}
+
+// parse a command sent as a string, or as a name and its arguments
+func (h *HTTPHandler) parse(requestBody RequestBody) (string, []string, error) {
+	specs := h.commands().specs
+	if requestBody.Args != nil {
+		return specs.ParseArgs(requestBody.Command, requestBody.Args)
+	}
+	return specs.ParseCommand(requestBody.Command)
+}
+
+// perform the operation for a parsed command against the store
+func (h *HTTPHandler) execute(st Store, cmd string, params []string) result {
+	table := h.commands()
+	table.lock.RLock()
+	fn := table.funcs[cmd]
+	table.lock.RUnlock()
+
+	if fn == nil {
+		return errorResult(commandparser.ErrInvalidCommand)
+	}
+	return fn(h, st, params)
+}
+
+// handle GET /commands by describing every command
+func (h *HTTPHandler) ListCommands(w http.ResponseWriter, r *http.Request) {
+	specs := h.Commands()
+	response := make([]ResponseCommand, len(specs))
+	for i, spec := range specs {
+		response[i] = newResponseCommand(spec)
+	}
+	writeJSONResponse(w, response, http.StatusOK)
+}
+
+// COMMAND [COUNT | INFO name ... | DOCS [name ...] | GETKEYS name arg ...]
+func runCommand(h *HTTPHandler, st Store, params []string) result {
+	table := h.commands().specs
+	if len(params) == 0 {
+		specs := table.Specs()
+		items := make([]Reply, len(specs))
+		response := ResponseCommands{Commands: make([]ResponseCommand, len(specs))}
+		for i, spec := range specs {
+			items[i] = commandReply(spec)
+			response.Commands[i] = newResponseCommand(spec)
+		}
+		return okResult(ArrayReply(items...), response)
+	}
+
+	switch strings.ToUpper(params[0]) {
+	case "COUNT":
+		if len(params) != 1 {
+			return errorResult(commandparser.ErrInvalidCommand)
+		}
+		return countResult(len(table.Specs()))
+	case "INFO":
+		// unknown commands are null, or missing in the legacy format
+		items := make([]Reply, 0, len(params)-1)
+		response := ResponseCommands{Commands: []ResponseCommand{}}
+		for _, name := range params[1:] {
+			spec, exists := table.Lookup(name)
+			if !exists {
+				items = append(items, NullReply())
+				continue
+			}
+			items = append(items, commandReply(spec))
+			response.Commands = append(response.Commands, newResponseCommand(spec))
+		}
+		return okResult(ArrayReply(items...), response)
+	case "DOCS":
+		specs := table.Specs()
+		if len(params) > 1 {
+			specs = specs[:0]
+			for _, name := range params[1:] {
+				if spec, exists := table.Lookup(name); exists {
+					specs = append(specs, spec)
+				}
+			}
+		}
+		docs := make(map[string]Reply, len(specs))
+		response := make(map[string]ResponseCommand, len(specs))
+		for _, spec := range specs {
+			docs[spec.Name] = MapReply(map[string]Reply{
+				"group":   StringReply(spec.Group),
+				"syntax":  StringReply(spec.Syntax),
+				"summary": StringReply(spec.Summary),
+			})
+			response[spec.Name] = ResponseCommand{Name: spec.Name, Group: spec.Group, Syntax: spec.Syntax, Summary: spec.Summary}
+		}
+		return okResult(MapReply(docs), response)
+	case "GETKEYS":
+		if len(params) < 2 {
+			return errorResult(commandparser.ErrInvalidCommand)
+		}
+		name, args, err := table.ParseArgs(params[1], params[2:])
+		if err != nil {
+			return errorResult(err)
+		}
+		spec, _ := table.Lookup(name)
+		keys := spec.Keys(args)
+		if keys == nil {
+			keys = []string{}
+		}
+		return okResult(stringsReply(keys), ResponseKeys{Keys: keys})
+	}
+	return errorResult(commandparser.ErrInvalidCommand)
+}
+
+func runSet(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	value := params[1]
+	expiry := time.Duration(0)
+	condition := ""
+
+	if len(params) > 2 {
+		for i := 2; i < len(params); i++ {
+			param := params[i]
+			if param == "EX" && i+1 < len(params) {
+				expiryStr := params[i+1]
+				expirySeconds, err := strconv.Atoi(expiryStr)
+				if err != nil {
+					return errorResult(commandparser.InvalidArgument("invalid expiry time"))
+				}
+				expiry = time.Duration(expirySeconds) * time.Second
+				i++
+			} else if param == "NX" || param == "XX" {
+				condition = param
+			} else {
+				return errorResult(commandparser.ErrInvalidCommand)
+			}
+		}
+	}
+
+	err := st.Set(key, value, expiry, condition)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	return blankResult()
+}
+
+func runGet(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	if len(params) == 2 {
+		if strings.ToUpper(params[1]) != "WITHREVISION" {
+			return errorResult(commandparser.ErrInvalidCommand)
+		}
+		item, err := st.GetItem(key)
+		if err != nil {
+			return errorResult(err)
+		}
+		return okResult(MapReply(map[string]Reply{
+			"value":    StringReply(item.String()),
+			"revision": IntegerReply(int64(item.Revision)),
+		}), ResponseValue{Value: item.String(), Revision: item.Revision})
+	}
+	value, err := st.Get(key)
+	if err != nil {
+		return errorResult(err)
+	}
+	return valueResult(value)
+}
+
+func runCAS(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	revision, err := strconv.ParseUint(params[1], 10, 64)
+	if err != nil {
+		return errorResult(commandparser.InvalidArgument("invalid revision"))
+	}
+	expiry := time.Duration(0)
+	if len(params) > 3 {
+		if len(params) != 5 || strings.ToUpper(params[3]) != "EX" {
+			return errorResult(commandparser.ErrInvalidCommand)
+		}
+		expirySeconds, err := strconv.Atoi(params[4])
+		if err != nil {
+			return errorResult(commandparser.InvalidArgument("invalid expiry time"))
+		}
+		expiry = time.Duration(expirySeconds) * time.Second
+	}
+	item := database.KeyValuePair{Value: params[2]}
+	if expiry > 0 {
+		item.Expiration = time.Now().Add(expiry)
+	}
+	newRevision, err := st.CompareAndSet(key, item, revision)
+	if err != nil {
+		return errorResult(err)
+	}
+	return okResult(IntegerReply(int64(newRevision)), ResponseRevision{Revision: newRevision})
+}
+
+func runAppend(h *HTTPHandler, st Store, params []string) result {
+	length, err := st.Append(params[0], params[1])
+	return lengthResult(length, err)
+}
+
+func runStrlen(h *HTTPHandler, st Store, params []string) result {
+	length, err := st.Strlen(params[0])
+	return lengthResult(length, err)
+}
+
+func runSetRange(h *HTTPHandler, st Store, params []string) result {
+	offset, err := strconv.Atoi(params[1])
+	if err != nil {
+		return errorResult(commandparser.InvalidArgument("invalid offset"))
+	}
+	length, err := st.SetRange(params[0], offset, params[2])
+	return lengthResult(length, err)
+}
+
+func runGetRange(h *HTTPHandler, st Store, params []string) result {
+	start, err := strconv.Atoi(params[1])
+	if err != nil {
+		return errorResult(commandparser.InvalidArgument("invalid start"))
+	}
+	end, err := strconv.Atoi(params[2])
+	if err != nil {
+		return errorResult(commandparser.InvalidArgument("invalid end"))
+	}
+	value, err := st.GetRange(params[0], start, end)
+	if err != nil {
+		return errorResult(err)
+	}
+	return valueResult(value)
+}
+
+func runGetDel(h *HTTPHandler, st Store, params []string) result {
+	value, err := st.GetDel(params[0])
+	if err != nil {
+		return errorResult(err)
+	}
+	return valueResult(value)
+}
+
+func runGetEx(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	if len(params) == 1 {
+		item, err := st.GetItem(key)
+		if err != nil {
+			return errorResult(err)
+		}
+		if item.Type() != database.TypeString {
+			return errorResult(database.ErrWrongType)
+		}
+		return valueResult(item.Value)
+	}
+	expiration, err := parseExpiration(params[1:])
+	if err != nil {
+		return errorResult(err)
+	}
+	value, err := st.GetEx(key, expiration)
+	if err != nil {
+		return errorResult(err)
+	}
+	return valueResult(value)
+}
+
+func runMGet(h *HTTPHandler, st Store, params []string) result {
+	values := st.MGet(params)
+	items := make([]Reply, len(values))
+	for i, value := range values {
+		if value == nil {
+			items[i] = NullReply()
+		} else {
+			items[i] = StringReply(*value)
+		}
+	}
+	return okResult(ArrayReply(items...), ResponseValues{Values: values})
+}
+
+// return the key value pairs of MSET and MSETNX
+func parseEntries(params []string) []database.Entry {
+	entries := make([]database.Entry, 0, len(params)/2)
+	for i := 0; i < len(params); i += 2 {
+		entries = append(entries, database.Entry{
+			Key:  params[i],
+			Item: database.KeyValuePair{Value: params[i+1]},
+		})
+	}
+	return entries
+}
+
+func runMSet(h *HTTPHandler, st Store, params []string) result {
+	if err := st.MSet(parseEntries(params)); err != nil {
+		return errorResult(err)
+	}
+	return blankResult()
+}
+
+func runMSetNX(h *HTTPHandler, st Store, params []string) result {
+	entries := parseEntries(params)
+	stored, err := st.MSetNX(entries)
+	if err != nil {
+		return errorResult(err)
+	}
+	count := 0
+	if stored {
+		count = len(entries)
+	}
+	return countResult(count)
+}
+
+func runDel(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	err := st.Delete(key)
+	if err != nil {
+		return errorResult(err)
+	}
+	return blankResult()
+}
+
+func runFlushDB(h *HTTPHandler, st Store, params []string) result {
+	st.Flush()
+	return blankResult()
+}
+
+func runInfo(h *HTTPHandler, st Store, params []string) result {
+	stats := st.Stats()
+	return okResult(statsReply(stats), newResponseStats(stats))
+}
+
+func runKeys(h *HTTPHandler, st Store, params []string) result {
+	pattern := params[0]
+	keys := st.Keys(pattern)
+	return okResult(stringsReply(keys), ResponseKeys{Keys: keys})
+}
+
+func runScan(h *HTTPHandler, st Store, params []string) result {
+	cursor, err := strconv.ParseUint(params[0], 10, 64)
+	if err != nil {
+		return errorResult(commandparser.InvalidArgument("invalid cursor"))
+	}
+	pattern, count, typ, err := parseScanOptions(params[1:])
+	if err != nil {
+		return errorResult(err)
+	}
+	next, keys := st.Scan(cursor, pattern, count, typ)
+	response := ResponseScan{Cursor: strconv.FormatUint(next, 10), Keys: keys}
+	return okResult(MapReply(map[string]Reply{
+		"cursor": StringReply(response.Cursor),
+		"keys":   stringsReply(keys),
+	}), response)
+}
+
+func runRange(h *HTTPHandler, st Store, params []string) result {
+	start, end := params[0], params[1]
+	limit, reverse, err := parseRangeOptions(params[2:], true)
+	if err != nil {
+		return errorResult(err)
+	}
+	entries := st.Range(start, end, limit, reverse)
+	response := ResponseEntries{Entries: make([]ResponseEntry, len(entries))}
+	items := make([]Reply, len(entries))
+	for i, entry := range entries {
+		response.Entries[i] = ResponseEntry{Key: entry.Key, Value: entry.Item.String()}
+		items[i] = MapReply(map[string]Reply{
+			"key":   StringReply(entry.Key),
+			"value": StringReply(entry.Item.String()),
+		})
+	}
+	return okResult(ArrayReply(items...), response)
+}
+
+func runPrefixCount(h *HTTPHandler, st Store, params []string) result {
+	prefix := params[0]
+	return countResult(st.CountPrefix(prefix))
+}
+
+func runPrefixDel(h *HTTPHandler, st Store, params []string) result {
+	prefix := params[0]
+	limit, _, err := parseRangeOptions(params[1:], false)
+	if err != nil {
+		return errorResult(err)
+	}
+	return countResult(st.DeletePrefix(prefix, limit))
+}
+
+func runPublish(h *HTTPHandler, st Store, params []string) result {
+	channel := params[0]
+	message := params[1]
+	subscribers := h.broker().Publish(channel, message)
+	return okResult(IntegerReply(int64(subscribers)), ResponseSubscribers{Subscribers: subscribers})
+}
+
+func runQPush(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	values := params[1:]
+	if err := st.QPush(key, values); err != nil {
+		return errorResult(err)
+	}
+	return blankResult()
+}
+
+func runQPop(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	value, err := st.QPop(key)
+	if err != nil {
+		return errorResult(err)
+	}
+	return valueResult(value)
+}
+
+func runBQPop(h *HTTPHandler, st Store, params []string) result {
+	key := params[0]
+	timeoutStr := params[1]
+	timeoutSeconds, err := strconv.ParseFloat(timeoutStr, 64)
+	if err != nil {
+		return errorResult(commandparser.InvalidArgument("invalid timeout"))
+	}
+	timeout := time.Duration(timeoutSeconds * float64(time.Second))
+	value, err := st.BQPop(key, timeout)
+	if errors.Is(err, database.ErrTimeout) {
+		// an expired wait is null, or an empty value in the legacy format
+		return okResult(NullReply(), ResponseValue{})
+	}
+	if err != nil {
+		return errorResult(err)
+	}
+	return valueResult(value)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/config"
+)
+
+// return the settings, creating default ones if none were set
+func (h *HTTPHandler) config() *config.Config {
+	h.configOnce.Do(func() {
+		if h.Config == nil {
+			h.Config = config.Default()
+			h.Config.LegacyResponses = h.LegacyResponses
+		}
+	})
+	return h.Config
+}
+
+// apply the settings that can change at runtime to every namespace and the
+// rate limiter
+func (h *HTTPHandler) applyConfig() {
+	settings := h.config().Snapshot()
+	namespaces := h.namespaces()
+	for _, name := range namespaces.Names() {
+		db, err := namespaces.Get(name)
+		if err != nil {
+			continue
+		}
+		db.SetMaxMemory(settings.MaxMemory, settings.MaxMemoryPolicy)
+		db.SetExpiryInterval(settings.ExpiryInterval)
+	}
+	namespaces.SetClientLimit(settings.NamespacesPerClient)
+	applyLimits(h.limiter(), &settings)
+}
+
+// CONFIG GET pattern | CONFIG SET setting value [setting value ...]
+func runConfig(h *HTTPHandler, st Store, params []string) result {
+	if strings.ToUpper(params[0]) == "SET" {
+		if err := h.config().Set(params[1:]...); err != nil {
+			return errorResult(err)
+		}
+		h.applyConfig()
+		return blankResult()
+	}
+
+	values := h.config().Match(params[1])
+	fields := make(map[string]Reply, len(values))
+	for name, value := range values {
+		fields[name] = StringReply(value)
+	}
+	return okResult(MapReply(fields), values)
+}
+
+// a response writer remembering the status code for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// let http.ResponseController reach the flushing of the wrapped writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// log every request once it is answered if the log-requests setting is on
+func (h *HTTPHandler) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.config().Snapshot().LogRequests {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		log.Printf("%s %s %s %d %v", r.RemoteAddr, r.Method, r.URL.RequestURI(), recorder.status, time.Since(start))
+	})
+}
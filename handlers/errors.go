@@ -0,0 +1,110 @@
+package handlers
+
+//go:generate go run gen_errorcodes.go
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/ratelimit"
+)
+
+// errors raised by the handlers themselves rather than by the database
+var (
+	ErrInvalidRequest     = errors.New("invalid request body")
+	ErrUnknownSession     = errors.New("unknown session")
+	ErrTxDiscarded        = errors.New("transaction discarded because of previous errors")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// matched by the errors of commands sent in a state that does not allow them
+	ErrInvalidState = errors.New("command not allowed in this state")
+)
+
+// a command sent in the wrong state described by its own message, matching
+// ErrInvalidState with errors.Is
+type stateError string
+
+func (e stateError) Error() string {
+	return string(e)
+}
+
+func (e stateError) Unwrap() error {
+	return ErrInvalidState
+}
+
+// a machine-readable error code, the HTTP status it is answered with and the
+// sentinel error it stands for
+type ErrorCode struct {
+	Code        string
+	Status      int
+	Err         error
+	Description string
+}
+
+// the error codes in the order they are matched, ending with the code of
+// errors matching none of the others
+var errorCodes = []ErrorCode{
+	{"INVALID_REQUEST", http.StatusBadRequest, ErrInvalidRequest, "The request body is not valid JSON."},
+	{"EMPTY_COMMAND", http.StatusBadRequest, commandparser.ErrEmptyCommand, "The command has no keyword."},
+	{"INVALID_COMMAND", http.StatusBadRequest, commandparser.ErrInvalidCommand, "The command is unknown, has the wrong number of arguments or an unknown option."},
+	{"SYNTAX_ERROR", http.StatusBadRequest, commandparser.ErrSyntax, "The quoting or escaping of the command string is malformed."},
+	{"INVALID_ARGUMENT", http.StatusBadRequest, commandparser.ErrInvalidArgument, "An argument, query parameter or header value is malformed or out of range."},
+	{"NOT_FOUND", http.StatusNotFound, database.ErrNotFound, "The key does not exist."},
+	{"QUEUE_EMPTY", http.StatusNotFound, database.ErrQueueEmpty, "The queue has no items."},
+	{"WRONG_TYPE", http.StatusBadRequest, database.ErrWrongType, "The key holds a queue where a string is expected, or the other way around."},
+	{"NOT_A_NUMBER", http.StatusBadRequest, database.ErrNotNumber, "The value cannot be incremented as a number."},
+	{"OUT_OF_RANGE", http.StatusBadRequest, database.ErrOffsetTooLong, "The offset would make the string too long."},
+	{"CONDITION_FAILED", http.StatusConflict, database.ErrConditionFailed, "An NX, XX or revision condition was not met."},
+	{"PRECONDITION_FAILED", http.StatusPreconditionFailed, ErrPreconditionFailed, "An If-Match or If-None-Match header did not match the revision of the key."},
+	{"TX_ABORTED", http.StatusConflict, database.ErrTxAborted, "A watched key changed before EXEC."},
+	{"TX_DISCARDED", http.StatusBadRequest, ErrTxDiscarded, "A command could not be queued, so EXEC discarded the transaction."},
+	{"INVALID_STATE", http.StatusBadRequest, ErrInvalidState, "The command is not allowed in the current transaction state, e.g. EXEC without MULTI."},
+	{"UNKNOWN_SESSION", http.StatusNotFound, ErrUnknownSession, "The session token is unknown or expired."},
+	{"INVALID_NAMESPACE", http.StatusBadRequest, database.ErrInvalidNamespace, "The namespace name is not allowed."},
+	{"TOO_MANY_NAMESPACES", http.StatusBadRequest, database.ErrTooManyNamespaces, "The namespace limit is reached."},
+	{"NAMESPACE_QUOTA", http.StatusForbidden, database.ErrNamespaceQuota, "The client already created as many namespaces as the namespaces-per-client setting allows."},
+	{"NAMESPACE_NOT_FOUND", http.StatusNotFound, database.ErrNamespaceNotFound, "The namespace of a watch or keyspace event stream does not exist yet."},
+	{"COMPACTED", http.StatusGone, database.ErrCompacted, "The watched revision is no longer retained."},
+	{"OUT_OF_MEMORY", http.StatusInsufficientStorage, database.ErrOutOfMemory, "The memory limit is reached and nothing can be evicted."},
+	{"UNKNOWN_SETTING", http.StatusBadRequest, config.ErrUnknownSetting, "CONFIG names a setting that does not exist."},
+	{"READ_ONLY_SETTING", http.StatusBadRequest, config.ErrReadOnlySetting, "CONFIG SET names a setting that can only be given on startup."},
+	{"INVALID_VALUE", http.StatusBadRequest, config.ErrInvalidValue, "CONFIG SET gives a value the setting does not accept."},
+	{"UNAUTHENTICATED", http.StatusUnauthorized, acl.ErrUnauthenticated, "The bearer token is unknown or belongs to a disabled user, or none was given and anonymous requests are not allowed."},
+	{"NO_PERMISSION", http.StatusForbidden, acl.ErrNoPermission, "The user may not run the command or access one of its keys."},
+	{"INVALID_RULE", http.StatusBadRequest, acl.ErrInvalidRule, "ACL SETUSER or the ACL file gives a malformed rule or a token of another user."},
+	{"RATE_LIMITED", http.StatusTooManyRequests, ratelimit.ErrRateLimited, "The client sent more commands of the class than its rate limit allows; retry after the Retry-After header."},
+	{"TOO_MANY_WAITERS", http.StatusTooManyRequests, ratelimit.ErrTooManyWaiters, "The client already has as many blocking commands waiting as the ratelimit-waiters setting allows."},
+	{"SHUTTING_DOWN", http.StatusServiceUnavailable, database.ErrClosed, "The server is shutting down and no longer waits for blocking commands."},
+	{"INTERNAL", http.StatusInternalServerError, nil, "Any other error."},
+}
+
+// return every error code
+func ErrorCodes() []ErrorCode {
+	return append([]ErrorCode(nil), errorCodes...)
+}
+
+// return the code of the error, matched with errors.Is
+func LookupErrorCode(err error) ErrorCode {
+	for _, code := range errorCodes {
+		if code.Err != nil && errors.Is(err, code.Err) {
+			return code
+		}
+	}
+	return errorCodes[len(errorCodes)-1]
+}
+
+// render the error codes as the Markdown table of the README
+func ErrorCodeTable() string {
+	var b strings.Builder
+	b.WriteString("| Code | HTTP status | Description |\n")
+	b.WriteString("| --- | --- | --- |\n")
+	for _, code := range errorCodes {
+		fmt.Fprintf(&b, "| `%s` | %d %s | %s |\n", code.Code, code.Status, http.StatusText(code.Status), code.Description)
+	}
+	return b.String()
+}
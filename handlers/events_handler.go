@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+)
+
+// represent a keyspace event in the event stream
+type ResponseEvent struct {
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	Class string `json:"class"`
+	// seconds left to live, omitted if the key does not expire or is gone
+	TTL      float64 `json:"ttl,omitempty"`
+	Revision uint64  `json:"revision"`
+	// the new value, only sent to watchers
+	Value string `json:"value,omitempty"`
+}
+
+// convert a database event into its JSON representation
+func newResponseEvent(event database.Event) ResponseEvent {
+	return ResponseEvent{
+		Key:      event.Key,
+		Op:       event.Op,
+		Class:    string(event.Class),
+		TTL:      event.TTL.Seconds(),
+		Revision: event.Revision,
+	}
+}
+
+// handle GET /keyspace/events?pattern=<glob>&class=<class> by streaming the
+// changes of matching keys as server-sent events. The class parameter may be
+// repeated and is one of string, queue, generic, expired and evicted; without
+// it every class is streamed.
+func (h *HTTPHandler) KeyspaceEvents(w http.ResponseWriter, r *http.Request) {
+	db := h.existingDatabase(w, r)
+	if db == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	var classes []database.EventClass
+	for _, class := range query["class"] {
+		switch c := database.EventClass(class); c {
+		case database.ClassString, database.ClassQueue, database.ClassGeneric, database.ClassExpired, database.ClassEvicted:
+			classes = append(classes, c)
+		default:
+			writeError(w, commandparser.InvalidArgument("invalid event class "+class))
+			return
+		}
+	}
+
+	sub := db.SubscribeEvents(query.Get("pattern"), classes)
+	defer db.UnsubscribeEvents(sub)
+
+	send, err := startEventStream(w)
+	if err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-sub.Events():
+			if err := send("keyspace", newResponseEvent(event)); err != nil {
+				return
+			}
+		case <-sub.Done():
+			if sub.Slow() {
+				send("disconnect", ResponseError{Error: "subscriber too slow"})
+			}
+			return
+		case <-keepAlive.C:
+			if err := send("", nil); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
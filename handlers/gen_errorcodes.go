@@ -0,0 +1,35 @@
+//go:build ignore
+
+// regenerate the table of error codes in the README, run by go generate
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+const (
+	readme = "../README.md"
+	begin  = "<!-- BEGIN ERROR CODES -->\n"
+	end    = "<!-- END ERROR CODES -->\n"
+)
+
+func main() {
+	content, err := os.ReadFile(readme)
+	if err != nil {
+		log.Fatal(err)
+	}
+	text := string(content)
+	start, stop := strings.Index(text, begin), strings.Index(text, end)
+	if start < 0 || stop < start {
+		log.Fatalf("%s has no error code markers", readme)
+	}
+
+	text = text[:start+len(begin)] + handlers.ErrorCodeTable() + text[stop:]
+	if err := os.WriteFile(readme, []byte(text), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
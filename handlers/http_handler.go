@@ -5,54 +5,212 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/7dpk/keyvaluestore/acl"
 	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/config"
 	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/pubsub"
+	"github.com/7dpk/keyvaluestore/ratelimit"
 )
 
 // handle the HTTP requests and interact with the Database
 type HTTPHandler struct {
 	Database *database.Database
+	// broker for PUBLISH and subscriptions, a default one is created if nil
+	PubSub     *pubsub.Broker
+	pubsubOnce sync.Once
+	// isolated keyspaces, a registry holding Database as the default
+	// namespace is created if nil
+	Namespaces     *database.Namespaces
+	namespacesOnce sync.Once
+	// answer commands in the shape used before typed replies unless a
+	// request asks otherwise with the X-Response-Format header
+	LegacyResponses bool
+	// settings read and changed by CONFIG, a default one is created if nil.
+	// Changes are applied to every namespace.
+	Config     *config.Config
+	configOnce sync.Once
+	// the users requests are authenticated and authorized as, an ACL with
+	// only a default user allowed everything is created if nil
+	ACL     *acl.ACL
+	aclOnce sync.Once
+	// the log of denied requests and ACL changes, one writing to the server
+	// log is created if nil
+	Audit     *acl.AuditLog
+	auditOnce sync.Once
+	// the per-client limits of the ratelimit-* settings
+	rateLimiter *ratelimit.Limiter
+	limiterOnce sync.Once
+
+	commandTable *commandTable
+	commandsOnce sync.Once
+
+	sessionsLock sync.Mutex
+	sessions     map[string]*session
 }
 
-// represent the request body JSON structure
+// the operations commands run against, implemented by the database itself
+// and by transactions
+type Store interface {
+	Set(key, value string, expiry time.Duration, condition string) error
+	Get(key string) (string, error)
+	GetItem(key string) (database.KeyValuePair, error)
+	CompareAndSet(key string, item database.KeyValuePair, revision uint64) (uint64, error)
+	Append(key, value string) (int, error)
+	Strlen(key string) (int, error)
+	GetRange(key string, start, end int) (string, error)
+	SetRange(key string, offset int, value string) (int, error)
+	GetDel(key string) (string, error)
+	GetEx(key string, expiration time.Time) (string, error)
+	MGet(keys []string) []*string
+	MSet(entries []database.Entry) error
+	MSetNX(entries []database.Entry) (bool, error)
+	Delete(key string) error
+	Flush()
+	Stats() database.Stats
+	Keys(pattern string) []string
+	Scan(cursor uint64, pattern string, count int, typ string) (uint64, []string)
+	Range(start, end string, limit int, reverse bool) []database.Entry
+	CountPrefix(prefix string) int
+	DeletePrefix(prefix string, limit int) int
+	QPush(key string, values []string) error
+	QPop(key string) (string, error)
+	BQPop(key string, timeout time.Duration) (string, error)
+}
+
+// represent the request body JSON structure. When Args is present the
+// command holds only the command name and the arguments are used verbatim.
 type RequestBody struct {
-	Command string `json:"command"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
 }
 
 // represent the error response JSON structure
 type ResponseError struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
 // represent the value response JSON structure
 type ResponseValue struct {
+	Value    string `json:"value"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// represent the response JSON structure of MGET, with null for missing keys
+type ResponseValues struct {
+	Values []*string `json:"values"`
+}
+
+// represent the response JSON structure of commands returning a string length
+type ResponseLength struct {
+	Length int `json:"length"`
+}
+
+// represent the revision response JSON structure of a successful CAS
+type ResponseRevision struct {
+	Revision uint64 `json:"revision"`
+}
+
+// represent the response JSON structure of KEYS
+type ResponseKeys struct {
+	Keys []string `json:"keys"`
+}
+
+// represent the response JSON structure of a SCAN step. The cursor is "0"
+// once the scan is complete.
+type ResponseScan struct {
+	Cursor string   `json:"cursor"`
+	Keys   []string `json:"keys"`
+}
+
+// represent a key and its value in a RANGE response
+type ResponseEntry struct {
+	Key   string `json:"key"`
 	Value string `json:"value"`
 }
 
+// represent the response JSON structure of RANGE
+type ResponseEntries struct {
+	Entries []ResponseEntry `json:"entries"`
+}
+
+// represent the response JSON structure of commands counting keys
+type ResponseCount struct {
+	Count int `json:"count"`
+}
+
 type ResponseBlank struct{}
 
-// write the error response JSON to the response writer
-func writeErrorJSON(w http.ResponseWriter, errMsg string, statusCode int) {
-	response := ResponseError{
-		Error: errMsg,
+// write the error response JSON with the code and status of the error, and
+// the Retry-After header of a rate limit
+func writeError(w http.ResponseWriter, err error) {
+	if wait := retryAfter(err); wait > 0 {
+		setRetryAfter(w, wait)
+	}
+	code := LookupErrorCode(err)
+	writeJSONResponse(w, ResponseError{Error: err.Error(), Code: code.Code}, code.Status)
+}
+
+// the outcome of a command: its typed reply, the response object of the
+// legacy format, the HTTP status code and, for a rate limit, how long the
+// client should wait
+type result struct {
+	reply      Reply
+	legacy     interface{}
+	statusCode int
+	retryAfter time.Duration
+}
+
+// return the object to encode for the result in the typed or legacy format
+func (res result) response(legacy bool) interface{} {
+	if legacy {
+		return res.legacy
 	}
-	writeJSONResponse(w, response, statusCode)
+	return res.reply
+}
+
+// build a successful result from its typed and legacy forms
+func okResult(reply Reply, legacy interface{}) result {
+	return result{reply: reply, legacy: legacy, statusCode: http.StatusOK}
 }
 
-// write the value response JSON to the response writer
-func writeValueJSON(w http.ResponseWriter, value string) {
-	response := ResponseValue{
-		Value: value,
+// build an error result with the code and status of the error
+func errorResult(err error) result {
+	code := LookupErrorCode(err)
+	return result{
+		reply:      ErrorReply(code.Code, err.Error()),
+		legacy:     ResponseError{Error: err.Error(), Code: code.Code},
+		statusCode: code.Status,
+		retryAfter: retryAfter(err),
 	}
-	writeJSONResponse(w, response, http.StatusOK)
 }
 
-// write the blank response JSON to the response writer
-func writeBlankJSON(w http.ResponseWriter) {
-	response := ResponseBlank{}
-	writeJSONResponse(w, response, http.StatusOK)
+// build a value result
+func valueResult(value string) result {
+	return okResult(StringReply(value), ResponseValue{Value: value})
+}
+
+// build a blank result
+func blankResult() result {
+	return okResult(okReply(), ResponseBlank{})
+}
+
+// build a count result
+func countResult(count int) result {
+	return okResult(IntegerReply(int64(count)), ResponseCount{Count: count})
+}
+
+// build the result of a command returning a string length
+func lengthResult(length int, err error) result {
+	if err != nil {
+		return errorResult(err)
+	}
+	return okResult(IntegerReply(int64(length)), ResponseLength{Length: length})
 }
 
 // write the given response object as JSON to the response writer
@@ -70,89 +228,158 @@ func (h *HTTPHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	var requestBody RequestBody
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		writeErrorJSON(w, "invalid request body", http.StatusBadRequest)
+		writeError(w, ErrInvalidRequest)
 		return
 	}
 
-	command := requestBody.Command
-	cmd, params, err := commandparser.ParseCommand(command)
-	if err != nil {
-		writeErrorJSON(w, err.Error(), http.StatusBadRequest)
-		return
+	sess, res := h.lookupSession(r)
+	if sess != nil {
+		res = h.run(sess, r, requestBody)
+	}
+	if res.retryAfter > 0 {
+		setRetryAfter(w, res.retryAfter)
 	}
+	writeJSONResponse(w, res.response(h.legacyResponses(r)), res.statusCode)
+}
 
-	switch cmd {
-	case "SET":
-		key := params[0]
-		value := params[1]
-		expiry := time.Duration(0)
-		condition := ""
-
-		if len(params) > 2 {
-			for i := 2; i < len(params); i++ {
-				param := params[i]
-				if param == "EX" && i+1 < len(params) {
-					expiryStr := params[i+1]
-					expirySeconds, err := strconv.Atoi(expiryStr)
-					if err != nil {
-						writeErrorJSON(w, "invalid expiry time", http.StatusBadRequest)
-						return
-					}
-					expiry = time.Duration(expirySeconds) * time.Second
-					i++
-				} else if param == "NX" || param == "XX" {
-					condition = param
-				} else {
-					writeErrorJSON(w, "invalid command", http.StatusBadRequest)
-					return
-				}
-			}
-		}
+// parse, authorize, rate limit and execute a single command on behalf of the
+// session, in the namespace selected by the session or otherwise by the request
+func (h *HTTPHandler) run(sess *session, r *http.Request, requestBody RequestBody) result {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
 
-		err := h.Database.Set(key, value, expiry, condition)
-		if err != nil {
-			writeErrorJSON(w, err.Error(), http.StatusBadRequest)
-			return
+	cmd, params, err := h.parse(requestBody)
+	if err == nil {
+		err = h.authorize(r, cmd, params)
+	}
+	if err == nil {
+		err = h.limit(r, cmd)
+	}
+	namespace := requestNamespace(r)
+	if sess.namespace != "" {
+		namespace = sess.namespace
+	}
+	if err == nil && sess.inMulti && !isTransactionCommand(cmd) && !h.queueable(cmd) {
+		err = stateError(cmd + " inside MULTI is not allowed")
+	}
+	if err == nil && sess.txNamespace != "" && namespace != sess.txNamespace && cmd != "DISCARD" && cmd != "UNWATCH" && h.queueable(cmd) {
+		// the watched revisions and the queued commands belong to another namespace
+		err = stateError(cmd + " outside the namespace of the transaction is not allowed")
+	}
+	if err != nil {
+		if sess.inMulti {
+			// a command that cannot be queued dooms the whole transaction
+			sess.dirty = true
 		}
+		return errorResult(err)
+	}
+
+	if cmd == "SELECT" || cmd == "SWAPDB" {
+		return h.selectNamespace(sess, r, cmd, params)
+	}
+	if cmd == "ACL" || cmd == "WHOAMI" {
+		return h.access(r, cmd, params)
+	}
+	db, res := h.namespaceDatabase(r, namespace, h.createsNamespace(sess, cmd))
+	if db == nil {
+		return res
+	}
 
-		writeBlankJSON(w)
-	case "GET":
-		key := params[0]
-		value, err := h.Database.Get(key)
+	switch {
+	case isTransactionCommand(cmd):
+		return h.transaction(sess, db, namespace, cmd, params)
+	case sess.inMulti:
+		sess.queued = append(sess.queued, queuedCommand{cmd, params})
+		return valueResult("QUEUED")
+	}
+
+	if h.lookupSpec(cmd).HasFlag(commandparser.FlagBlocking) {
+		release, err := h.waitSlot(r)
 		if err != nil {
-			writeErrorJSON(w, err.Error(), http.StatusNotFound)
-			return
+			return errorResult(err)
 		}
-		writeValueJSON(w, value)
-	case "QPUSH":
-		key := params[0]
-		values := params[1:]
-		h.Database.QPush(key, values)
-		writeBlankJSON(w)
-	case "QPOP":
-		key := params[0]
-		value, err := h.Database.QPop(key)
-		if err != nil {
-			writeErrorJSON(w, err.Error(), http.StatusNotFound)
-			return
+		defer release()
+	}
+	return h.execute(db, cmd, params)
+}
+
+// parse the MATCH, COUNT and TYPE options of SCAN
+func parseScanOptions(params []string) (pattern string, count int, typ string, err error) {
+	for i := 0; i < len(params); i += 2 {
+		if i+1 == len(params) {
+			return "", 0, "", commandparser.ErrInvalidCommand
 		}
-		writeValueJSON(w, value)
-	case "BQPOP":
-		key := params[0]
-		timeoutStr := params[1]
-		timeoutSeconds, err := strconv.ParseFloat(timeoutStr, 64)
-		if err != nil {
-			writeErrorJSON(w, "invalid timeout", http.StatusBadRequest)
-			return
+		value := params[i+1]
+		switch strings.ToUpper(params[i]) {
+		case "MATCH":
+			pattern = value
+		case "COUNT":
+			count, err = strconv.Atoi(value)
+			if err != nil || count <= 0 {
+				return "", 0, "", commandparser.InvalidArgument("invalid count")
+			}
+		case "TYPE":
+			typ = strings.ToLower(value)
+			if typ != database.TypeString && typ != database.TypeQueue {
+				return "", 0, "", commandparser.InvalidArgument("invalid type")
+			}
+		default:
+			return "", 0, "", commandparser.ErrInvalidCommand
 		}
-		timeout := time.Duration(timeoutSeconds) * time.Second
-		value, err := h.Database.BQPop(key, timeout)
-		if err != nil {
-			writeErrorJSON(w, err.Error(), http.StatusNotFound)
-			return
+	}
+	return pattern, count, typ, nil
+}
+
+// parse the LIMIT option, and the REV option if allowed, of the ordered
+// index commands
+func parseRangeOptions(params []string, allowReverse bool) (limit int, reverse bool, err error) {
+	for i := 0; i < len(params); i++ {
+		switch strings.ToUpper(params[i]) {
+		case "LIMIT":
+			if i+1 == len(params) {
+				return 0, false, commandparser.ErrInvalidCommand
+			}
+			limit, err = strconv.Atoi(params[i+1])
+			if err != nil || limit <= 0 {
+				return 0, false, commandparser.InvalidArgument("invalid limit")
+			}
+			i++
+		case "REV":
+			if !allowReverse {
+				return 0, false, commandparser.ErrInvalidCommand
+			}
+			reverse = true
+		default:
+			return 0, false, commandparser.ErrInvalidCommand
 		}
-		writeValueJSON(w, value)
-	default:
-		writeErrorJSON(w, "invalid command", http.StatusBadRequest)
 	}
+	return limit, reverse, nil
+}
+
+// parse the expiration option of GETEX: EX seconds, PX milliseconds, EXAT
+// unix seconds, PXAT unix milliseconds or PERSIST, which yields the zero time
+func parseExpiration(params []string) (time.Time, error) {
+	option := strings.ToUpper(params[0])
+	if option == "PERSIST" && len(params) == 1 {
+		return time.Time{}, nil
+	}
+	if len(params) != 2 {
+		return time.Time{}, commandparser.ErrInvalidCommand
+	}
+	n, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, commandparser.InvalidArgument("invalid expire time")
+	}
+
+	switch option {
+	case "EX":
+		return time.Now().Add(time.Duration(n) * time.Second), nil
+	case "PX":
+		return time.Now().Add(time.Duration(n) * time.Millisecond), nil
+	case "EXAT":
+		return time.Unix(n, 0), nil
+	case "PXAT":
+		return time.UnixMilli(n), nil
+	}
+	return time.Time{}, commandparser.ErrInvalidCommand
 }
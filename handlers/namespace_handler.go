@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/gorilla/mux"
+)
+
+// header selecting the namespace of a request
+const namespaceHeader = "X-Namespace"
+
+// represent the statistics of a namespace
+type ResponseStats struct {
+	Keys        int    `json:"keys"`
+	Volatile    int    `json:"volatile"`
+	MemoryUsage int64  `json:"memory_usage"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Expired     uint64 `json:"expired"`
+	Evicted     uint64 `json:"evicted"`
+	Revision    uint64 `json:"revision"`
+}
+
+func newResponseStats(stats database.Stats) ResponseStats {
+	return ResponseStats(stats)
+}
+
+// return the statistics as a typed map with the keys of ResponseStats
+func statsReply(stats database.Stats) Reply {
+	return MapReply(map[string]Reply{
+		"keys":         IntegerReply(int64(stats.Keys)),
+		"volatile":     IntegerReply(int64(stats.Volatile)),
+		"memory_usage": IntegerReply(stats.MemoryUsage),
+		"hits":         IntegerReply(int64(stats.Hits)),
+		"misses":       IntegerReply(int64(stats.Misses)),
+		"expired":      IntegerReply(int64(stats.Expired)),
+		"evicted":      IntegerReply(int64(stats.Evicted)),
+		"revision":     IntegerReply(int64(stats.Revision)),
+	})
+}
+
+// return the namespaces, creating a registry around Database if none was set
+func (h *HTTPHandler) namespaces() *database.Namespaces {
+	h.namespacesOnce.Do(func() {
+		if h.Namespaces == nil {
+			h.Namespaces = database.NewNamespaces(h.Database)
+		}
+		h.Namespaces.SetClientLimit(h.config().Snapshot().NamespacesPerClient)
+	})
+	return h.Namespaces
+}
+
+// return the name of the namespace selected by the /ns/{namespace} path
+// prefix or the X-Namespace header, the default namespace if neither is given
+func requestNamespace(r *http.Request) string {
+	if name, ok := mux.Vars(r)["namespace"]; ok {
+		return name
+	}
+	if name := r.Header.Get(namespaceHeader); name != "" {
+		return name
+	}
+	return database.DefaultNamespace
+}
+
+// return the database of the namespace, or nil and the error result to send.
+// A namespace that does not exist is created on behalf of the client of the
+// request if create is set, and read as an empty one otherwise.
+func (h *HTTPHandler) namespaceDatabase(r *http.Request, name string, create bool) (*database.Database, result) {
+	db, err := h.lookupNamespace(r, name, create)
+	if err != nil {
+		return nil, errorResult(err)
+	}
+	return db, result{}
+}
+
+// return the database of the namespace the request selects, see
+// namespaceDatabase. If there is none the error is written and nil is returned.
+func (h *HTTPHandler) requestDatabase(w http.ResponseWriter, r *http.Request, create bool) *database.Database {
+	db, err := h.lookupNamespace(r, requestNamespace(r), create)
+	if err != nil {
+		writeError(w, err)
+	}
+	return db
+}
+
+// return the database of the namespace the request selects if it exists, for
+// the handlers that only wait for its changes and must not create it. If it
+// does not exist the error is written and nil is returned.
+func (h *HTTPHandler) existingDatabase(w http.ResponseWriter, r *http.Request) *database.Database {
+	db, err := h.namespaces().Existing(requestNamespace(r))
+	if err != nil {
+		writeError(w, err)
+	}
+	return db
+}
+
+// return the database of the namespace, creating it on behalf of the client
+// of the request if create is set
+func (h *HTTPHandler) lookupNamespace(r *http.Request, name string, create bool) (*database.Database, error) {
+	if create {
+		return h.namespaces().Create(name, clientKey(r))
+	}
+	return h.namespaces().Lookup(name)
+}
+
+// report whether the command needs its namespace to exist: a write does, as
+// does EXEC of a transaction queuing one. Commands are only queued inside
+// MULTI, so they need nothing yet.
+func (h *HTTPHandler) createsNamespace(sess *session, cmd string) bool {
+	if cmd == "EXEC" {
+		for _, queued := range sess.queued {
+			if h.lookupSpec(queued.cmd).HasFlag(commandparser.FlagWrite) {
+				return true
+			}
+		}
+		return false
+	}
+	return !sess.inMulti && h.lookupSpec(cmd).HasFlag(commandparser.FlagWrite)
+}
+
+// execute SELECT and SWAPDB, which act on the namespaces instead of a database.
+// SELECT does not create the namespace, the first write in it does.
+func (h *HTTPHandler) selectNamespace(sess *session, r *http.Request, cmd string, params []string) result {
+	switch cmd {
+	case "SELECT":
+		if sess.watched != nil {
+			return errorResult(stateError("SELECT with watched keys is not allowed"))
+		}
+		if !database.ValidNamespace(params[0]) {
+			return errorResult(database.ErrInvalidNamespace)
+		}
+		sess.namespace = params[0]
+		return blankResult()
+	default: // SWAPDB
+		for _, name := range params {
+			if db, res := h.namespaceDatabase(r, name, true); db == nil {
+				return res
+			}
+		}
+		if err := h.namespaces().Swap(params[0], params[1]); err != nil {
+			return errorResult(err)
+		}
+		return blankResult()
+	}
+}
+
+// handle GET /namespaces by returning the statistics of every namespace
+func (h *HTTPHandler) ListNamespaces(w http.ResponseWriter, r *http.Request) {
+	namespaces := h.namespaces()
+	response := make(map[string]ResponseStats)
+	for _, name := range namespaces.Names() {
+		db, err := namespaces.Get(name)
+		if err != nil {
+			continue
+		}
+		response[name] = newResponseStats(db.Stats())
+	}
+	writeJSONResponse(w, response, http.StatusOK)
+}
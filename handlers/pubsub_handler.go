@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/pubsub"
+)
+
+// interval between comments that keep idle event streams open through proxies
+const keepAliveInterval = 15 * time.Second
+
+// represent the PUBLISH response JSON structure
+type ResponseSubscribers struct {
+	Subscribers int `json:"subscribers"`
+}
+
+// return the broker for PUBLISH and subscriptions, creating a default one if none was configured
+func (h *HTTPHandler) broker() *pubsub.Broker {
+	h.pubsubOnce.Do(func() {
+		if h.PubSub == nil {
+			h.PubSub = pubsub.NewBroker(pubsub.DefaultBufferSize)
+		}
+	})
+	return h.PubSub
+}
+
+// prepare w for a stream of server-sent events and return a function that
+// writes one event and flushes it
+func startEventStream(w http.ResponseWriter) (func(event string, data interface{}) error, error) {
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return nil, err
+	}
+
+	return func(event string, data interface{}) error {
+		if event == "" {
+			// an empty event is sent as a comment to keep the connection alive
+			fmt.Fprint(w, ": keep-alive\n\n")
+		} else {
+			payload, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		}
+		return controller.Flush()
+	}, nil
+}
+
+// handle GET /subscribe?channel=<name>&pattern=<glob> by streaming every
+// message published on the channels as server-sent events. Both parameters
+// may be repeated. A subscriber that falls behind is sent a disconnect event
+// and the stream ends.
+func (h *HTTPHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	channels, patterns := query["channel"], query["pattern"]
+	if len(channels) == 0 && len(patterns) == 0 {
+		writeError(w, commandparser.InvalidArgument("no channel or pattern given"))
+		return
+	}
+
+	broker := h.broker()
+	sub := broker.Subscribe(channels, patterns)
+	defer broker.Unsubscribe(sub)
+
+	send, err := startEventStream(w)
+	if err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case message := <-sub.Messages():
+			if err := send("message", message); err != nil {
+				return
+			}
+		case <-sub.Done():
+			if sub.Slow() {
+				send("disconnect", ResponseError{Error: "subscriber too slow"})
+			}
+			return
+		case <-keepAlive.C:
+			if err := send("", nil); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/ratelimit"
+)
+
+// return the rate limiter, creating one with the limits of the settings
+func (h *HTTPHandler) limiter() *ratelimit.Limiter {
+	h.limiterOnce.Do(func() {
+		settings := h.config().Snapshot()
+		h.rateLimiter = ratelimit.New()
+		applyLimits(h.rateLimiter, &settings)
+	})
+	return h.rateLimiter
+}
+
+// set the limits of the limiter to those of the settings
+func applyLimits(limiter *ratelimit.Limiter, settings *config.Config) {
+	limiter.SetLimit(ratelimit.Read, settings.RateLimitRead)
+	limiter.SetLimit(ratelimit.Write, settings.RateLimitWrite)
+	limiter.SetLimit(ratelimit.Blocking, settings.RateLimitBlocking)
+	limiter.SetMaxWaiters(settings.RateLimitWaiters)
+}
+
+// return the key a request is rate limited by: the hash of its bearer token,
+// or the IP address of the client if it has none
+func clientKey(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return "token:" + acl.HashToken(token)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// return the budget the command is charged to: blocking, write, or read for
+// every other command
+func limitClass(spec commandparser.Spec) ratelimit.Class {
+	switch {
+	case spec.HasFlag(commandparser.FlagBlocking):
+		return ratelimit.Blocking
+	case spec.HasFlag(commandparser.FlagWrite):
+		return ratelimit.Write
+	}
+	return ratelimit.Read
+}
+
+// charge the command to the budget of the client of the request
+func (h *HTTPHandler) limit(r *http.Request, cmd string) error {
+	return h.limiter().Allow(clientKey(r), limitClass(h.lookupSpec(cmd)))
+}
+
+// take a slot for a blocking command of the client of the request and return
+// the function giving it back
+func (h *HTTPHandler) waitSlot(r *http.Request) (func(), error) {
+	return h.limiter().Wait(clientKey(r))
+}
+
+// return how long a refused client should wait, zero if the error is not a
+// rate limit
+func retryAfter(err error) time.Duration {
+	var limited *ratelimit.Error
+	if errors.As(err, &limited) {
+		return limited.RetryAfter
+	}
+	return 0
+}
+
+// set the Retry-After header to the wait in whole seconds, at least one
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := max(1, int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
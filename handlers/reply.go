@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the types of a typed reply
+const (
+	ReplyString  = "string"
+	ReplyInteger = "integer"
+	ReplyFloat   = "float"
+	ReplyArray   = "array"
+	ReplyMap     = "map"
+	ReplyNull    = "null"
+	ReplyError   = "error"
+)
+
+// header choosing the response format of a request, "typed" or "legacy"
+const responseFormatHeader = "X-Response-Format"
+
+// a typed command reply. Value holds a string, an int64, a float64, a []Reply
+// or a map[string]Reply depending on Type, and is nil for null and error
+// replies; an error reply carries its message in Error and its code in Code.
+//
+//	{"type": "string", "value": "hello"}
+//	{"type": "array", "value": [{"type": "string", "value": "a"}, {"type": "null"}]}
+//	{"type": "error", "error": "key not found", "code": "NOT_FOUND"}
+type Reply struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value,omitempty"`
+	Error string      `json:"error,omitempty"`
+	Code  string      `json:"code,omitempty"`
+}
+
+// build a string reply
+func StringReply(value string) Reply {
+	return Reply{Type: ReplyString, Value: value}
+}
+
+// build an integer reply
+func IntegerReply(value int64) Reply {
+	return Reply{Type: ReplyInteger, Value: value}
+}
+
+// build a float reply
+func FloatReply(value float64) Reply {
+	return Reply{Type: ReplyFloat, Value: value}
+}
+
+// build an array reply holding the items in order
+func ArrayReply(items ...Reply) Reply {
+	if items == nil {
+		items = []Reply{}
+	}
+	return Reply{Type: ReplyArray, Value: items}
+}
+
+// build a map reply
+func MapReply(fields map[string]Reply) Reply {
+	return Reply{Type: ReplyMap, Value: fields}
+}
+
+// build a null reply, for a missing or absent value
+func NullReply() Reply {
+	return Reply{Type: ReplyNull}
+}
+
+// build an error reply with its code
+func ErrorReply(code, msg string) Reply {
+	return Reply{Type: ReplyError, Error: msg, Code: code}
+}
+
+// the reply of commands that succeed without returning anything
+func okReply() Reply {
+	return StringReply("OK")
+}
+
+// an array of strings
+func stringsReply(values []string) Reply {
+	items := make([]Reply, len(values))
+	for i, value := range values {
+		items[i] = StringReply(value)
+	}
+	return ArrayReply(items...)
+}
+
+// decode a reply, turning its value into the Go type matching its type
+func (r *Reply) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+		Error string          `json:"error"`
+		Code  string          `json:"code"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*r = Reply{Type: raw.Type, Error: raw.Error, Code: raw.Code}
+
+	var err error
+	switch raw.Type {
+	case ReplyString:
+		var value string
+		err = json.Unmarshal(raw.Value, &value)
+		r.Value = value
+	case ReplyInteger:
+		var value int64
+		err = json.Unmarshal(raw.Value, &value)
+		r.Value = value
+	case ReplyFloat:
+		var value float64
+		err = json.Unmarshal(raw.Value, &value)
+		r.Value = value
+	case ReplyArray:
+		var value []Reply
+		err = json.Unmarshal(raw.Value, &value)
+		r.Value = value
+	case ReplyMap:
+		var value map[string]Reply
+		err = json.Unmarshal(raw.Value, &value)
+		r.Value = value
+	case ReplyNull, ReplyError:
+	default:
+		err = fmt.Errorf("unknown reply type %q", raw.Type)
+	}
+	return err
+}
+
+// report whether the request asks for responses in the shape used before
+// typed replies, either through the X-Response-Format header or, without
+// it, because the handler is configured for legacy responses
+func (h *HTTPHandler) legacyResponses(r *http.Request) bool {
+	switch strings.ToLower(r.Header.Get(responseFormatHeader)) {
+	case "legacy":
+		return true
+	case "typed":
+		return false
+	}
+	return h.LegacyResponses
+}
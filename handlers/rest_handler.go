@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/gorilla/mux"
+)
+
+// write a raw value as the response body so that binary values survive untouched
+func writeRawValue(w http.ResponseWriter, value string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, value)
+}
+
+// parse a duration given in (possibly fractional) seconds from the query string
+func parseSeconds(r *http.Request, name string) (time.Duration, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(raw, 64)
+	if err != nil || seconds < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// format a revision as a strong entity tag
+func formatETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// report whether an If-Match or If-None-Match header lists the revision
+func etagMatches(header string, revision uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == formatETag(revision) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle GET /keys?cursor=<cursor>&match=<glob>&count=<n>&type=<type> as one
+// step of a SCAN
+func (h *HTTPHandler) ScanKeys(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, false)
+	if db == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	cursor := uint64(0)
+	if raw := query.Get("cursor"); raw != "" {
+		var err error
+		cursor, err = strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			writeError(w, commandparser.InvalidArgument("invalid cursor"))
+			return
+		}
+	}
+
+	var options []string
+	for _, name := range []string{"match", "count", "type"} {
+		if query.Has(name) {
+			options = append(options, name, query.Get(name))
+		}
+	}
+	pattern, count, typ, err := parseScanOptions(options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	next, keys := db.Scan(cursor, pattern, count, typ)
+	writeJSONResponse(w, ResponseScan{Cursor: strconv.FormatUint(next, 10), Keys: keys}, http.StatusOK)
+}
+
+// handle GET /keys/{key}, answering 304 when If-None-Match lists the current revision
+func (h *HTTPHandler) GetKey(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, false)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	item, err := db.GetItem(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(item.Revision))
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, item.Revision) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeRawValue(w, item.String())
+}
+
+// handle PUT /keys/{key}?ttl=<seconds>&nx|xx with the request body as the value.
+// If-Match and If-None-Match make the write conditional on the key's revision.
+func (h *HTTPHandler) PutKey(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, true)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	query := r.URL.Query()
+
+	expiry, err := parseSeconds(r, "ttl")
+	if err != nil {
+		writeError(w, commandparser.InvalidArgument("invalid expiry time"))
+		return
+	}
+	condition := ""
+	if query.Has("nx") {
+		condition = "NX"
+	}
+	if query.Has("xx") {
+		if condition != "" {
+			writeError(w, commandparser.InvalidArgument("nx and xx are mutually exclusive"))
+			return
+		}
+		condition = "XX"
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, ErrInvalidRequest)
+		return
+	}
+
+	expiration := time.Time{}
+	if expiry > 0 {
+		expiration = time.Now().Add(expiry)
+	}
+	item := database.KeyValuePair{
+		Value:      string(body),
+		Expiration: expiration,
+	}
+
+	var revision uint64
+	var created bool
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch != "" || ifNoneMatch != "" {
+		// check the headers against the current revision, then write only if
+		// that revision is still current
+		current := db.Revision(key)
+		if ifMatch != "" && (current == 0 || !etagMatches(ifMatch, current)) ||
+			ifNoneMatch != "" && current != 0 && etagMatches(ifNoneMatch, current) {
+			writeError(w, ErrPreconditionFailed)
+			return
+		}
+		revision, err = db.CompareAndSet(key, item, current)
+		created = current == 0
+		if errors.Is(err, database.ErrConditionFailed) || errors.Is(err, database.ErrNotFound) {
+			// the key changed after the headers were checked
+			err = ErrPreconditionFailed
+		}
+	} else {
+		revision, created, err = db.SetItem(key, item, condition)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(revision))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handle DELETE /keys/{key}, honouring If-Match
+func (h *HTTPHandler) DeleteKey(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, true)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+
+	var err error
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		current := db.Revision(key)
+		if current != 0 && !etagMatches(ifMatch, current) {
+			writeError(w, ErrPreconditionFailed)
+			return
+		}
+		err = db.CompareAndDelete(key, current)
+	} else {
+		err = db.Delete(key)
+	}
+
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, database.ErrConditionFailed):
+		writeError(w, ErrPreconditionFailed)
+	default:
+		writeError(w, err)
+	}
+}
+
+// handle POST /queues/{key}/push with the request body as the pushed value
+func (h *HTTPHandler) QueuePush(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, true)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, ErrInvalidRequest)
+		return
+	}
+	if err := db.QPush(key, []string{string(body)}); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handle POST /queues/{key}/pop
+func (h *HTTPHandler) QueuePop(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, true)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	value, err := db.QPop(key)
+	h.writePopResult(w, value, err)
+}
+
+// handle POST /queues/{key}/bpop?timeout=<seconds>
+func (h *HTTPHandler) QueueBPop(w http.ResponseWriter, r *http.Request) {
+	db := h.requestDatabase(w, r, true)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	timeout, err := parseSeconds(r, "timeout")
+	if err != nil {
+		writeError(w, commandparser.InvalidArgument("invalid timeout"))
+		return
+	}
+	value, err := db.BQPop(key, timeout)
+	h.writePopResult(w, value, err)
+}
+
+// write the outcome of a pop: the value, 204 when nothing was available or 404 for a missing queue
+func (h *HTTPHandler) writePopResult(w http.ResponseWriter, value string, err error) {
+	switch {
+	case err == nil:
+		writeRawValue(w, value)
+	case errors.Is(err, database.ErrQueueEmpty), errors.Is(err, database.ErrTimeout):
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, err)
+	}
+}
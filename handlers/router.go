@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// create a router with every route served by the handler. The routes working
+// on keys are also served below /ns/{namespace} for the given namespace.
+// Every request is authenticated, and every route is authorized as the
+// command it corresponds to.
+func NewRouter(handler *HTTPHandler) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(handler.logRequests, handler.authenticate)
+	router.HandleFunc("/subscribe", handler.guard("SUBSCRIBE", handler.Subscribe)).Methods("GET")
+
+	router.HandleFunc("/sessions", handler.CreateSession).Methods("POST")
+	router.HandleFunc("/sessions/{token}", handler.DeleteSession).Methods("DELETE")
+
+	router.HandleFunc("/namespaces", handler.guard("INFO", handler.ListNamespaces)).Methods("GET")
+	router.HandleFunc("/commands", handler.guard("COMMAND", handler.ListCommands)).Methods("GET")
+
+	addKeyspaceRoutes(router.PathPrefix("/ns/{namespace}").Subrouter(), handler)
+	addKeyspaceRoutes(router, handler)
+	return router
+}
+
+// register the routes that work on the keys of a namespace
+func addKeyspaceRoutes(router *mux.Router, handler *HTTPHandler) {
+	router.HandleFunc("/", handler.HandleRequest).Methods("POST")
+	router.HandleFunc("/batch", handler.HandleBatch).Methods("POST")
+
+	router.HandleFunc("/keyspace/events", handler.guard("EVENTS", handler.KeyspaceEvents)).Methods("GET")
+	// authorized by the handler, which depends on the query
+	router.HandleFunc("/watch", handler.Watch).Methods("GET")
+
+	router.HandleFunc("/keys", handler.guard("SCAN", handler.ScanKeys)).Methods("GET")
+	router.HandleFunc("/keys/{key}", handler.guard("GET", handler.GetKey)).Methods("GET")
+	router.HandleFunc("/keys/{key}", handler.guard("SET", handler.PutKey)).Methods("PUT")
+	router.HandleFunc("/keys/{key}", handler.guard("DEL", handler.DeleteKey)).Methods("DELETE")
+
+	router.HandleFunc("/queues/{key}/push", handler.guard("QPUSH", handler.QueuePush)).Methods("POST")
+	router.HandleFunc("/queues/{key}/pop", handler.guard("QPOP", handler.QueuePop)).Methods("POST")
+	router.HandleFunc("/queues/{key}/bpop", handler.guard("BQPOP", handler.QueueBPop)).Methods("POST")
+}
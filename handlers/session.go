@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// header carrying the token returned by POST /sessions
+	sessionHeader = "X-Session-Token"
+	// sessions unused for this long are discarded
+	sessionIdleTimeout = 10 * time.Minute
+)
+
+// a command queued between MULTI and EXEC
+type queuedCommand struct {
+	cmd    string
+	params []string
+}
+
+// the transaction state of a client. Requests carrying a session token share
+// one session; any other request gets a fresh session that lives only as long
+// as the request, so a batch can hold a whole MULTI ... EXEC block.
+type session struct {
+	lock     sync.Mutex
+	inMulti  bool
+	dirty    bool
+	queued   []queuedCommand
+	watched  map[string]uint64
+	lastUsed time.Time
+	// namespace chosen with SELECT, empty to use the one of each request
+	namespace string
+	// namespace of the transaction, set by the first WATCH or MULTI. The
+	// watched revisions and queued commands only make sense in it.
+	txNamespace string
+	// the user that created the session, the only one that may use it
+	owner string
+}
+
+// reset the transaction state after EXEC or DISCARD
+func (s *session) reset() {
+	s.inMulti = false
+	s.dirty = false
+	s.queued = nil
+	s.watched = nil
+	s.txNamespace = ""
+}
+
+// report whether the command manipulates the transaction state instead of the database
+func isTransactionCommand(cmd string) bool {
+	switch cmd {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		return true
+	}
+	return false
+}
+
+// report whether the command can be queued inside MULTI. Commands acting on
+// the session, the namespaces, the users or the settings do not run against
+// the database and cannot be part of EXEC.
+func (h *HTTPHandler) queueable(cmd string) bool {
+	switch cmd {
+	case "SELECT", "SWAPDB", "ACL", "WHOAMI":
+		return false
+	}
+	// admin commands take locks of their own and cannot run within EXEC
+	return !h.lookupSpec(cmd).HasFlag(commandparser.FlagAdmin)
+}
+
+// handle POST /sessions by creating a session and returning its token
+func (h *HTTPHandler) CreateSession(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		writeError(w, errors.New("could not create session"))
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	h.sessionsLock.Lock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*session)
+	}
+	now := time.Now()
+	for t, sess := range h.sessions {
+		if now.Sub(sess.lastUsed) > sessionIdleTimeout {
+			delete(h.sessions, t)
+		}
+	}
+	h.sessions[token] = &session{lastUsed: now, owner: h.requestUser(r).Name}
+	h.sessionsLock.Unlock()
+
+	writeJSONResponse(w, ResponseValue{Value: token}, http.StatusCreated)
+}
+
+// handle DELETE /sessions/{token}
+func (h *HTTPHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	h.sessionsLock.Lock()
+	_, exists := h.sessions[token]
+	delete(h.sessions, token)
+	h.sessionsLock.Unlock()
+
+	if !exists {
+		writeError(w, ErrUnknownSession)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// return the session named by the request header, or a fresh one if there is
+// none. An unknown token yields a nil session and the error result to send.
+func (h *HTTPHandler) lookupSession(r *http.Request) (*session, result) {
+	token := r.Header.Get(sessionHeader)
+	if token == "" {
+		return &session{}, result{}
+	}
+
+	h.sessionsLock.Lock()
+	defer h.sessionsLock.Unlock()
+
+	sess, exists := h.sessions[token]
+	if exists && sess.owner != h.requestUser(r).Name {
+		// a session of another user is as good as unknown
+		return nil, errorResult(ErrUnknownSession)
+	}
+	if !exists || time.Since(sess.lastUsed) > sessionIdleTimeout {
+		delete(h.sessions, token)
+		return nil, errorResult(ErrUnknownSession)
+	}
+	sess.lastUsed = time.Now()
+	return sess, result{}
+}
+
+// execute MULTI, EXEC, DISCARD, WATCH and UNWATCH against the session and
+// the database of the namespace
+func (h *HTTPHandler) transaction(sess *session, db *database.Database, namespace, cmd string, params []string) result {
+	switch cmd {
+	case "MULTI":
+		if sess.inMulti {
+			return errorResult(stateError("MULTI calls can not be nested"))
+		}
+		sess.inMulti = true
+		sess.txNamespace = namespace
+		return blankResult()
+	case "EXEC":
+		if !sess.inMulti {
+			return errorResult(stateError("EXEC without MULTI"))
+		}
+		defer sess.reset()
+		if sess.dirty {
+			return errorResult(ErrTxDiscarded)
+		}
+
+		replies := make([]Reply, len(sess.queued))
+		responses := make([]interface{}, len(sess.queued))
+		err := db.Atomic(sess.watched, func(tx *database.Tx) {
+			for i, queued := range sess.queued {
+				res := h.execute(tx, queued.cmd, queued.params)
+				replies[i], responses[i] = res.reply, res.legacy
+			}
+		})
+		if err != nil {
+			return errorResult(err)
+		}
+		return okResult(ArrayReply(replies...), responses)
+	case "DISCARD":
+		if !sess.inMulti {
+			return errorResult(stateError("DISCARD without MULTI"))
+		}
+		sess.reset()
+		return blankResult()
+	case "WATCH":
+		if sess.inMulti {
+			return errorResult(stateError("WATCH inside MULTI is not allowed"))
+		}
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+			sess.txNamespace = namespace
+		}
+		for _, key := range params {
+			if _, exists := sess.watched[key]; !exists {
+				sess.watched[key] = db.Revision(key)
+			}
+		}
+		return blankResult()
+	default: // UNWATCH
+		sess.watched = nil
+		if !sess.inMulti {
+			sess.txNamespace = ""
+		}
+		return blankResult()
+	}
+}
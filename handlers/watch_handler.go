@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+)
+
+const (
+	// how long a watch waits for changes when the request does not say
+	defaultWatchTimeout = 30 * time.Second
+	// the longest wait a watch may ask for
+	maxWatchTimeout = 5 * time.Minute
+)
+
+// represent the watch response JSON structure
+type ResponseWatch struct {
+	// the current revision; watch again from one past it to continue
+	Revision uint64          `json:"revision"`
+	Events   []ResponseEvent `json:"events"`
+}
+
+// represent the error response JSON structure of a watch from a compacted revision
+type ResponseCompacted struct {
+	Error           string `json:"error"`
+	Code            string `json:"code"`
+	CompactRevision uint64 `json:"compact_revision"`
+}
+
+// handle GET /watch?key=<key>&prefix=true&revision=<rev>&timeout=<seconds> by
+// returning every change of the key, or of all keys with the prefix, from the
+// revision onwards in order. If there is none yet, the request waits for the
+// next change or the timeout. Without a revision only future changes are
+// returned. A revision that is no longer retained answers 410 Gone.
+func (h *HTTPHandler) Watch(w http.ResponseWriter, r *http.Request) {
+	db := h.existingDatabase(w, r)
+	if db == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	key := query.Get("key")
+	prefix := query.Get("prefix") == "true"
+	if key == "" && !prefix {
+		writeError(w, commandparser.InvalidArgument("no key given"))
+		return
+	}
+	// a prefix watch sees the changes of keys the prefix does not name
+	cmd, params := "GET", []string{key}
+	if prefix {
+		cmd, params = "EVENTS", nil
+	}
+	err := h.authorize(r, cmd, params)
+	if err == nil {
+		err = h.limit(r, cmd)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fromRevision := db.CurrentRevision() + 1
+	if raw := query.Get("revision"); raw != "" {
+		revision, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			writeError(w, commandparser.InvalidArgument("invalid revision"))
+			return
+		}
+		fromRevision = revision
+	}
+
+	timeout, err := parseSeconds(r, "timeout")
+	if err != nil {
+		writeError(w, commandparser.InvalidArgument("invalid timeout"))
+		return
+	}
+	if timeout == 0 {
+		timeout = defaultWatchTimeout
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	events, revision, err := db.WaitChanges(ctx, key, prefix, fromRevision)
+	if err == database.ErrCompacted {
+		code := LookupErrorCode(err)
+		writeJSONResponse(w, ResponseCompacted{
+			Error:           err.Error(),
+			Code:            code.Code,
+			CompactRevision: db.CompactedRevision(),
+		}, code.Status)
+		return
+	}
+
+	response := ResponseWatch{
+		Revision: revision,
+		Events:   make([]ResponseEvent, len(events)),
+	}
+	for i, event := range events {
+		response.Events[i] = newResponseEvent(event)
+		response.Events[i].Value = event.Value
+	}
+	writeJSONResponse(w, response, http.StatusOK)
+}
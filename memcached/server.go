@@ -0,0 +1,339 @@
+package memcached
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+)
+
+const (
+	// longest key accepted by the protocol
+	maxKeyLength = 250
+	// largest value accepted by storage commands
+	maxValueLength = 1024 * 1024
+	// exptimes above this many seconds are absolute unix timestamps
+	maxRelativeExptime = 60 * 60 * 24 * 30
+	version            = "1.6.0-keyvaluestore"
+)
+
+// serve the memcached ASCII protocol on top of a Database
+type Server struct {
+	Database *database.Database
+}
+
+// listen on the TCP address and serve connections until the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// accept connections on the listener and serve each one in its own goroutine
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// errClientClosed is returned by a command that ends the connection
+var errClientClosed = errors.New("client closed connection")
+
+// read and execute commands from the connection until it is closed
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Println("memcached: error reading command:", err)
+			}
+			return
+		}
+
+		err = s.execute(strings.TrimRight(line, "\r\n"), reader, writer)
+		if err == errClientClosed {
+			writer.Flush()
+			return
+		}
+		if err != nil {
+			log.Println("memcached: error handling command:", err)
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// execute one command line, reading a data block from reader if the command carries one
+func (s *Server) execute(line string, reader *bufio.Reader, w *bufio.Writer) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		return s.handleGet(fields[1:], cmd == "gets", w)
+	case "set", "add", "replace", "cas":
+		return s.handleStore(cmd, fields[1:], reader, w)
+	case "delete":
+		return s.handleDelete(fields[1:], w)
+	case "incr", "decr":
+		return s.handleArithmetic(cmd, fields[1:], w)
+	case "touch":
+		return s.handleTouch(fields[1:], w)
+	case "version":
+		_, err := w.WriteString("VERSION " + version + "\r\n")
+		return err
+	case "quit":
+		return errClientClosed
+	default:
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+}
+
+// handle get <key>* and gets <key>*
+func (s *Server) handleGet(keys []string, withCas bool, w *bufio.Writer) error {
+	if len(keys) == 0 {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+
+	for _, key := range keys {
+		if !validKey(key) {
+			return clientError(w, "bad command line format")
+		}
+		item, err := s.Database.GetItem(key)
+		// queues have no value the protocol could return, so they read as misses
+		if err != nil || item.Queue != nil {
+			continue
+		}
+		if withCas {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.Flags, len(item.Value), item.Revision)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.Flags, len(item.Value))
+		}
+		w.WriteString(item.Value)
+		w.WriteString("\r\n")
+	}
+
+	_, err := w.WriteString("END\r\n")
+	return err
+}
+
+// handle <set|add|replace> <key> <flags> <exptime> <bytes> [noreply]
+// and cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (s *Server) handleStore(cmd string, args []string, reader *bufio.Reader, w *bufio.Writer) error {
+	argc := 4
+	if cmd == "cas" {
+		argc = 5
+	}
+	noreply := len(args) == argc+1 && args[argc] == "noreply"
+	if len(args) != argc && !noreply {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+
+	key := args[0]
+	flags, errFlags := strconv.ParseUint(args[1], 10, 32)
+	exptime, errExptime := strconv.ParseInt(args[2], 10, 64)
+	size, errSize := strconv.Atoi(args[3])
+	if !validKey(key) || errFlags != nil || errExptime != nil || errSize != nil || size < 0 {
+		return clientError(w, "bad command line format")
+	}
+	var casUnique uint64
+	if cmd == "cas" {
+		var err error
+		casUnique, err = strconv.ParseUint(args[4], 10, 64)
+		// revisions start at one, zero would ask the database for create-only semantics
+		if err != nil || casUnique == 0 {
+			return clientError(w, "bad command line format")
+		}
+	}
+	if size > maxValueLength {
+		// swallow the data block so the connection stays usable
+		if _, err := reader.Discard(size + 2); err != nil {
+			return err
+		}
+		return serverError(w, "object too large for cache")
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		// drop the rest of the oversized block up to the next line
+		if data[size+1] != '\n' {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return err
+			}
+		}
+		return clientError(w, "bad data chunk")
+	}
+
+	item := database.KeyValuePair{
+		Value:      string(data[:size]),
+		Expiration: expiration(exptime),
+		Flags:      uint32(flags),
+	}
+
+	var err error
+	switch cmd {
+	case "set":
+		_, _, err = s.Database.SetItem(key, item, "")
+	case "add":
+		_, _, err = s.Database.SetItem(key, item, "NX")
+	case "replace":
+		_, _, err = s.Database.SetItem(key, item, "XX")
+	case "cas":
+		_, err = s.Database.CompareAndSet(key, item, casUnique)
+	}
+
+	reply := "STORED"
+	switch err {
+	case nil:
+	case database.ErrKeyExists, database.ErrKeyNotExist:
+		reply = "NOT_STORED"
+	case database.ErrRevisionMismatch:
+		reply = "EXISTS"
+	case database.ErrNotFound:
+		reply = "NOT_FOUND"
+	default:
+		return serverError(w, err.Error())
+	}
+	return writeReply(w, reply, noreply)
+}
+
+// handle delete <key> [noreply]
+func (s *Server) handleDelete(args []string, w *bufio.Writer) error {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		return clientError(w, "bad command line format.  Usage: delete <key> [noreply]")
+	}
+
+	if err := s.Database.Delete(args[0]); err != nil {
+		return writeReply(w, "NOT_FOUND", noreply)
+	}
+	return writeReply(w, "DELETED", noreply)
+}
+
+// handle <incr|decr> <key> <value> [noreply]
+func (s *Server) handleArithmetic(cmd string, args []string, w *bufio.Writer) error {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return clientError(w, "invalid numeric delta argument")
+	}
+
+	var value uint64
+	if cmd == "incr" {
+		value, err = s.Database.Incr(args[0], delta)
+	} else {
+		value, err = s.Database.Decr(args[0], delta)
+	}
+
+	switch err {
+	case nil:
+		return writeReply(w, strconv.FormatUint(value, 10), noreply)
+	case database.ErrNotFound:
+		return writeReply(w, "NOT_FOUND", noreply)
+	case database.ErrNotNumber:
+		return clientError(w, "cannot increment or decrement non-numeric value")
+	default:
+		return serverError(w, err.Error())
+	}
+}
+
+// handle touch <key> <exptime> [noreply]
+func (s *Server) handleTouch(args []string, w *bufio.Writer) error {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return clientError(w, "invalid exptime argument")
+	}
+
+	if err := s.Database.Touch(args[0], expiration(exptime)); err != nil {
+		return writeReply(w, "NOT_FOUND", noreply)
+	}
+	return writeReply(w, "TOUCHED", noreply)
+}
+
+// convert a memcached exptime into an absolute expiration. Zero never expires,
+// negative values expire immediately, values up to 30 days are relative to now
+// and anything larger is a unix timestamp.
+func expiration(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now().Add(-time.Second)
+	case exptime <= maxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// report whether key is acceptable to the protocol
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// write the reply line unless the client asked for noreply
+func writeReply(w *bufio.Writer, reply string, noreply bool) error {
+	if noreply {
+		return nil
+	}
+	_, err := w.WriteString(reply + "\r\n")
+	return err
+}
+
+func clientError(w *bufio.Writer, msg string) error {
+	_, err := w.WriteString("CLIENT_ERROR " + msg + "\r\n")
+	return err
+}
+
+func serverError(w *bufio.Writer, msg string) error {
+	_, err := w.WriteString("SERVER_ERROR " + msg + "\r\n")
+	return err
+}
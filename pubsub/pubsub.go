@@ -0,0 +1,147 @@
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/7dpk/keyvaluestore/glob"
+)
+
+// number of undelivered messages a subscriber may hold before it is disconnected
+const DefaultBufferSize = 128
+
+// a message delivered to a subscriber. Pattern is the pattern that matched,
+// empty when the subscriber named the channel exactly.
+type Message struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Payload string `json:"message"`
+}
+
+// fan published messages out to the subscribers of each channel
+type Broker struct {
+	bufferSize  int
+	lock        sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// a subscriber's interest in some channels and patterns along with its
+// bounded buffer of pending messages
+type Subscription struct {
+	channels  map[string]struct{}
+	patterns  []string
+	messages  chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+	// set when the subscription was closed because its buffer filled up
+	slow bool
+}
+
+// create a broker whose subscribers buffer up to bufferSize messages
+func NewBroker(bufferSize int) *Broker {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	return &Broker{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe to the exact channels and to every channel matching the glob patterns
+func (b *Broker) Subscribe(channels, patterns []string) *Subscription {
+	sub := &Subscription{
+		channels: make(map[string]struct{}, len(channels)),
+		patterns: patterns,
+		messages: make(chan Message, b.bufferSize),
+		done:     make(chan struct{}),
+	}
+	for _, channel := range channels {
+		sub.channels[channel] = struct{}{}
+	}
+
+	b.lock.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.lock.Unlock()
+
+	return sub
+}
+
+// stop delivering messages to the subscription
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.remove(sub, false)
+}
+
+// remove the subscription and signal its end, recording whether it fell behind
+func (b *Broker) remove(sub *Subscription, slow bool) {
+	b.lock.Lock()
+	delete(b.subscribers, sub)
+	b.lock.Unlock()
+
+	sub.closeOnce.Do(func() {
+		sub.slow = slow
+		close(sub.done)
+	})
+}
+
+// deliver payload to every subscriber of channel and return how many received
+// it. Subscribers whose buffer is full are disconnected instead of blocking.
+func (b *Broker) Publish(channel, payload string) int {
+	var slow []*Subscription
+	receivers := 0
+
+	b.lock.RLock()
+	for sub := range b.subscribers {
+		pattern, ok := sub.match(channel)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.messages <- Message{Channel: channel, Pattern: pattern, Payload: payload}:
+			receivers++
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	b.lock.RUnlock()
+
+	for _, sub := range slow {
+		b.remove(sub, true)
+	}
+	return receivers
+}
+
+// return the number of active subscriptions
+func (b *Broker) Subscribers() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subscribers)
+}
+
+// report whether the subscription wants messages on channel and which pattern matched
+func (s *Subscription) match(channel string) (string, bool) {
+	if _, ok := s.channels[channel]; ok {
+		return "", true
+	}
+	for _, pattern := range s.patterns {
+		if glob.Match(pattern, channel) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// return the channel of pending messages
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// return a channel that is closed once the subscription ends
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// report whether the subscription ended because the subscriber fell behind.
+// Only meaningful once Done is closed.
+func (s *Subscription) Slow() bool {
+	return s.slow
+}
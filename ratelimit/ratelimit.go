@@ -0,0 +1,237 @@
+// Package ratelimit limits how many commands each client may send per second
+// with token buckets, and how many blocking commands it may have waiting.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// matched by the *Error of a client out of tokens
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// matched by the *Error of a client holding too many blocking commands
+	ErrTooManyWaiters = errors.New("too many blocking commands waiting")
+)
+
+// a refused command and how long the client should wait before retrying. It
+// matches ErrRateLimited or ErrTooManyWaiters with errors.Is.
+type Error struct {
+	Err        error
+	Class      Class
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Err == ErrTooManyWaiters {
+		return fmt.Sprintf("%v, retry after %v", e.Err, e.RetryAfter)
+	}
+	return fmt.Sprintf("%v for %s commands, retry after %v", e.Err, e.Class, e.RetryAfter)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// the budget a command is charged to
+type Class string
+
+const (
+	Read     Class = "read"
+	Write    Class = "write"
+	Blocking Class = "blocking"
+)
+
+// every class in the order they are documented
+var Classes = []Class{Read, Write, Blocking}
+
+// how long a client is told to wait when its blocking commands are capped,
+// since it cannot be known when one of them returns
+const WaiterRetryAfter = time.Second
+
+// a token bucket: Rate tokens per second are added up to Burst, and every
+// command takes one. A zero Rate means no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// parse a limit given as "rate" or "rate/burst", e.g. 100/200, with the
+// burst defaulting to the rate rounded up. "0" is no limit.
+func ParseLimit(value string) (Limit, error) {
+	rateText, burstText, hasBurst := strings.Cut(strings.TrimSpace(value), "/")
+	rate, err := strconv.ParseFloat(rateText, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return Limit{}, errors.New("invalid rate " + rateText)
+	}
+	if rate == 0 {
+		return Limit{}, nil
+	}
+	burst := int(math.Ceil(rate))
+	if hasBurst {
+		burst, err = strconv.Atoi(burstText)
+		if err != nil || burst < 1 {
+			return Limit{}, errors.New("invalid burst " + burstText)
+		}
+	}
+	return Limit{Rate: rate, Burst: burst}, nil
+}
+
+func (l Limit) String() string {
+	if l.Rate == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + "/" + strconv.Itoa(l.Burst)
+}
+
+// the tokens left in a bucket when it was last charged
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// add the tokens earned since the bucket was last charged
+func (b *bucket) refill(limit Limit, now time.Time) {
+	b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+// the buckets and blocking commands of a client
+type client struct {
+	buckets map[Class]*bucket
+	waiters int
+}
+
+// how often clients whose buckets are full again are forgotten
+const pruneInterval = time.Minute
+
+// the limits of every client, safe for concurrent use. Clients are told
+// apart by a key chosen by the caller, such as their token or address.
+type Limiter struct {
+	lock       sync.Mutex
+	limits     map[Class]Limit
+	maxWaiters int
+	clients    map[string]*client
+	lastPrune  time.Time
+}
+
+// create a limiter without limits
+func New() *Limiter {
+	return &Limiter{
+		limits:    make(map[Class]Limit),
+		clients:   make(map[string]*client),
+		lastPrune: time.Now(),
+	}
+}
+
+// set the limit of a class. Buckets keep their tokens, capped at the new burst.
+func (l *Limiter) SetLimit(class Class, limit Limit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limits[class] = limit
+}
+
+// set how many blocking commands a client may have waiting, 0 for any number
+func (l *Limiter) SetMaxWaiters(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.maxWaiters = n
+}
+
+// return the client with the key, creating it if needed. Callers must hold the lock.
+func (l *Limiter) client(key string) *client {
+	c, exists := l.clients[key]
+	if !exists {
+		c = &client{buckets: make(map[Class]*bucket)}
+		l.clients[key] = c
+	}
+	return c
+}
+
+// charge a command of the class to the client, or return an *Error telling
+// how long until the client has a token again
+func (l *Limiter) Allow(key string, class Class) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit := l.limits[class]
+	if limit.Rate == 0 {
+		return nil
+	}
+	now := time.Now()
+	l.prune(now)
+
+	c := l.client(key)
+	b, exists := c.buckets[class]
+	if !exists {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		c.buckets[class] = b
+	}
+	b.refill(limit, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return &Error{Err: ErrRateLimited, Class: class, RetryAfter: wait}
+	}
+	b.tokens--
+	return nil
+}
+
+// take a slot for a blocking command of the client and return the function
+// giving it back, or an *Error if the client has too many waiting
+func (l *Limiter) Wait(key string) (func(), error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxWaiters == 0 {
+		return func() {}, nil
+	}
+	c := l.client(key)
+	if c.waiters >= l.maxWaiters {
+		return nil, &Error{Err: ErrTooManyWaiters, Class: Blocking, RetryAfter: WaiterRetryAfter}
+	}
+	c.waiters++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			c.waiters--
+		})
+	}, nil
+}
+
+// forget the clients without waiting commands whose buckets are full again,
+// at most once per pruneInterval. Callers must hold the lock.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, c := range l.clients {
+		if c.waiters > 0 {
+			continue
+		}
+		full := true
+		for class, b := range c.buckets {
+			limit := l.limits[class]
+			if limit.Rate == 0 {
+				continue
+			}
+			if b.refill(limit, now); b.tokens < float64(limit.Burst) {
+				full = false
+				break
+			}
+		}
+		if full {
+			delete(l.clients, key)
+		}
+	}
+}
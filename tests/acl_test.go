@@ -0,0 +1,219 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// send a command with the token as bearer token and return the status and typed reply
+func sendAs(t *testing.T, url, token, command string) (int, handlers.Reply) {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(`{"command": "`+command+`"}`))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply handlers.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("%q: failed to decode reply: %v", command, err)
+	}
+	return resp.StatusCode, reply
+}
+
+func TestACL(t *testing.T) {
+	var audit bytes.Buffer
+	handler := &handlers.HTTPHandler{
+		Database: database.NewDatabase(),
+		Audit:    acl.NewAuditLog(&audit, acl.DefaultAuditLogSize),
+		Config:   config.Default(),
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// without users every request is made as the default user
+	if _, reply := sendCommand(t, server.URL, "WHOAMI"); reply.Value != "default" {
+		t.Fatalf("WHOAMI: expected default, got %+v", reply)
+	}
+
+	steps := []struct {
+		Token   string
+		Command string
+		Status  int
+		Code    string
+	}{
+		{"", "ACL SETUSER admin on >admin-token allkeys allcommands", http.StatusOK, ""},
+		{"", "ACL SETUSER reader on >reader-token ~app:* +@read -STRLEN", http.StatusOK, ""},
+		{"", "ACL SETUSER worker on >worker-token ~jobs +@queue", http.StatusOK, ""},
+		{"", "ACL SETUSER bogus on +", http.StatusBadRequest, "INVALID_RULE"},
+		{"", "ACL SETUSER thief on >admin-token", http.StatusBadRequest, "INVALID_RULE"},
+		{"", "ACL SETUSER default off", http.StatusOK, ""},
+		// anonymous requests are no longer allowed
+		{"", "GET app:1", http.StatusUnauthorized, "UNAUTHENTICATED"},
+		{"wrong-token", "GET app:1", http.StatusUnauthorized, "UNAUTHENTICATED"},
+		{"admin-token", "SET app:1 one", http.StatusOK, ""},
+		{"admin-token", "SET secret value", http.StatusOK, ""},
+		{"reader-token", "GET app:1", http.StatusOK, ""},
+		{"reader-token", "MGET app:1 app:2", http.StatusOK, ""},
+		{"reader-token", "GET secret", http.StatusForbidden, "NO_PERMISSION"},
+		{"reader-token", "MGET app:1 secret", http.StatusForbidden, "NO_PERMISSION"},
+		{"reader-token", "STRLEN app:1", http.StatusForbidden, "NO_PERMISSION"},
+		{"reader-token", "SET app:1 two", http.StatusForbidden, "NO_PERMISSION"},
+		// commands reaching keys beyond their arguments need every key
+		{"reader-token", "KEYS app:*", http.StatusForbidden, "NO_PERMISSION"},
+		{"reader-token", "ACL LIST", http.StatusForbidden, "NO_PERMISSION"},
+		{"worker-token", "QPUSH jobs a", http.StatusOK, ""},
+		{"worker-token", "BQPOP jobs 1", http.StatusOK, ""},
+		{"worker-token", "SET jobs a", http.StatusForbidden, "NO_PERMISSION"},
+		{"worker-token", "QPUSH other a", http.StatusForbidden, "NO_PERMISSION"},
+		{"admin-token", "ACL SAVE", http.StatusBadRequest, "INVALID_STATE"},
+	}
+	for _, step := range steps {
+		status, reply := sendAs(t, server.URL, step.Token, step.Command)
+		if status != step.Status || reply.Code != step.Code {
+			t.Errorf("%s as %q: expected %d %s, got %d %+v", step.Command, step.Token, step.Status, step.Code, status, reply)
+		}
+	}
+
+	if _, reply := sendAs(t, server.URL, "reader-token", "WHOAMI"); reply.Value != "reader" {
+		t.Errorf("WHOAMI: expected reader, got %+v", reply)
+	}
+
+	// the routes are authorized as their commands
+	for path, status := range map[string]int{
+		"/keys/app:1":                    http.StatusOK,
+		"/keys/secret":                   http.StatusForbidden,
+		"/keys":                          http.StatusForbidden,
+		"/watch?key=secret&timeout=0.01": http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer reader-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("GET %s: expected %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(server.URL + "/keys/app:1")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with a WWW-Authenticate header, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// sessions belong to the user that created them
+	req, _ := http.NewRequest("POST", server.URL+"/sessions", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	var created handlers.ResponseValue
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	req, _ = http.NewRequest("POST", server.URL, strings.NewReader(`{"command": "GET app:1"}`))
+	req.Header.Set("Authorization", "Bearer reader-token")
+	req.Header.Set("X-Session-Token", created.Value)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the session of another user to be unknown, got %d", resp.StatusCode)
+	}
+
+	_, reply := sendAs(t, server.URL, "admin-token", "ACL GETUSER reader")
+	if keys := replyStrings(replyField(reply, "keys")); len(keys) != 1 || keys[0] != "app:*" {
+		t.Errorf("ACL GETUSER: expected the keys [app:*], got %+v", reply)
+	}
+	if commands := replyStrings(replyField(reply, "commands")); strings.Join(commands, " ") != "+@read -STRLEN" {
+		t.Errorf("ACL GETUSER: expected the commands +@read -STRLEN, got %v", commands)
+	}
+	_, reply = sendAs(t, server.URL, "admin-token", "ACL LIST")
+	if list := strings.Join(replyStrings(reply), "\n"); strings.Contains(list, "reader-token") || !strings.Contains(list, acl.HashToken("reader-token")) {
+		t.Errorf("ACL LIST: expected hashed tokens only, got %s", list)
+	}
+	_, reply = sendAs(t, server.URL, "admin-token", "ACL CAT queue")
+	if commands := strings.Join(replyStrings(reply), " "); commands != "BQPOP QPOP QPUSH" {
+		t.Errorf("ACL CAT queue: expected BQPOP QPOP QPUSH, got %s", commands)
+	}
+
+	// denials are logged, the most recent first
+	_, reply = sendAs(t, server.URL, "admin-token", "ACL LOG 2")
+	entries, _ := reply.Value.([]handlers.Reply)
+	if len(entries) != 2 || replyField(entries[0], "event").Value != "auth" ||
+		replyField(entries[1], "event").Value != "key" || replyField(entries[1], "user").Value != "reader" {
+		t.Errorf("ACL LOG: unexpected entries %+v", reply)
+	}
+	if !strings.Contains(audit.String(), `"event":"key","user":"reader"`) || !strings.Contains(audit.String(), `"key":"secret"`) {
+		t.Errorf("Expected the key denial in the audit log, got %s", audit.String())
+	}
+	if strings.Contains(audit.String(), "admin-token") || !strings.Contains(audit.String(), `"command":"ACL SETUSER"`) {
+		t.Errorf("Expected redacted ACL changes in the audit log, got %s", audit.String())
+	}
+
+	if _, reply := sendAs(t, server.URL, "admin-token", "ACL DELUSER reader nobody"); replyInt(reply) != 1 {
+		t.Errorf("ACL DELUSER: expected 1, got %+v", reply)
+	}
+	if status, _ := sendAs(t, server.URL, "reader-token", "GET app:1"); status != http.StatusUnauthorized {
+		t.Errorf("Expected the token of a deleted user to fail, got %d", status)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	cfg := config.Default()
+	cfg.ACLFile = filepath.Join(t.TempDir(), "users.acl")
+	users := acl.New()
+	handler := &handlers.HTTPHandler{Database: database.NewDatabase(), Config: cfg, ACL: users}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	for _, step := range []struct{ Token, Command string }{
+		{"", "ACL SETUSER ops on >ops-token allkeys +@all -@admin"},
+		{"", "ACL SETUSER admin on >admin-token allcommands"},
+		{"", "ACL SETUSER default reset"},
+		{"admin-token", "ACL SAVE"},
+		{"admin-token", "ACL DELUSER ops"},
+		{"admin-token", "ACL LOAD"},
+	} {
+		if status, reply := sendAs(t, server.URL, step.Token, step.Command); status != http.StatusOK {
+			t.Fatalf("%s: %d %+v", step.Command, status, reply)
+		}
+	}
+	if status, reply := sendAs(t, server.URL, "ops-token", "WHOAMI"); status != http.StatusOK || reply.Value != "ops" {
+		t.Errorf("Expected the saved user to be loaded, got %d %+v", status, reply)
+	}
+	if status, _ := sendAs(t, server.URL, "ops-token", "CONFIG GET *"); status != http.StatusForbidden {
+		t.Errorf("Expected the admin category to be denied, got %d", status)
+	}
+	if status, _ := sendCommand(t, server.URL, "WHOAMI"); status != http.StatusUnauthorized {
+		t.Errorf("Expected the disabled default user to refuse anonymous requests, got %d", status)
+	}
+
+	err := users.Read(strings.NewReader("user a on >same\nuser b on >same\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected a token shared by two users to fail on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestTokenize(t *testing.T) {
+	testCases := []struct {
+		Command  string
+		Expected []string
+		Error    string
+	}{
+		{`SET k v`, []string{"SET", "k", "v"}, ""},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}, ""},
+		{`SET k "say \"hi\"\n\x41"`, []string{"SET", "k", "say \"hi\"\nA"}, ""},
+		{`SET k 'it\'s \n raw'`, []string{"SET", "k", `it's \n raw`}, ""},
+		{`SET k ""`, []string{"SET", "k", ""}, ""},
+		{`SET k "open`, nil, "unterminated quoted string at position 7"},
+		{`SET k "a"b`, nil, "closing quote must be followed by a space at position 10"},
+		{`SET k "bad \q"`, nil, "invalid escape sequence \\q at position 12"},
+		{`SET k "\xZZ"`, nil, "invalid hex escape sequence at position 8"},
+	}
+
+	for _, testCase := range testCases {
+		words, err := commandparser.Tokenize(testCase.Command)
+		if testCase.Error != "" {
+			if err == nil || err.Error() != testCase.Error {
+				t.Errorf("Tokenize(%q): expected error %q, got %v", testCase.Command, testCase.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Tokenize(%q): unexpected error %v", testCase.Command, err)
+		}
+		if !reflect.DeepEqual(words, testCase.Expected) {
+			t.Errorf("Tokenize(%q): expected %q, got %q", testCase.Command, testCase.Expected, words)
+		}
+	}
+}
+
+func TestStructuredArguments(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleRequest))
+	defer server.Close()
+
+	testCases := []struct {
+		Request  interface{}
+		Status   int
+		ExpValue string
+		ErrValue string
+	}{
+		{map[string]interface{}{"command": "SET", "args": []string{"k", "hello world\n"}}, http.StatusOK, "OK", ""},
+		{map[string]interface{}{"command": "GET", "args": []string{"k"}}, http.StatusOK, "hello world\n", ""},
+		{map[string]interface{}{"command": `SET k "quoted \"value\""`}, http.StatusOK, "OK", ""},
+		{map[string]interface{}{"command": "GET k"}, http.StatusOK, `quoted "value"`, ""},
+		{map[string]interface{}{"command": "QPUSH", "args": []string{"q", "a b", "c d"}}, http.StatusOK, "OK", ""},
+		{map[string]interface{}{"command": "QPOP", "args": []string{"q"}}, http.StatusOK, "c d", ""},
+		{map[string]interface{}{"command": "GET", "args": []string{}}, http.StatusBadRequest, "", "invalid command"},
+		{map[string]interface{}{"command": `GET "k`}, http.StatusBadRequest, "", "unterminated quoted string at position 5"},
+	}
+
+	for _, testCase := range testCases {
+		body, err := json.Marshal(testCase.Request)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %v", err)
+		}
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Errorf("Could not decode JSON response: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != testCase.Status {
+			t.Errorf("Request %s: expected status %d, got %d", body, testCase.Status, resp.StatusCode)
+		}
+		if response.Value != testCase.ExpValue || response.Error != testCase.ErrValue {
+			t.Errorf("Request %s: expected value %q error %q, got value %q error %q",
+				body, testCase.ExpValue, testCase.ErrValue, response.Value, response.Error)
+		}
+	}
+}
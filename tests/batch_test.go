@@ -0,0 +1,101 @@
+package handlers_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestBatchCommands(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	requestBody := `[
+		{"command": "SET a 1"},
+		{"command": "GET a"},
+		{"command": "GET missing"},
+		{"command": "BOGUS"},
+		{"command": "QPUSH", "args": ["q", "x y"]},
+		{"command": "QPOP q"}
+	]`
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	var responses []Response
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+
+	expected := []Response{
+		{Value: "OK"},
+		{Value: "1"},
+		{Error: "key not found"},
+		{Error: "invalid command"},
+		{Value: "OK"},
+		{Value: "x y"},
+	}
+	if len(responses) != len(expected) {
+		t.Fatalf("Expected %d responses, got %d", len(expected), len(responses))
+	}
+	for i := range expected {
+		if responses[i] != expected[i] {
+			t.Errorf("Response %d: expected %+v, got %+v", i, expected[i], responses[i])
+		}
+	}
+}
+
+func TestStreamCommands(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	resp, err := http.Post(server.URL+"/batch", "application/x-ndjson", bodyReader)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+
+	// every response must arrive before the next command is written
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(bodyWriter, "{\"command\": \"QPUSH q %d\"}\n{\"command\": \"QPOP q\"}\n", i)
+
+		for _, expected := range []Response{{Value: "OK"}, {Value: fmt.Sprint(i)}} {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read response line: %v", err)
+			}
+			var response Response
+			if err := json.Unmarshal([]byte(line), &response); err != nil {
+				t.Fatalf("Could not decode JSON response %q: %v", line, err)
+			}
+			if response != expected {
+				t.Fatalf("Expected %+v, got %+v", expected, response)
+			}
+		}
+	}
+}
@@ -166,13 +166,14 @@ func TestBQPOP(t *testing.T) {
 	}
 
 	// Decode the JSON response
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	var timedOut handlers.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&timedOut); err != nil {
 		t.Errorf("Could not decode JSON response: %v", err)
 	}
 
 	// Check the response body as it should timeout after 3 seconds
-	if response.Value != "" {
-		t.Errorf("Expected an empty string; got %q", response.Value)
+	if timedOut.Type != handlers.ReplyNull {
+		t.Errorf("Expected a null reply; got %+v", timedOut)
 	}
 
 	// Check the duration it took to get a response
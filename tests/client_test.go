@@ -0,0 +1,242 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/client"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// start a server and return a client of it
+func newTestClient(t *testing.T, options client.Options) (*client.Client, *database.Database) {
+	t.Helper()
+	db := database.NewDatabase()
+	server := httptest.NewServer(handlers.NewRouter(&handlers.HTTPHandler{Database: db}))
+	t.Cleanup(server.Close)
+	return client.NewClient(server.URL, options), db
+}
+
+func TestClientCommands(t *testing.T) {
+	c, _ := newTestClient(t, client.Options{})
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "greeting", "hello", nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if value, err := c.Get(ctx, "greeting"); err != nil || value != "hello" {
+		t.Errorf("Get: expected hello, got %q %v", value, err)
+	}
+	if err := c.Set(ctx, "greeting", "hi", &client.SetOptions{NX: true}); !errors.Is(err, database.ErrConditionFailed) {
+		t.Errorf("Set NX on an existing key: expected ErrConditionFailed, got %v", err)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("Get of a missing key: expected ErrNotFound, got %v", err)
+	}
+
+	_, revision, err := c.GetWithRevision(ctx, "greeting")
+	if err != nil {
+		t.Fatalf("GetWithRevision: %v", err)
+	}
+	if _, err := c.CAS(ctx, "greeting", revision, "hey", time.Minute); err != nil {
+		t.Errorf("CAS at the current revision: %v", err)
+	}
+	if _, err := c.CAS(ctx, "greeting", revision, "ho", 0); !errors.Is(err, database.ErrConditionFailed) {
+		t.Errorf("CAS at an old revision: expected ErrConditionFailed, got %v", err)
+	}
+
+	if length, err := c.Append(ctx, "greeting", " there"); err != nil || length != 9 {
+		t.Errorf("Append: expected 9, got %d %v", length, err)
+	}
+	if value, err := c.GetRange(ctx, "greeting", 0, 2); err != nil || value != "hey" {
+		t.Errorf("GetRange: expected hey, got %q %v", value, err)
+	}
+
+	if err := c.MSet(ctx, map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("MSet: %v", err)
+	}
+	values, err := c.MGet(ctx, "a", "nope", "b")
+	if err != nil || len(values) != 3 || *values[0] != "1" || values[1] != nil || *values[2] != "2" {
+		t.Errorf("MGet: unexpected values %v %v", values, err)
+	}
+	if stored, err := c.MSetNX(ctx, map[string]string{"a": "3", "c": "4"}); err != nil || stored {
+		t.Errorf("MSetNX with an existing key: expected false, got %v %v", stored, err)
+	}
+
+	entries, err := c.Range(ctx, "a", "c", nil)
+	if err != nil || !reflect.DeepEqual(entries, []client.Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}) {
+		t.Errorf("Range: unexpected entries %v %v", entries, err)
+	}
+	cursor, keys, err := c.Scan(ctx, 0, &client.ScanOptions{Match: "a"})
+	if err != nil || cursor != 0 || !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("Scan: unexpected step %d %v %v", cursor, keys, err)
+	}
+
+	if err := c.QPush(ctx, "jobs", "x", "y"); err != nil {
+		t.Fatalf("QPush: %v", err)
+	}
+	if value, err := c.QPop(ctx, "jobs"); err != nil || value != "y" {
+		t.Errorf("QPop: expected y, got %q %v", value, err)
+	}
+	if value, err := c.BQPop(ctx, "jobs", time.Second); err != nil || value != "x" {
+		t.Errorf("BQPop: expected x, got %q %v", value, err)
+	}
+	if _, err := c.BQPop(ctx, "jobs", 10*time.Millisecond); !errors.Is(err, database.ErrTimeout) {
+		t.Errorf("BQPop of an empty queue: expected ErrTimeout, got %v", err)
+	}
+	if _, err := c.QPop(ctx, "jobs"); !errors.Is(err, database.ErrQueueEmpty) {
+		t.Errorf("QPop of an empty queue: expected ErrQueueEmpty, got %v", err)
+	}
+
+	c.QPush(ctx, "jobs", "z")
+	var replyErr *client.Error
+	if _, err := c.Strlen(ctx, "jobs"); !errors.As(err, &replyErr) || replyErr.Code != "WRONG_TYPE" || replyErr.Status != http.StatusBadRequest {
+		t.Errorf("Strlen of a queue: expected a WRONG_TYPE error, got %v", err)
+	}
+
+	stats, err := c.Info(ctx)
+	if err != nil || stats.Keys != 4 {
+		t.Errorf("Info: expected 4 keys, got %+v %v", stats, err)
+	}
+}
+
+func TestClientNamespace(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{Database: db}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	c := client.NewClient(server.URL, client.Options{Namespace: "other"})
+	if err := c.Set(context.Background(), "a", "1", nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("Expected the key to be set in the other namespace, got %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	db := database.NewDatabase()
+	router := handlers.NewRouter(&handlers.HTTPHandler{Database: db})
+	// fail every other request as an overloaded proxy would
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := client.NewClient(server.URL, client.Options{MinBackoff: time.Millisecond})
+	ctx := context.Background()
+
+	db.Set("a", "1", 0, "")
+	if value, err := c.Get(ctx, "a"); err != nil || value != "1" {
+		t.Errorf("Get: expected the retry to succeed, got %q %v", value, err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Get: expected 2 requests, got %d", got)
+	}
+
+	// a push is not idempotent, so its failure is returned as is
+	requests.Store(0)
+	var replyErr *client.Error
+	if err := c.QPush(ctx, "jobs", "x"); !errors.As(err, &replyErr) || replyErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("QPush: expected a 503 error, got %v", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("QPush: expected 1 request, got %d", got)
+	}
+
+	// with retries disabled nothing is retried
+	requests.Store(0)
+	c = client.NewClient(server.URL, client.Options{MaxRetries: -1})
+	if _, err := c.Get(ctx, "a"); !errors.As(err, &replyErr) {
+		t.Errorf("Get without retries: expected a 503 error, got %v", err)
+	}
+}
+
+func TestClientDoesNotRetryConditionalSet(t *testing.T) {
+	db := database.NewDatabase()
+	router := handlers.NewRouter(&handlers.HTTPHandler{Database: db})
+	// run every request but drop the first response, so the client cannot
+	// tell whether its write happened
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			router.ServeHTTP(w, r)
+			return
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	c := client.NewClient(server.URL, client.Options{MinBackoff: time.Millisecond})
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "lock", "owner", &client.SetOptions{NX: true}); err == nil {
+		t.Errorf("Set NX: expected the dropped response to be an error")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Set NX: expected 1 request, got %d", got)
+	}
+	if value, _ := db.Get("lock"); value != "owner" {
+		t.Errorf("Expected the write to have happened, got %q", value)
+	}
+
+	// an unconditional SET is retried
+	requests.Store(0)
+	if err := c.Set(ctx, "lock", "other", nil); err != nil {
+		t.Errorf("Set: expected the retry to succeed, got %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Set: expected 2 requests, got %d", got)
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	c, _ := newTestClient(t, client.Options{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.QPush(ctx, "jobs", "x"); err != nil {
+		t.Fatalf("QPush: %v", err)
+	}
+	c.QPop(ctx, "jobs")
+	if _, err := c.BQPop(ctx, "jobs", time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("BQPop past the deadline: expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("BQPop returned after %v, expected the deadline to cut it short", elapsed)
+	}
+}
+
+func TestClientBatch(t *testing.T) {
+	c, _ := newTestClient(t, client.Options{})
+
+	replies, err := c.Batch(context.Background(), [][]string{
+		{"SET", "a", "hello world"},
+		{"GET", "a"},
+		{"GET", "missing"},
+	})
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	if len(replies) != 3 || replies[1].Value != "hello world" || replies[2].Code != "NOT_FOUND" {
+		t.Errorf("Batch: unexpected replies %+v", replies)
+	}
+}
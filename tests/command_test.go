@@ -0,0 +1,184 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// send a command and decode its typed reply
+func sendCommand(t *testing.T, url, command string) (int, handlers.Reply) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"command": "`+command+`"}`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply handlers.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("%q: failed to decode reply: %v", command, err)
+	}
+	return resp.StatusCode, reply
+}
+
+func TestCommandIntrospection(t *testing.T) {
+	handler := &handlers.HTTPHandler{Database: database.NewDatabase()}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	status, reply := sendCommand(t, server.URL, "COMMAND COUNT")
+	if status != http.StatusOK || replyInt(reply) != int64(len(commandparser.Builtins())) {
+		t.Errorf("COMMAND COUNT: expected %d, got %d %+v", len(commandparser.Builtins()), status, reply)
+	}
+
+	_, reply = sendCommand(t, server.URL, "COMMAND INFO bqpop nosuch")
+	items, _ := reply.Value.([]handlers.Reply)
+	if len(items) != 2 || items[1].Type != handlers.ReplyNull {
+		t.Fatalf("COMMAND INFO: unexpected reply %+v", reply)
+	}
+	bqpop := items[0]
+	if name := replyField(bqpop, "name").Value; name != "BQPOP" {
+		t.Errorf("COMMAND INFO: expected BQPOP, got %v", name)
+	}
+	if flags := replyStrings(replyField(bqpop, "flags")); !reflect.DeepEqual(flags, []string{"write", "blocking"}) {
+		t.Errorf("COMMAND INFO: unexpected flags %v", flags)
+	}
+	if replyInt(replyField(bqpop, "min_args")) != 2 || replyInt(replyField(bqpop, "max_args")) != 2 {
+		t.Errorf("COMMAND INFO: unexpected arity %+v", bqpop)
+	}
+
+	_, reply = sendCommand(t, server.URL, "COMMAND DOCS GET")
+	if syntax := replyField(replyField(reply, "GET"), "syntax").Value; syntax != "GET key [WITHREVISION]" {
+		t.Errorf("COMMAND DOCS: unexpected syntax %v", syntax)
+	}
+
+	_, reply = sendCommand(t, server.URL, "COMMAND GETKEYS MSET a 1 b 2")
+	if keys := replyStrings(reply); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("COMMAND GETKEYS: expected [a b], got %v", keys)
+	}
+	if status, _ := sendCommand(t, server.URL, "COMMAND GETKEYS MSET a"); status != http.StatusBadRequest {
+		t.Errorf("COMMAND GETKEYS with a wrong arity: expected 400, got %d", status)
+	}
+
+	resp, err := http.Get(server.URL + "/commands")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var commands []handlers.ResponseCommand
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		t.Fatalf("Failed to decode commands: %v", err)
+	}
+	if len(commands) != len(commandparser.Builtins()) || commands[0].Name != "ACL" {
+		t.Errorf("GET /commands: unexpected response %+v", commands)
+	}
+}
+
+func TestCustomCommand(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{Database: db}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	incr := commandparser.Spec{
+		Name:     "incr",
+		MinArgs:  1,
+		MaxArgs:  1,
+		Flags:    []string{commandparser.FlagWrite},
+		FirstKey: 1,
+		LastKey:  1,
+		KeyStep:  1,
+		Summary:  "Increment the integer of a key",
+	}
+	err := handler.RegisterCommand(incr, func(st handlers.Store, args []string) (handlers.Reply, error) {
+		value, err := st.Get(args[0])
+		if errors.Is(err, database.ErrNotFound) {
+			value, err = "0", nil
+		}
+		if err != nil {
+			return handlers.Reply{}, err
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return handlers.Reply{}, database.ErrNotNumber
+		}
+		n++
+		return handlers.IntegerReply(n), st.Set(args[0], strconv.FormatInt(n, 10), 0, "")
+	})
+	if err != nil {
+		t.Fatalf("Failed to register command: %v", err)
+	}
+
+	if err := handler.RegisterCommand(incr, nil); !errors.Is(err, commandparser.ErrInvalidSpec) {
+		t.Errorf("Registering without a function: expected ErrInvalidSpec, got %v", err)
+	}
+	noop := func(st handlers.Store, args []string) (handlers.Reply, error) { return handlers.NullReply(), nil }
+	if err := handler.RegisterCommand(commandparser.Spec{Name: "GET", MaxArgs: -1}, noop); !errors.Is(err, commandparser.ErrCommandExists) {
+		t.Errorf("Registering GET again: expected ErrCommandExists, got %v", err)
+	}
+	if err := handler.RegisterCommand(commandparser.Spec{Name: "BEGIN", Flags: []string{commandparser.FlagSession}}, noop); !errors.Is(err, commandparser.ErrInvalidSpec) {
+		t.Errorf("Registering a session command: expected ErrInvalidSpec, got %v", err)
+	}
+
+	steps := []struct {
+		Command string
+		Status  int
+		Value   int64
+	}{
+		{"INCR counter", http.StatusOK, 1},
+		{"incr counter", http.StatusOK, 2},
+		{"INCR", http.StatusBadRequest, 0},
+		{"INCR counter extra", http.StatusBadRequest, 0},
+	}
+	for _, step := range steps {
+		status, reply := sendCommand(t, server.URL, step.Command)
+		if status != step.Status || replyInt(reply) != step.Value {
+			t.Errorf("%q: expected %d %d, got %d %+v", step.Command, step.Status, step.Value, status, reply)
+		}
+	}
+
+	db.Set("name", "bob", 0, "")
+	if status, reply := sendCommand(t, server.URL, "INCR name"); status != http.StatusBadRequest || reply.Code != "NOT_A_NUMBER" {
+		t.Errorf("INCR on a string: expected 400 NOT_A_NUMBER, got %d %+v", status, reply)
+	}
+
+	// custom commands are queued and run inside transactions
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(
+		`[{"command": "MULTI"}, {"command": "INCR counter"}, {"command": "INCR counter"}, {"command": "EXEC"}]`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var replies []handlers.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&replies); err != nil {
+		t.Fatalf("Failed to decode batch: %v", err)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("Expected 4 replies, got %+v", replies)
+	}
+	exec, _ := replies[3].Value.([]handlers.Reply)
+	if len(exec) != 2 || replyInt(exec[1]) != 4 {
+		t.Errorf("EXEC: expected the counter to reach 4, got %+v", replies[3])
+	}
+
+	if status, reply := sendCommand(t, server.URL, "COMMAND DOCS INCR"); status != http.StatusOK ||
+		replyField(replyField(reply, "INCR"), "summary").Value != incr.Summary {
+		t.Errorf("COMMAND DOCS INCR: unexpected reply %d %+v", status, reply)
+	}
+
+	// other handlers keep only the builtin commands
+	other := httptest.NewServer(handlers.NewRouter(&handlers.HTTPHandler{Database: database.NewDatabase()}))
+	defer other.Close()
+	if status, reply := sendCommand(t, other.URL, "INCR counter"); status != http.StatusBadRequest || reply.Code != "INVALID_COMMAND" {
+		t.Errorf("INCR on another handler: expected 400 INVALID_COMMAND, got %d %+v", status, reply)
+	}
+}
@@ -0,0 +1,159 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvs.conf")
+	content := `# settings of the test server
+http-addr :9000
+maxmemory 2mb
+maxmemory-policy allkeys-lru
+memcached-addr ""
+expiry-interval	250ms
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"KVS_CONFIG":           path,
+		"KVS_MAXMEMORY":        "4096",
+		"KVS_HTTP_ADDR":        ":9001",
+		"KVS_LEGACY_RESPONSES": "yes",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg, err := config.Load([]string{"-http-addr", ":9002", "-log-requests"}, lookupEnv)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	expected := map[string]string{
+		// the flag wins over the environment and the file
+		"http-addr": ":9002",
+		// the environment wins over the file
+		"maxmemory":        "4096",
+		"legacy-responses": "true",
+		// the file wins over the defaults
+		"maxmemory-policy": "allkeys-lru",
+		"memcached-addr":   "",
+		"expiry-interval":  "250ms",
+		"log-requests":     "true",
+		"log-file":         "",
+	}
+	for name, value := range expected {
+		if got, err := cfg.Get(name); err != nil || got != value {
+			t.Errorf("%s: expected %q, got %q %v", name, value, got, err)
+		}
+	}
+
+	if _, err := config.Load([]string{"-maxmemory", "lots"}, lookupEnv); err == nil {
+		t.Errorf("Expected an invalid flag value to fail")
+	}
+	err = cfg.ReadFile(strings.NewReader("bogus 1\n"))
+	if !errors.Is(err, config.ErrUnknownSetting) || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("Expected an unknown setting on line 1, got %v", err)
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{Database: db}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	steps := []struct {
+		Command string
+		Status  int
+		Code    string
+	}{
+		{"CONFIG SET maxmemory 1kb expiry-interval 50ms", http.StatusOK, ""},
+		{"CONFIG SET http-addr :9000", http.StatusBadRequest, "READ_ONLY_SETTING"},
+		{"CONFIG SET bogus 1", http.StatusBadRequest, "UNKNOWN_SETTING"},
+		// nothing changes if one of the values is invalid
+		{"CONFIG SET maxmemory 2kb maxmemory-policy bogus", http.StatusBadRequest, "INVALID_VALUE"},
+		{"CONFIG SET maxmemory", http.StatusBadRequest, "INVALID_COMMAND"},
+		{"CONFIG SET maxmemory -1", http.StatusBadRequest, "INVALID_VALUE"},
+		{"CONFIG SET maxmemory 9000000000gb", http.StatusBadRequest, "INVALID_VALUE"},
+		{"CONFIG RESET", http.StatusBadRequest, "INVALID_COMMAND"},
+		{"SET big " + strings.Repeat("x", 2048), http.StatusInsufficientStorage, "OUT_OF_MEMORY"},
+	}
+	for _, step := range steps {
+		status, reply := sendCommand(t, server.URL, step.Command)
+		if status != step.Status || reply.Code != step.Code {
+			t.Errorf("%q: expected %d %s, got %d %+v", step.Command, step.Status, step.Code, status, reply)
+		}
+	}
+
+	_, reply := sendCommand(t, server.URL, "CONFIG GET maxmemory*")
+	if maxMemory := replyField(reply, "maxmemory").Value; maxMemory != "1024" {
+		t.Errorf("CONFIG GET: expected maxmemory 1024, got %v", maxMemory)
+	}
+	if policy := replyField(reply, "maxmemory-policy").Value; policy != "noeviction" {
+		t.Errorf("CONFIG GET: expected policy noeviction, got %v", policy)
+	}
+	if _, exists := reply.Value.(map[string]handlers.Reply)["http-addr"]; exists {
+		t.Errorf("CONFIG GET: http-addr does not match the pattern")
+	}
+
+	// the shorter expiry interval removes expired keys sooner
+	db.Set("short", "lived", time.Second, "")
+	time.Sleep(1200 * time.Millisecond)
+	if expired := db.Stats().Expired; expired != 1 {
+		t.Errorf("Expected the key to be expired within 200ms of its expiration, got %d expired keys", expired)
+	}
+}
+
+func TestConfigInsideMulti(t *testing.T) {
+	server := httptest.NewServer(handlers.NewRouter(&handlers.HTTPHandler{Database: database.NewDatabase()}))
+	defer server.Close()
+
+	// CONFIG SET could not take the locks EXEC holds, so it is refused when queued
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(server.URL+"/batch", "application/json", strings.NewReader(
+		`[{"command": "MULTI"}, {"command": "CONFIG SET maxmemory 1mb"}, {"command": "SET greeting hello"}, {"command": "EXEC"}]`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	var replies []handlers.Reply
+	json.NewDecoder(resp.Body).Decode(&replies)
+	resp.Body.Close()
+	if len(replies) != 4 || replies[1].Code != "INVALID_STATE" || replies[3].Code != "TX_DISCARDED" {
+		t.Fatalf("Expected CONFIG to be refused and EXEC to discard the transaction, got %+v", replies)
+	}
+
+	if _, reply := sendCommand(t, server.URL, "CONFIG GET maxmemory"); replyField(reply, "maxmemory").Value != "0" {
+		t.Errorf("Expected maxmemory to be unchanged, got %+v", reply)
+	}
+	if status, _ := sendCommand(t, server.URL, "GET greeting"); status != http.StatusNotFound {
+		t.Errorf("Expected the discarded SET not to run, got %d", status)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]int64{"0": 0, "512": 512, "1kb": 1 << 10, "100MB": 100 << 20, "8gb": 8 << 30, "9223372036854775807b": 1<<63 - 1} {
+		if size, err := config.ParseSize(value); size != want || err != nil {
+			t.Errorf("%s: expected %d, got %d %v", value, want, size, err)
+		}
+	}
+	for _, value := range []string{"-1", "-1kb", "8589934592gb", "9223372036854775808", "lots"} {
+		if _, err := config.ParseSize(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
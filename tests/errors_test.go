@@ -0,0 +1,112 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/commandparser"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestErrorCodes(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	db.Set("k", "v", 0, "")
+	db.QPush("q", []string{"a"})
+
+	steps := []struct {
+		Command string
+		Status  int
+		Code    string
+	}{
+		{"SET k v NX", http.StatusConflict, "CONDITION_FAILED"},
+		{"SET missing v XX", http.StatusConflict, "CONDITION_FAILED"},
+		{"CAS k 999999 v", http.StatusConflict, "CONDITION_FAILED"},
+		{"GET missing", http.StatusNotFound, "NOT_FOUND"},
+		{"APPEND q x", http.StatusBadRequest, "WRONG_TYPE"},
+		{"BOGUS", http.StatusBadRequest, "INVALID_COMMAND"},
+		{"SCAN 0 COUNT -1", http.StatusBadRequest, "INVALID_ARGUMENT"},
+		{`GET \"k`, http.StatusBadRequest, "SYNTAX_ERROR"},
+		{"EXEC", http.StatusBadRequest, "INVALID_STATE"},
+	}
+	for _, step := range steps {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"command": "`+step.Command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		var reply handlers.Reply
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != step.Status || reply.Type != handlers.ReplyError || reply.Code != step.Code {
+			t.Errorf("%q: expected %d %s, got %d %+v", step.Command, step.Status, step.Code, resp.StatusCode, reply)
+		}
+	}
+
+	// the REST routes answer the same codes
+	req, _ := http.NewRequest("PUT", server.URL+"/keys/k", strings.NewReader("w"))
+	req.Header.Set("If-Match", `"999999"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var response handlers.ResponseError
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+	if resp.StatusCode != http.StatusPreconditionFailed || response.Code != "PRECONDITION_FAILED" {
+		t.Errorf("Expected a failed precondition, got %d %+v", resp.StatusCode, response)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	db := database.NewDatabase()
+	db.Set("k", "v", 0, "")
+
+	if err := db.Set("k", "w", 0, "NX"); !errors.Is(err, database.ErrConditionFailed) || err != database.ErrKeyExists {
+		t.Errorf("Expected a failed condition, got %v", err)
+	}
+	if _, err := db.CompareAndSet("k", database.KeyValuePair{Value: "w"}, 999999); !errors.Is(err, database.ErrConditionFailed) {
+		t.Errorf("Expected a failed condition, got %v", err)
+	}
+	if _, _, err := commandparser.ParseCommand(`GET "k`); !errors.Is(err, commandparser.ErrSyntax) {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+
+	for _, test := range []struct {
+		err  error
+		code string
+	}{
+		{database.ErrRevisionMismatch, "CONDITION_FAILED"},
+		{commandparser.InvalidArgument("invalid count"), "INVALID_ARGUMENT"},
+		{database.ErrOutOfMemory, "OUT_OF_MEMORY"},
+		{errors.New("something else"), "INTERNAL"},
+	} {
+		if code := handlers.LookupErrorCode(test.err); code.Code != test.code {
+			t.Errorf("Expected %v to have code %s, got %s", test.err, test.code, code.Code)
+		}
+	}
+}
+
+func TestErrorCodeTableIsGenerated(t *testing.T) {
+	readme, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Fatalf("Failed to read the README: %v", err)
+	}
+	if !strings.Contains(string(readme), "<!-- BEGIN ERROR CODES -->\n"+handlers.ErrorCodeTable()+"<!-- END ERROR CODES -->") {
+		t.Errorf("The error code table of the README is stale, run go generate ./handlers")
+	}
+}
@@ -0,0 +1,100 @@
+package handlers_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestKeyspaceEvents(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/keyspace/events?class=bogus"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid class to be rejected, got %v %v", resp.Status, err)
+	}
+
+	resp, err := http.Get(server.URL + "/keyspace/events?pattern=user:*&class=string&class=expired&class=queue")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	db.Set("user:1", "alice", time.Second, "")
+	db.Set("order:1", "ignored by pattern", 0, "")
+	db.QPush("user:queue", []string{"a"})
+	db.Delete("user:queue") // generic class is not subscribed
+
+	expected := []struct {
+		Key   string
+		Op    string
+		Class string
+		TTL   bool
+	}{
+		{"user:1", "set", "string", true},
+		{"user:queue", "qpush", "queue", false},
+		{"user:1", "expired", "expired", false},
+	}
+	for _, want := range expected {
+		var event handlers.ResponseEvent
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &event); err != nil {
+					t.Fatalf("Could not decode event data %q: %v", line, err)
+				}
+				break
+			}
+		}
+		if event.Key != want.Key || event.Op != want.Op || event.Class != want.Class || (event.TTL > 0) != want.TTL {
+			t.Errorf("Expected %+v, got %+v", want, event)
+		}
+		if event.Revision == 0 {
+			t.Errorf("Expected event %+v to carry a revision", event)
+		}
+	}
+}
+
+func TestKeyspaceEventsNeverBlockWrites(t *testing.T) {
+	db := database.NewDatabase()
+	sub := db.SubscribeEvents("", nil)
+
+	// nobody reads the subscription, yet every write must complete
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10*database.DefaultEventBufferSize; i++ {
+			db.Set(fmt.Sprint("key", i), "value", 0, "")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Writes blocked on an unread event subscription")
+	}
+	select {
+	case <-sub.Done():
+		if !sub.Slow() {
+			t.Errorf("Expected the subscription to be marked slow")
+		}
+	default:
+		t.Errorf("Expected the overflowing subscription to be disconnected")
+	}
+}
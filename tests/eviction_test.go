@@ -0,0 +1,176 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// the accounted size of a key of two bytes holding a value of one byte
+const smallEntry = 64 + 2 + 1
+
+func TestNoEviction(t *testing.T) {
+	db := database.NewDatabase()
+	db.SetMaxMemory(2*smallEntry, database.NoEviction)
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	for _, command := range []string{"SET k1 v", "SET k2 v", "SET k1 w"} {
+		body, _ := json.Marshal(handlers.RequestBody{Command: command})
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected %q to fit, got status %d", command, resp.StatusCode)
+		}
+	}
+
+	for _, command := range []string{"SET k3 v", "QPUSH k1 more"} {
+		body, _ := json.Marshal(handlers.RequestBody{Command: command})
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		var response Response
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInsufficientStorage || response.Error != database.ErrOutOfMemory.Error() {
+			t.Errorf("Expected %q to run out of memory, got %d %+v", command, resp.StatusCode, response)
+		}
+	}
+
+	// deleting frees the memory again
+	db.Delete("k1")
+	if err := db.Set("k3", "v", 0, ""); err != nil {
+		t.Errorf("Expected k3 to fit after a delete, got %v", err)
+	}
+	db.Delete("k2")
+	db.Delete("k3")
+	if used := db.MemoryUsage(); used != 0 {
+		t.Errorf("Expected no memory in use, got %d", used)
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	// each case fills the database with k1..k4, and the next write must evict want
+	tests := []struct {
+		policy database.EvictionPolicy
+		// called once all keys are written
+		access func(db *database.Database)
+		want   string
+	}{
+		{
+			policy: database.AllKeysLRU,
+			access: func(db *database.Database) {
+				db.Get("k1")
+			},
+			want: "k2",
+		},
+		{
+			policy: database.AllKeysLFU,
+			access: func(db *database.Database) {
+				for _, key := range []string{"k1", "k2", "k4"} {
+					for i := 0; i < 1000; i++ {
+						db.Get(key)
+					}
+				}
+			},
+			want: "k3",
+		},
+		{
+			policy: database.VolatileTTL,
+			want:   "k3",
+		},
+		{
+			policy: database.VolatileLRU,
+			access: func(db *database.Database) {
+				db.Get("k2")
+			},
+			want: "k3",
+		},
+	}
+
+	for _, test := range tests {
+		db := database.NewDatabase()
+		db.SetMaxMemory(4*smallEntry, test.policy)
+		db.Set("k1", "v", 0, "")
+		db.Set("k2", "v", time.Hour, "")
+		db.Set("k3", "v", time.Minute, "")
+		db.Set("k4", "v", 0, "")
+		time.Sleep(time.Millisecond)
+		if test.access != nil {
+			test.access(db)
+		}
+
+		sub := db.SubscribeEvents("", []database.EventClass{database.ClassEvicted})
+		if err := db.Set("k5", "v", 0, ""); err != nil {
+			t.Errorf("%s: expected k5 to be stored, got %v", test.policy, err)
+			continue
+		}
+		if _, err := db.Get(test.want); err != database.ErrNotFound {
+			t.Errorf("%s: expected %s to be evicted", test.policy, test.want)
+		}
+		select {
+		case event := <-sub.Events():
+			if event.Key != test.want || event.Op != "evicted" {
+				t.Errorf("%s: unexpected event %+v", test.policy, event)
+			}
+		default:
+			t.Errorf("%s: expected an evicted event", test.policy)
+		}
+		if used := db.MemoryUsage(); used > 4*smallEntry {
+			t.Errorf("%s: expected at most %d bytes in use, got %d", test.policy, 4*smallEntry, used)
+		}
+	}
+}
+
+func TestEvictionWithoutCandidates(t *testing.T) {
+	db := database.NewDatabase()
+	db.SetMaxMemory(2*smallEntry, database.VolatileLRU)
+	db.Set("k1", "v", 0, "")
+	db.Set("k2", "v", 0, "")
+
+	// no key has an expiration, so there is nothing to evict
+	if err := db.Set("k3", "v", 0, ""); err != database.ErrOutOfMemory {
+		t.Errorf("Expected an out of memory error, got %v", err)
+	}
+
+	// an expiration set in place makes a key a candidate, removing it does not
+	db.Touch("k1", time.Now().Add(time.Hour))
+	db.Touch("k1", time.Time{})
+	db.Touch("k2", time.Now().Add(time.Hour))
+	if err := db.Set("k3", "v", 0, ""); err != nil {
+		t.Errorf("Expected k3 to be stored, got %v", err)
+	}
+	if _, err := db.Get("k2"); err != database.ErrNotFound {
+		t.Errorf("Expected k2 to be evicted")
+	}
+	db.Delete("k3")
+
+	// a value larger than the limit never fits, even in an empty database
+	db.SetMaxMemory(2*smallEntry, database.AllKeysRandom)
+	if err := db.Set("big", string(make([]byte, 3*smallEntry)), 0, ""); err != database.ErrOutOfMemory {
+		t.Errorf("Expected an out of memory error, got %v", err)
+	}
+
+	// lowering the limit evicts right away
+	db.SetMaxMemory(smallEntry, database.AllKeysRandom)
+	if used := db.MemoryUsage(); used > smallEntry {
+		t.Errorf("Expected at most %d bytes in use, got %d", smallEntry, used)
+	}
+
+	if _, err := database.ParseEvictionPolicy("bogus"); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+}
@@ -54,7 +54,7 @@ func TestSetAndGetCommands(t *testing.T) {
 		// Valid SET command with condition NX for non-existing key
 		{
 			Command:  `SET hello key NX`,
-			Status:   http.StatusBadRequest,
+			Status:   http.StatusConflict,
 			ExpValue: "",
 			ExpError: true,
 			ErrValue: "key already exists",
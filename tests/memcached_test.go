@@ -0,0 +1,116 @@
+package handlers_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/memcached"
+)
+
+func TestMemcachedProtocol(t *testing.T) {
+	db := database.NewDatabase()
+	server := &memcached.Server{
+		Database: db,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// send the request and read back as many lines as expected
+	send := func(request string, lines int) string {
+		if _, err := fmt.Fprint(conn, request); err != nil {
+			t.Fatalf("Failed to send %q: %v", request, err)
+		}
+		var response []string
+		for i := 0; i < lines; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read response to %q: %v", request, err)
+			}
+			response = append(response, strings.TrimRight(line, "\r\n"))
+		}
+		return strings.Join(response, "|")
+	}
+
+	testCases := []struct {
+		Request  string
+		Lines    int
+		Expected string
+	}{
+		{"set hello 42 0 11\r\nhello world\r\n", 1, "STORED"},
+		{"get hello missing\r\n", 3, "VALUE hello 42 11|hello world|END"},
+		{"add hello 0 0 1\r\nx\r\n", 1, "NOT_STORED"},
+		{"replace missing 0 0 1\r\nx\r\n", 1, "NOT_STORED"},
+		{"replace hello 7 0 3\r\nbye\r\n", 1, "STORED"},
+		{"get hello\r\n", 3, "VALUE hello 7 3|bye|END"},
+		{"set counter 0 0 2\r\n10\r\n", 1, "STORED"},
+		{"incr counter 5\r\n", 1, "15"},
+		{"decr counter 100\r\n", 1, "0"},
+		{"incr hello 1\r\n", 1, "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr missing 1\r\n", 1, "NOT_FOUND"},
+		{"touch hello 100\r\n", 1, "TOUCHED"},
+		{"touch missing 100\r\n", 1, "NOT_FOUND"},
+		{"delete counter\r\n", 1, "DELETED"},
+		{"delete counter\r\n", 1, "NOT_FOUND"},
+		{"set gone 0 -1 1\r\nx\r\n", 1, "STORED"},
+		{"get gone\r\n", 1, "END"},
+		{"set short 0 0 2\r\nabcd\r\n", 1, "CLIENT_ERROR bad data chunk"},
+		{"bogus\r\n", 1, "ERROR"},
+	}
+
+	for _, testCase := range testCases {
+		response := send(testCase.Request, testCase.Lines)
+		if response != testCase.Expected {
+			t.Errorf("Request %q: expected %q, got %q", testCase.Request, testCase.Expected, response)
+		}
+	}
+
+	// cas only succeeds with the unique returned by gets
+	item, err := db.GetItem("hello")
+	if err != nil {
+		t.Fatalf("Expected hello to exist: %v", err)
+	}
+	expected := fmt.Sprintf("VALUE hello 7 3 %d|bye|END", item.Revision)
+	if response := send("gets hello\r\n", 3); response != expected {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+	if response := send(fmt.Sprintf("cas hello 0 0 3 %d\r\nnew\r\n", item.Revision+1000), 1); response != "EXISTS" {
+		t.Errorf("Expected EXISTS for stale cas, got %q", response)
+	}
+	if response := send(fmt.Sprintf("cas hello 0 0 3 %d\r\nnew\r\n", item.Revision), 1); response != "STORED" {
+		t.Errorf("Expected STORED for current cas, got %q", response)
+	}
+	if response := send("cas missing 0 0 1 1\r\nx\r\n", 1); response != "NOT_FOUND" {
+		t.Errorf("Expected NOT_FOUND for missing cas, got %q", response)
+	}
+
+	// queues are not values and read as misses, even among other keys
+	if err := db.QPush("jobs", []string{"a", "b"}); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+	if response := send("get jobs\r\n", 1); response != "END" {
+		t.Errorf("Expected a queue to read as a miss, got %q", response)
+	}
+	if response := send("gets jobs quiet hello\r\n", 3); !strings.HasPrefix(response, "VALUE hello 0 3 ") || !strings.HasSuffix(response, "|new|END") {
+		t.Errorf("Expected only hello among a queue and a missing key, got %q", response)
+	}
+
+	// noreply suppresses the response entirely
+	send("set quiet 0 0 1 noreply\r\nq\r\n", 0)
+	if response := send("get quiet\r\n", 3); response != "VALUE quiet 0 1|q|END" {
+		t.Errorf("Expected quiet to be stored, got %q", response)
+	}
+}
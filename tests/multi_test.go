@@ -0,0 +1,101 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestMultiKeyCommands(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	steps := []struct {
+		Command  string
+		Status   int
+		Response string
+	}{
+		{"MSET a 1 b 2", http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"MGET a missing b", http.StatusOK, `{"type":"array","value":[{"type":"string","value":"1"},{"type":"null"},{"type":"string","value":"2"}]}`},
+		// MSETNX sets nothing if any key exists
+		{"MSETNX c 3 a 9", http.StatusOK, `{"type":"integer","value":0}`},
+		{"MGET c a", http.StatusOK, `{"type":"array","value":[{"type":"null"},{"type":"string","value":"1"}]}`},
+		{"MSETNX c 3 d 4", http.StatusOK, `{"type":"integer","value":2}`},
+		{"MGET c d", http.StatusOK, `{"type":"array","value":[{"type":"string","value":"3"},{"type":"string","value":"4"}]}`},
+		// the last value of a repeated key wins
+		{"MSET e 1 e 2", http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"GET e", http.StatusOK, `{"type":"string","value":"2"}`},
+		{"MSET a", http.StatusBadRequest, `{"type":"error","error":"invalid command","code":"INVALID_COMMAND"}`},
+		{"MSETNX a 1 b", http.StatusBadRequest, `{"type":"error","error":"invalid command","code":"INVALID_COMMAND"}`},
+		{"MGET", http.StatusBadRequest, `{"type":"error","error":"invalid command","code":"INVALID_COMMAND"}`},
+	}
+	for _, step := range steps {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"command": "`+step.Command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.TrimSpace(string(body)); resp.StatusCode != step.Status || got != step.Response {
+			t.Errorf("%q: expected %d %s, got %d %s", step.Command, step.Status, step.Response, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestMSetIsAllOrNothingWhenOutOfMemory(t *testing.T) {
+	db := database.NewDatabase()
+	db.SetMaxMemory(2*smallEntry, database.NoEviction)
+
+	entries := []database.Entry{
+		{Key: "k1", Item: database.KeyValuePair{Value: "v"}},
+		{Key: "k2", Item: database.KeyValuePair{Value: "v"}},
+		{Key: "k3", Item: database.KeyValuePair{Value: "v"}},
+	}
+	if err := db.MSet(entries); err != database.ErrOutOfMemory {
+		t.Errorf("Expected an out of memory error, got %v", err)
+	}
+	if stored, err := db.MSetNX(entries); stored || err != database.ErrOutOfMemory {
+		t.Errorf("Expected an out of memory error, got %v %v", stored, err)
+	}
+	if keys := db.Keys("*"); len(keys) != 0 {
+		t.Errorf("Expected no key to be stored, got %v", keys)
+	}
+}
+
+func TestMSetNeverEvictsItsOwnKeys(t *testing.T) {
+	db := database.NewDatabase()
+	db.SetMaxMemory(2*smallEntry, database.AllKeysLRU)
+	db.Set("k1", "v", 0, "")
+	db.Set("k2", "v", 0, "")
+	time.Sleep(time.Millisecond)
+	db.Get("k2")
+
+	// k1 is the least recently used key, but it is part of the batch, which
+	// only counts the last entry of k3
+	err := db.MSet([]database.Entry{
+		{Key: "k1", Item: database.KeyValuePair{Value: "w"}},
+		{Key: "k3", Item: database.KeyValuePair{Value: string(make([]byte, smallEntry))}},
+		{Key: "k3", Item: database.KeyValuePair{Value: "w"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected the batch to fit, got %v", err)
+	}
+	for key, want := range map[string]string{"k1": "w", "k3": "w"} {
+		if value, err := db.Get(key); value != want {
+			t.Errorf("Expected %s to hold %s, got %q %v", key, want, value, err)
+		}
+	}
+	if _, err := db.Get("k2"); err != database.ErrNotFound {
+		t.Errorf("Expected k2 to be evicted")
+	}
+}
@@ -0,0 +1,240 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestNamespaces(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send a command to the path with the given headers and return the status and raw response
+	send := func(path, command string, headers map[string]string) (int, string) {
+		req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(`{"command": "`+command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+	inTeam := func(team string) map[string]string {
+		return map[string]string{"X-Namespace": team}
+	}
+
+	// the same key lives separately in each namespace
+	send("/", "SET owner default", nil)
+	send("/", "SET owner red", inTeam("red"))
+	send("/ns/blue/", "SET owner blue", nil)
+
+	steps := []struct {
+		Path     string
+		Command  string
+		Headers  map[string]string
+		Status   int
+		Response string
+	}{
+		{"/", "GET owner", nil, http.StatusOK, `{"type":"string","value":"default"}`},
+		{"/", "GET owner", inTeam("red"), http.StatusOK, `{"type":"string","value":"red"}`},
+		{"/", "GET owner", inTeam("blue"), http.StatusOK, `{"type":"string","value":"blue"}`},
+		{"/ns/red/", "GET owner", nil, http.StatusOK, `{"type":"string","value":"red"}`},
+		// the path wins over the header
+		{"/ns/red/", "GET owner", inTeam("blue"), http.StatusOK, `{"type":"string","value":"red"}`},
+		{"/", "GET owner", inTeam("bad name"), http.StatusBadRequest, `{"type":"error","error":"invalid namespace name","code":"INVALID_NAMESPACE"}`},
+
+		// FLUSHDB only empties one namespace
+		{"/", "FLUSHDB", inTeam("red"), http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"/", "GET owner", inTeam("red"), http.StatusNotFound, `{"type":"error","error":"key not found","code":"NOT_FOUND"}`},
+		{"/", "GET owner", nil, http.StatusOK, `{"type":"string","value":"default"}`},
+
+		// SWAPDB exchanges the keys of two namespaces
+		{"/", "SWAPDB default blue", nil, http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"/", "GET owner", nil, http.StatusOK, `{"type":"string","value":"blue"}`},
+		{"/", "GET owner", inTeam("blue"), http.StatusOK, `{"type":"string","value":"default"}`},
+		{"/", "SWAPDB default bad/name", nil, http.StatusBadRequest, `{"type":"error","error":"invalid namespace name","code":"INVALID_NAMESPACE"}`},
+	}
+	for _, step := range steps {
+		status, response := send(step.Path, step.Command, step.Headers)
+		if status != step.Status || response != step.Response {
+			t.Errorf("%s %q %v: expected %d %s, got %d %s", step.Path, step.Command, step.Headers, step.Status, step.Response, status, response)
+		}
+	}
+
+	// the memcached server keeps using the default database, which now holds the swapped keys
+	if value, _ := db.Get("owner"); value != "blue" {
+		t.Errorf("Expected the default database to hold blue, got %q", value)
+	}
+
+	// SELECT switches the namespace for the rest of a batch
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(
+		`[{"command": "SELECT green"}, {"command": "SET owner green"}, {"command": "GET owner"}, {"command": "SELECT default"}, {"command": "GET owner"}]`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := strings.TrimSpace(string(body)); got != `[{"type":"string","value":"OK"},{"type":"string","value":"OK"},{"type":"string","value":"green"},{"type":"string","value":"OK"},{"type":"string","value":"blue"}]` {
+		t.Errorf("Unexpected batch response %s", got)
+	}
+
+	// every namespace keeps its own statistics
+	var info handlers.Reply
+	status, response := send("/", "INFO", inTeam("green"))
+	if err := json.Unmarshal([]byte(response), &info); err != nil || status != http.StatusOK || info.Type != handlers.ReplyMap {
+		t.Fatalf("Unexpected INFO response %d %s", status, response)
+	}
+	stats := info.Value.(map[string]handlers.Reply)
+	if stats["keys"].Value != int64(1) || stats["hits"].Value != int64(1) || stats["misses"].Value != int64(0) {
+		t.Errorf("Unexpected statistics of green %s", response)
+	}
+
+	resp, err = http.Get(server.URL + "/namespaces")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var all map[string]handlers.ResponseStats
+	if err := json.NewDecoder(resp.Body).Decode(&all); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+	for _, name := range []string{"default", "red", "blue", "green"} {
+		if _, exists := all[name]; !exists {
+			t.Errorf("Expected namespace %s to be listed, got %v", name, all)
+		}
+	}
+	if all["red"].Keys != 0 || all["default"].Keys != 1 {
+		t.Errorf("Unexpected key counts %+v", all)
+	}
+}
+
+func TestSwapAbortsWatchingTransactions(t *testing.T) {
+	db := database.NewDatabase()
+	namespaces := database.NewNamespaces(db)
+	other, _ := namespaces.Get("other")
+	db.Set("config", "v1", 0, "")
+	other.Set("config", "v2", 0, "")
+
+	watched := map[string]uint64{"config": db.Revision("config")}
+	if err := namespaces.Swap(database.DefaultNamespace, "other"); err != nil {
+		t.Fatalf("Failed to swap: %v", err)
+	}
+	err := db.Atomic(watched, func(tx *database.Tx) {
+		tx.Set("config", "v3", 0, "")
+	})
+	if err != database.ErrTxAborted {
+		t.Errorf("Expected the transaction to abort after the swap, got %v", err)
+	}
+}
+
+func TestNamespaceCreation(t *testing.T) {
+	cfg := config.Default()
+	cfg.NamespacesPerClient = 2
+	handler := &handlers.HTTPHandler{Database: database.NewDatabase(), Config: cfg}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// reads answer as if the namespace were empty without creating it
+	if status, reply := sendCommand(t, server.URL+"/ns/ghost/", "GET owner"); status != http.StatusNotFound || reply.Code != "NOT_FOUND" {
+		t.Errorf("GET: expected 404 NOT_FOUND, got %d %+v", status, reply)
+	}
+	if status, reply := sendCommand(t, server.URL+"/ns/ghost/", "INFO"); status != http.StatusOK || replyInt(replyField(reply, "keys")) != 0 {
+		t.Errorf("INFO: expected an empty namespace, got %d %+v", status, reply)
+	}
+	resp, err := http.Get(server.URL + "/ns/ghost/keys/owner")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /keys: expected 404, got %d", resp.StatusCode)
+	}
+	// watches and event streams cannot wait on a namespace that does not exist
+	for _, path := range []string{"/ns/ghost/watch?key=owner&timeout=1", "/ns/ghost/keyspace/events"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		var response handlers.ResponseError
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || response.Code != "NAMESPACE_NOT_FOUND" {
+			t.Errorf("GET %s: expected 404 NAMESPACE_NOT_FOUND, got %d %+v", path, resp.StatusCode, response)
+		}
+	}
+	if names := handler.Namespaces.Names(); len(names) != 1 {
+		t.Errorf("Expected reads to create no namespace, got %v", names)
+	}
+
+	// writes create namespaces up to the limit of the client
+	for _, name := range []string{"a", "b"} {
+		if status, reply := sendCommand(t, server.URL+"/ns/"+name+"/", "SET owner "+name); status != http.StatusOK {
+			t.Errorf("SET in %s: expected 200, got %d %+v", name, status, reply)
+		}
+	}
+	if status, reply := sendCommand(t, server.URL+"/ns/c/", "SET owner c"); status != http.StatusForbidden || reply.Code != "NAMESPACE_QUOTA" {
+		t.Errorf("SET in c: expected 403 NAMESPACE_QUOTA, got %d %+v", status, reply)
+	}
+	if status, reply := sendCommand(t, server.URL, "SWAPDB a c"); status != http.StatusForbidden || reply.Code != "NAMESPACE_QUOTA" {
+		t.Errorf("SWAPDB: expected 403 NAMESPACE_QUOTA, got %d %+v", status, reply)
+	}
+	// existing namespaces can still be written
+	if status, reply := sendCommand(t, server.URL+"/ns/a/", "SET owner again"); status != http.StatusOK {
+		t.Errorf("SET in a: expected 200, got %d %+v", status, reply)
+	}
+
+	// the limit changes at runtime
+	sendCommand(t, server.URL, "CONFIG SET namespaces-per-client 3")
+	if status, reply := sendCommand(t, server.URL+"/ns/c/", "SET owner c"); status != http.StatusOK {
+		t.Errorf("SET in c: expected 200 after raising the limit, got %d %+v", status, reply)
+	}
+}
+
+func TestNamespacesShareMemoryLimit(t *testing.T) {
+	db := database.NewDatabase()
+	namespaces := database.NewNamespaces(db)
+	other, _ := namespaces.Get("other")
+	db.SetMaxMemory(2*smallEntry, database.NoEviction)
+
+	db.Set("k1", "v", 0, "")
+	if err := other.Set("k1", "v", 0, ""); err != nil {
+		t.Fatalf("Expected k1 to fit in other, got %v", err)
+	}
+	if err := other.Set("k2", "v", 0, ""); err != database.ErrOutOfMemory {
+		t.Errorf("Expected the limit to count the keys of both namespaces, got %v", err)
+	}
+
+	// a write only evicts keys of its own namespace
+	db.SetMaxMemory(2*smallEntry, database.AllKeysRandom)
+	if err := other.Set("k2", "v", 0, ""); err != nil {
+		t.Errorf("Expected k2 to evict k1 of other, got %v", err)
+	}
+	if _, err := db.Get("k1"); err != nil {
+		t.Errorf("Expected k1 of the default namespace to stay, got %v", err)
+	}
+
+	// flushing gives the memory back to every namespace
+	other.Flush()
+	if err := db.Set("k2", "v", 0, ""); err != nil {
+		t.Errorf("Expected k2 to fit after the flush, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestOrderedCommands(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send a command with structured arguments and decode the response into v
+	send := func(command string, args []string, v interface{}) int {
+		body, _ := json.Marshal(handlers.RequestBody{Command: command, Args: args})
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return resp.StatusCode
+	}
+	keysOf := func(response handlers.Reply) []string {
+		entries, _ := response.Value.([]handlers.Reply)
+		keys := []string{}
+		for _, entry := range entries {
+			key, _ := replyField(entry, "key").Value.(string)
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	for _, key := range []string{"user:42:name", "user:42:email", "user:42:age", "user:420", "user:43:name", "order:1"} {
+		db.Set(key, "value of "+key, 0, "")
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"user:42:", "user:42;"}, []string{"user:42:age", "user:42:email", "user:42:name"}},
+		{[]string{"user:42:", "user:42;", "REV"}, []string{"user:42:name", "user:42:email", "user:42:age"}},
+		{[]string{"user:", "", "LIMIT", "2"}, []string{"user:420", "user:42:age"}},
+		{[]string{"", "user:", "REV", "LIMIT", "1"}, []string{"order:1"}},
+		{[]string{"user:43:name", ""}, []string{"user:43:name"}},
+		{[]string{"z", ""}, []string{}},
+	}
+	for _, test := range tests {
+		var response handlers.Reply
+		if status := send("RANGE", test.args, &response); status != http.StatusOK {
+			t.Fatalf("RANGE %q: expected status 200, got %d", test.args, status)
+		}
+		if keys := keysOf(response); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("RANGE %q: expected %v, got %v", test.args, test.want, keys)
+		}
+	}
+
+	var entries handlers.Reply
+	send("RANGE", []string{"order:", "order;"}, &entries)
+	if items, _ := entries.Value.([]handlers.Reply); len(items) != 1 || replyField(items[0], "value").Value != "value of order:1" {
+		t.Errorf("Expected the value of order:1, got %+v", entries)
+	}
+
+	var count handlers.Reply
+	send("PREFIXCOUNT", []string{"user:42"}, &count)
+	if replyInt(count) != 4 {
+		t.Errorf("Expected 4 keys with prefix user:42, got %+v", count)
+	}
+
+	send("PREFIXDEL", []string{"user:42:", "LIMIT", "2"}, &count)
+	if replyInt(count) != 2 {
+		t.Errorf("Expected 2 deleted keys, got %+v", count)
+	}
+	send("PREFIXDEL", []string{"user:42:"}, &count)
+	if replyInt(count) != 1 {
+		t.Errorf("Expected 1 deleted key, got %+v", count)
+	}
+	if keys := db.Keys("user:*"); !reflect.DeepEqual(keys, []string{"user:420", "user:43:name"}) {
+		t.Errorf("Unexpected keys left %v", keys)
+	}
+
+	for _, args := range [][]string{{"a"}, {"a", "b", "LIMIT"}, {"a", "b", "LIMIT", "-1"}, {"a", "b", "UP"}} {
+		var response Response
+		if status := send("RANGE", args, &response); status != http.StatusBadRequest {
+			t.Errorf("RANGE %q: expected status 400, got %d", args, status)
+		}
+	}
+	var response Response
+	if status := send("PREFIXDEL", []string{"a", "REV"}, &response); status != http.StatusBadRequest {
+		t.Errorf("Expected PREFIXDEL with REV to be rejected, got %d", status)
+	}
+}
+
+func TestOrderedIndexStaysSorted(t *testing.T) {
+	db := database.NewDatabase()
+	random := rand.New(rand.NewSource(1))
+	present := make(map[string]bool)
+
+	// enough keys to split and merge nodes many times over
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key:%05d", random.Intn(5000))
+		if random.Intn(3) == 0 {
+			db.Delete(key)
+			delete(present, key)
+		} else {
+			db.Set(key, "v", 0, "")
+			present[key] = true
+		}
+	}
+
+	want := []string{}
+	for key := range present {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	var got []string
+	for _, entry := range db.Range("", "", 0, false) {
+		got = append(got, entry.Key)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %d keys in order, got %d", len(want), len(got))
+	}
+
+	got = got[:0]
+	for _, entry := range db.Range("", "", 0, true) {
+		got = append(got, entry.Key)
+	}
+	for i := range got {
+		if got[i] != want[len(want)-1-i] {
+			t.Fatalf("Expected reverse order at %d: %s, got %s", i, want[len(want)-1-i], got[i])
+		}
+	}
+
+	if n := db.CountPrefix("key:01"); n != countPrefix(want, "key:01") {
+		t.Errorf("Expected %d keys with prefix key:01, got %d", countPrefix(want, "key:01"), n)
+	}
+	db.DeletePrefix("key:", 0)
+	if entries := db.Range("", "", 0, false); len(entries) != 0 {
+		t.Errorf("Expected no keys left, got %d", len(entries))
+	}
+}
+
+func countPrefix(keys []string, prefix string) int {
+	n := 0
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			n++
+		}
+	}
+	return n
+}
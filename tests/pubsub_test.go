@@ -0,0 +1,147 @@
+package handlers_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/glob"
+	"github.com/7dpk/keyvaluestore/handlers"
+	"github.com/7dpk/keyvaluestore/pubsub"
+)
+
+func TestGlobMatch(t *testing.T) {
+	testCases := []struct {
+		Pattern string
+		Input   string
+		Matches bool
+	}{
+		{"*", "anything/at:all", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "weather.today", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{"key[0-9]", "keyx", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*:*:end", "user:42:x:end", true},
+		{"[unterminated", "u", false},
+	}
+
+	for _, testCase := range testCases {
+		if glob.Match(testCase.Pattern, testCase.Input) != testCase.Matches {
+			t.Errorf("Match(%q, %q): expected %v", testCase.Pattern, testCase.Input, testCase.Matches)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// publish and return the reported number of subscribers
+	publish := func(channel, message string) int {
+		body := `{"command": "PUBLISH", "args": ["` + channel + `", "` + message + `"]}`
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		var response handlers.Reply
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return int(replyInt(response))
+	}
+
+	if n := publish("news.sport", "nobody listens"); n != 0 {
+		t.Errorf("Expected no subscribers, got %d", n)
+	}
+
+	resp, err := http.Get(server.URL + "/subscribe?channel=alerts&pattern=news.*")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(resp.Body)
+
+	// read the next event and decode its data
+	next := func() pubsub.Message {
+		var message pubsub.Message
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &message); err != nil {
+					t.Fatalf("Could not decode event data %q: %v", line, err)
+				}
+				return message
+			}
+		}
+	}
+
+	if n := publish("news.sport", "goal"); n != 1 {
+		t.Errorf("Expected 1 subscriber, got %d", n)
+	}
+	if n := publish("weather", "rain"); n != 0 {
+		t.Errorf("Expected no subscribers for weather, got %d", n)
+	}
+	if n := publish("alerts", "fire"); n != 1 {
+		t.Errorf("Expected 1 subscriber, got %d", n)
+	}
+
+	expected := []pubsub.Message{
+		{Channel: "news.sport", Pattern: "news.*", Payload: "goal"},
+		{Channel: "alerts", Payload: "fire"},
+	}
+	for _, want := range expected {
+		if got := next(); got != want {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	broker := pubsub.NewBroker(2)
+	slow := broker.Subscribe([]string{"c"}, nil)
+	fast := broker.Subscribe(nil, []string{"*"})
+
+	for i := 0; i < 2; i++ {
+		if n := broker.Publish("c", "m"); n != 2 {
+			t.Fatalf("Expected 2 receivers, got %d", n)
+		}
+		<-fast.Messages()
+	}
+
+	// the third message overflows the slow subscriber's buffer
+	if n := broker.Publish("c", "m"); n != 1 {
+		t.Errorf("Expected only the fast subscriber to receive, got %d", n)
+	}
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatalf("Expected the slow subscriber to be disconnected")
+	}
+	if !slow.Slow() {
+		t.Errorf("Expected the subscription to be marked slow")
+	}
+	if broker.Subscribers() != 1 {
+		t.Errorf("Expected 1 remaining subscriber, got %d", broker.Subscribers())
+	}
+}
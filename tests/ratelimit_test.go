@@ -0,0 +1,137 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+	"github.com/7dpk/keyvaluestore/ratelimit"
+)
+
+// send the request with the token, if any, as bearer token and return the response with its body read into reply
+func doAs(t *testing.T, method, url, token, body string, reply interface{}) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	if reply != nil {
+		json.NewDecoder(resp.Body).Decode(reply)
+	}
+	return resp
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimitWrite = ratelimit.Limit{Rate: 0.5, Burst: 2}
+	users := acl.New()
+	users.SetUser("default", "off")
+	users.SetUser("a", "on", ">a-token", "allkeys", "allcommands")
+	users.SetUser("b", "on", ">b-token", "allkeys", "allcommands")
+	handler := &handlers.HTTPHandler{Database: database.NewDatabase(), Config: cfg, ACL: users}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if status, reply := sendAs(t, server.URL, "a-token", "SET greeting hello"); status != http.StatusOK {
+			t.Fatalf("SET %d: expected 200 within the burst, got %d %+v", i, status, reply)
+		}
+	}
+	var reply handlers.Reply
+	resp := doAs(t, "POST", server.URL, "a-token", `{"command": "SET greeting hello"}`, &reply)
+	if resp.StatusCode != http.StatusTooManyRequests || reply.Code != "RATE_LIMITED" || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 RATE_LIMITED with Retry-After 2, got %d %+v %q", resp.StatusCode, reply, resp.Header.Get("Retry-After"))
+	}
+
+	// reads have their own budget and other tokens their own buckets
+	if status, _ := sendAs(t, server.URL, "a-token", "GET greeting"); status != http.StatusOK {
+		t.Errorf("GET: expected reads to be unlimited, got %d", status)
+	}
+	if status, _ := sendAs(t, server.URL, "b-token", "SET greeting hi"); status != http.StatusOK {
+		t.Errorf("SET as b: expected its own bucket, got %d", status)
+	}
+
+	// the routes are charged as their commands
+	resp = doAs(t, "PUT", server.URL+"/keys/greeting", "a-token", "hello", nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("PUT /keys: expected 429 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// a batch succeeds with the limited commands failing on their own
+	var replies []handlers.Reply
+	resp = doAs(t, "POST", server.URL+"/batch", "a-token", `[{"command": "GET greeting"}, {"command": "SET greeting hello"}]`, &replies)
+	if resp.StatusCode != http.StatusOK || len(replies) != 2 || replies[0].Code != "" || replies[1].Code != "RATE_LIMITED" || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Batch: expected only the SET to be limited, got %d %+v %v", resp.StatusCode, replies, resp.Header)
+	}
+
+	// limits change at runtime
+	if status, reply := sendAs(t, server.URL, "b-token", "CONFIG SET ratelimit-write 0"); status != http.StatusOK {
+		t.Fatalf("CONFIG SET: %d %+v", status, reply)
+	}
+	if status, _ := sendAs(t, server.URL, "a-token", "SET greeting hello"); status != http.StatusOK {
+		t.Errorf("SET: expected no limit after CONFIG SET, got %d", status)
+	}
+	if _, reply := sendAs(t, server.URL, "a-token", "CONFIG GET ratelimit-*"); replyField(reply, "ratelimit-write").Value != "0" {
+		t.Errorf("CONFIG GET: unexpected %+v", reply)
+	}
+	if status, reply := sendAs(t, server.URL, "a-token", "CONFIG SET ratelimit-read 10/0"); status != http.StatusBadRequest || reply.Code != "INVALID_VALUE" {
+		t.Errorf("CONFIG SET: expected a zero burst to be invalid, got %d %+v", status, reply)
+	}
+}
+
+func TestRateLimitWaiters(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimitWaiters = 1
+	handler := &handlers.HTTPHandler{Database: database.NewDatabase(), Config: cfg}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	sendCommand(t, server.URL, "QPUSH jobs a")
+	sendCommand(t, server.URL, "QPOP jobs")
+
+	done := make(chan handlers.Reply)
+	go func() {
+		_, reply := sendCommand(t, server.URL, "BQPOP jobs 5")
+		done <- reply
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	var reply handlers.Reply
+	resp := doAs(t, "POST", server.URL, "", `{"command": "BQPOP jobs 0.1"}`, &reply)
+	if resp.StatusCode != http.StatusTooManyRequests || reply.Code != "TOO_MANY_WAITERS" || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected a second BQPOP to get 429 TOO_MANY_WAITERS, got %d %+v %v", resp.StatusCode, reply, resp.Header)
+	}
+	resp = doAs(t, "POST", server.URL+"/queues/jobs/bpop?timeout=0.1", "", "", nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected the bpop route to share the cap, got %d", resp.StatusCode)
+	}
+	// other commands are not capped
+	if status, _ := sendCommand(t, server.URL, "QPUSH jobs b"); status != http.StatusOK {
+		t.Errorf("QPUSH: expected 200, got %d", status)
+	}
+
+	select {
+	case reply := <-done:
+		if reply.Value != "b" {
+			t.Errorf("Expected the waiting BQPOP to get b, got %+v", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("BQPOP did not return")
+	}
+	// the slot is given back once the command returns
+	if status, reply := sendCommand(t, server.URL, "BQPOP jobs 0.01"); status != http.StatusOK {
+		t.Errorf("Expected the slot to be free again, got %d %+v", status, reply)
+	}
+}
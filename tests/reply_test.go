@@ -0,0 +1,190 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// return the strings of an array reply
+func replyStrings(reply handlers.Reply) []string {
+	items, _ := reply.Value.([]handlers.Reply)
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		value, _ := item.Value.(string)
+		values = append(values, value)
+	}
+	return values
+}
+
+// return a field of a map reply
+func replyField(reply handlers.Reply, name string) handlers.Reply {
+	fields, _ := reply.Value.(map[string]handlers.Reply)
+	return fields[name]
+}
+
+// return the value of an integer reply, zero for any other reply
+func replyInt(reply handlers.Reply) int64 {
+	value, _ := reply.Value.(int64)
+	return value
+}
+
+func TestTypedReplies(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	db.Set("a", "1", 0, "")
+	db.Set("empty", "", 0, "")
+	db.QPush("jobs", []string{"x"})
+	db.QPop("jobs")
+
+	steps := []struct {
+		Command  string
+		Status   int
+		Response string
+	}{
+		{"SET b 2", http.StatusOK, `{"type":"string","value":"OK"}`},
+		// an empty string still carries its value, unlike a missing one
+		{"GET empty", http.StatusOK, `{"type":"string","value":""}`},
+		{"GET missing", http.StatusNotFound, `{"type":"error","error":"key not found","code":"NOT_FOUND"}`},
+		{"STRLEN a", http.StatusOK, `{"type":"integer","value":1}`},
+		{"MGET a missing", http.StatusOK, `{"type":"array","value":[{"type":"string","value":"1"},{"type":"null"}]}`},
+		{"KEYS *", http.StatusOK, `{"type":"array","value":[{"type":"string","value":"a"},{"type":"string","value":"b"},{"type":"string","value":"empty"},{"type":"string","value":"jobs"}]}`},
+		{"SCAN 0 MATCH b", http.StatusOK, `{"type":"map","value":{"cursor":{"type":"string","value":"0"},"keys":{"type":"array","value":[{"type":"string","value":"b"}]}}}`},
+		{"RANGE a b", http.StatusOK, `{"type":"array","value":[{"type":"map","value":{"key":{"type":"string","value":"a"},"value":{"type":"string","value":"1"}}}]}`},
+		{"BQPOP jobs 0.01", http.StatusOK, `{"type":"null"}`},
+		{"QPOP jobs", http.StatusNotFound, `{"type":"error","error":"queue is empty","code":"QUEUE_EMPTY"}`},
+	}
+	for _, step := range steps {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"command": "`+step.Command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.TrimSpace(string(body)); resp.StatusCode != step.Status || got != step.Response {
+			t.Errorf("%q: expected %d %s, got %d %s", step.Command, step.Status, step.Response, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestLegacyResponses(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database:        db,
+		LegacyResponses: true,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send a command with the given response format header and return the raw response
+	send := func(command, format string) string {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"command": "`+command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		if format != "" {
+			req.Header.Set("X-Response-Format", format)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return strings.TrimSpace(string(body))
+	}
+
+	db.QPush("jobs", []string{"x"})
+	db.QPop("jobs")
+
+	steps := []struct {
+		Command  string
+		Format   string
+		Response string
+	}{
+		{"SET a 1", "", `{}`},
+		{"MGET a b", "", `{"values":["1",null]}`},
+		{"STRLEN a", "", `{"length":1}`},
+		{"BQPOP jobs 0.01", "", `{"value":""}`},
+		{"GET b", "", `{"error":"key not found","code":"NOT_FOUND"}`},
+		// the header overrides the handler setting either way
+		{"STRLEN a", "typed", `{"type":"integer","value":1}`},
+		{"STRLEN a", "legacy", `{"length":1}`},
+	}
+	for _, step := range steps {
+		if got := send(step.Command, step.Format); got != step.Response {
+			t.Errorf("%q with format %q: expected %s, got %s", step.Command, step.Format, step.Response, got)
+		}
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	reply := handlers.MapReply(map[string]handlers.Reply{
+		"name":  handlers.StringReply("x"),
+		"count": handlers.IntegerReply(3),
+		"ratio": handlers.FloatReply(0.5),
+		"tags":  handlers.ArrayReply(handlers.StringReply("a"), handlers.NullReply()),
+		"err":   handlers.ErrorReply("INTERNAL", "boom"),
+	})
+	data, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatalf("Failed to encode reply: %v", err)
+	}
+	var decoded handlers.Reply
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode reply: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, reply) {
+		t.Errorf("Expected %+v, got %+v", reply, decoded)
+	}
+	if err := json.Unmarshal([]byte(`{"type":"set"}`), &decoded); err == nil {
+		t.Errorf("Expected an unknown reply type to be rejected")
+	}
+}
+
+func TestTypedTransactionReplies(t *testing.T) {
+	server := httptest.NewServer(handlers.NewRouter(&handlers.HTTPHandler{
+		Database: database.NewDatabase(),
+	}))
+	defer server.Close()
+
+	// a transaction never blocks, so BQPOP on an empty queue is null right away
+	start := time.Now()
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(
+		`[{"command": "MULTI"}, {"command": "SET a 1"}, {"command": "STRLEN a"}, {"command": "QPUSH q x"}, {"command": "QPOP q"}, {"command": "BQPOP q 5"}, {"command": "EXEC"}]`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var replies []handlers.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&replies); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected the transaction not to block")
+	}
+	expected := handlers.ArrayReply(
+		handlers.StringReply("OK"),
+		handlers.IntegerReply(1),
+		handlers.StringReply("OK"),
+		handlers.StringReply("x"),
+		handlers.NullReply(),
+	)
+	if len(replies) != 7 || !reflect.DeepEqual(replies[6], expected) {
+		t.Errorf("Unexpected transaction replies %+v", replies)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestRESTRoutes(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send the request and return the status code and the body
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response body: %v", err)
+		}
+		return resp.StatusCode, string(responseBody)
+	}
+
+	testCases := []struct {
+		Method   string
+		Path     string
+		Body     string
+		Status   int
+		ExpValue string
+	}{
+		{"PUT", "/keys/greeting", "hello \"world\"\n", http.StatusCreated, ""},
+		{"GET", "/keys/greeting", "", http.StatusOK, "hello \"world\"\n"},
+		{"PUT", "/keys/greeting", "bye", http.StatusNoContent, ""},
+		{"PUT", "/keys/greeting?nx", "again", http.StatusConflict, ""},
+		{"PUT", "/keys/missing?xx", "value", http.StatusConflict, ""},
+		{"PUT", "/keys/greeting?ttl=abc", "value", http.StatusBadRequest, ""},
+		{"GET", "/keys/greeting", "", http.StatusOK, "bye"},
+		{"DELETE", "/keys/greeting", "", http.StatusNoContent, ""},
+		{"DELETE", "/keys/greeting", "", http.StatusNotFound, ""},
+		{"GET", "/keys/greeting", "", http.StatusNotFound, ""},
+		{"POST", "/queues/jobs/pop", "", http.StatusNotFound, ""},
+		{"POST", "/queues/jobs/push", "first job", http.StatusNoContent, ""},
+		{"POST", "/queues/jobs/push", "second job", http.StatusNoContent, ""},
+		{"POST", "/queues/jobs/pop", "", http.StatusOK, "second job"},
+		{"POST", "/queues/jobs/bpop?timeout=1", "", http.StatusOK, "first job"},
+		{"POST", "/queues/jobs/pop", "", http.StatusNoContent, ""},
+		{"POST", "/queues/jobs/bpop?timeout=0.2", "", http.StatusNoContent, ""},
+	}
+
+	for _, testCase := range testCases {
+		status, body := do(testCase.Method, testCase.Path, testCase.Body)
+		if status != testCase.Status {
+			t.Errorf("%s %s: expected status %d, got %d", testCase.Method, testCase.Path, testCase.Status, status)
+		}
+		if testCase.Status == http.StatusOK && body != testCase.ExpValue {
+			t.Errorf("%s %s: expected body %q, got %q", testCase.Method, testCase.Path, testCase.ExpValue, body)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestCompareAndSet(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleRequest))
+	defer server.Close()
+
+	// send the command and decode the response
+	send := func(command string) (int, handlers.Reply) {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"command": "`+command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		var response handlers.Reply
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return resp.StatusCode, response
+	}
+
+	// revision zero creates the key only if it is absent
+	status, created := send("CAS counter 0 1")
+	revision := replyInt(created)
+	if status != http.StatusOK || revision == 0 {
+		t.Fatalf("Expected CAS to create counter, got %d %+v", status, created)
+	}
+	if status, _ := send("CAS counter 0 1"); status != http.StatusConflict {
+		t.Errorf("Expected CAS with revision 0 on an existing key to conflict, got %d", status)
+	}
+
+	_, read := send("GET counter WITHREVISION")
+	if replyField(read, "value").Value != "1" || replyInt(replyField(read, "revision")) != revision {
+		t.Errorf("Expected value 1 at revision %d, got %+v", revision, read)
+	}
+
+	// a stale revision is rejected and the current one accepted
+	send("SET other x")
+	if status, _ := send(fmt.Sprintf("CAS counter %d 2", revision+100)); status != http.StatusConflict {
+		t.Errorf("Expected stale CAS to conflict, got %d", status)
+	}
+	status, updated := send(fmt.Sprintf("CAS counter %d 2 EX 100", revision))
+	if status != http.StatusOK || replyInt(updated) <= revision {
+		t.Errorf("Expected CAS to succeed with a newer revision, got %d %+v", status, updated)
+	}
+	if status, _ := send("CAS missing 5 x"); status != http.StatusNotFound {
+		t.Errorf("Expected CAS on a missing key to be not found, got %d", status)
+	}
+}
+
+func TestETags(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send the request with the given precondition header and return the status and ETag
+	do := func(method, header, etag, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+"/keys/config", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+
+	status, first := do("PUT", "If-None-Match", "*", "v1")
+	if status != http.StatusCreated || first == "" {
+		t.Fatalf("Expected create with an ETag, got %d %q", status, first)
+	}
+	if status, _ := do("PUT", "If-None-Match", "*", "v1"); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected If-None-Match: * on an existing key to fail, got %d", status)
+	}
+	if status, etag := do("GET", "", "", ""); status != http.StatusOK || etag != first {
+		t.Errorf("Expected GET to return ETag %s, got %d %s", first, status, etag)
+	}
+	if status, _ := do("GET", "If-None-Match", first, ""); status != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", status)
+	}
+
+	status, second := do("PUT", "If-Match", first, "v2")
+	if status != http.StatusNoContent || second == first {
+		t.Errorf("Expected If-Match update with a new ETag, got %d %s", status, second)
+	}
+	if status, _ := do("PUT", "If-Match", first, "v3"); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale If-Match to fail, got %d", status)
+	}
+	if status, _ := do("DELETE", "If-Match", first, ""); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale If-Match delete to fail, got %d", status)
+	}
+	if status, _ := do("DELETE", "If-Match", second, ""); status != http.StatusNoContent {
+		t.Errorf("Expected If-Match delete to succeed, got %d", status)
+	}
+	if status, _ := do("PUT", "If-Match", "*", "v4"); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected If-Match: * on a missing key to fail, got %d", status)
+	}
+}
@@ -0,0 +1,133 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestKeysAndScan(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send a command and decode the response into v, returning the status code
+	send := func(command string, v interface{}) int {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"command": "`+command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	db.Set("user:1", "alice", 0, "")
+	db.Set("user:2", "bob", 0, "")
+	db.Set("order:1", "book", 0, "")
+	db.QPush("user:jobs", []string{"a"})
+
+	var keys handlers.Reply
+	if status := send("KEYS user:?", &keys); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if !reflect.DeepEqual(replyStrings(keys), []string{"user:1", "user:2"}) {
+		t.Errorf("Unexpected keys %+v", keys)
+	}
+	send("KEYS nothing*", &keys)
+	if keys.Type != handlers.ReplyArray || len(replyStrings(keys)) != 0 {
+		t.Errorf("Expected an empty list, got %+v", keys)
+	}
+
+	// scan everything step by step
+	scanAll := func(options string) []string {
+		var all []string
+		cursor := "0"
+		for {
+			var scan handlers.Reply
+			if status := send("SCAN "+cursor+" COUNT 2 "+options, &scan); status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", status)
+			}
+			all = append(all, replyStrings(replyField(scan, "keys"))...)
+			cursor, _ = replyField(scan, "cursor").Value.(string)
+			if cursor == "0" {
+				break
+			}
+		}
+		sort.Strings(all)
+		return all
+	}
+	if all := scanAll("MATCH user:*"); !reflect.DeepEqual(all, []string{"user:1", "user:2", "user:jobs"}) {
+		t.Errorf("Unexpected scanned keys %v", all)
+	}
+	if all := scanAll("TYPE queue"); !reflect.DeepEqual(all, []string{"user:jobs"}) {
+		t.Errorf("Unexpected scanned queues %v", all)
+	}
+
+	for _, command := range []string{"SCAN abc", "SCAN 0 COUNT 0", "SCAN 0 TYPE list", "SCAN 0 MATCH", "KEYS"} {
+		var response Response
+		if status := send(command, &response); status != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected, got %d", command, status)
+		}
+	}
+
+	// the REST route returns the same steps
+	resp, err := http.Get(server.URL + "/keys?match=order:*&count=1000")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var scan handlers.ResponseScan
+	if err := json.NewDecoder(resp.Body).Decode(&scan); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+	if scan.Cursor != "0" || !reflect.DeepEqual(scan.Keys, []string{"order:1"}) {
+		t.Errorf("Unexpected scan response %+v", scan)
+	}
+}
+
+func TestScanWhileGrowing(t *testing.T) {
+	db := database.NewDatabase()
+	for i := 0; i < 1000; i++ {
+		db.Set(fmt.Sprint("old:", i), "v", 0, "")
+	}
+
+	seen := make(map[string]bool)
+	cursor, added := uint64(0), 0
+	for {
+		var keys []string
+		cursor, keys = db.Scan(cursor, "", 10, "")
+		for _, key := range keys {
+			seen[key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+
+		// the keyspace grows and shrinks between steps
+		for i := 0; i < 50; i++ {
+			db.Set(fmt.Sprint("new:", added), "v", 0, "")
+			added++
+		}
+		db.Delete(fmt.Sprint("new:", added/2))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprint("old:", i); !seen[key] {
+			t.Fatalf("Expected %s to be returned by the scan", key)
+		}
+	}
+}
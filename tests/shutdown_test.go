@@ -0,0 +1,139 @@
+package handlers_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestCloseWakesBlockedPops(t *testing.T) {
+	db := database.NewDatabase()
+	namespaces := database.NewNamespaces(db)
+	handler := &handlers.HTTPHandler{Database: db, Namespaces: namespaces}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	statuses := make(chan int, 2)
+	for _, namespace := range []string{"default", "team"} {
+		// BQPOP only waits on queues that exist
+		queue, _ := namespaces.Get(namespace)
+		queue.QPush("jobs", []string{"a"})
+		queue.QPop("jobs")
+		go func(namespace string) {
+			req, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{"command": "BQPOP jobs 30"}`))
+			req.Header.Set("X-Namespace", namespace)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(namespace)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	namespaces.Close()
+	for i := 0; i < 2; i++ {
+		if status := <-statuses; status != http.StatusServiceUnavailable {
+			t.Errorf("Expected a blocked BQPOP to fail with 503, got %d", status)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Close to wake blocked pops at once, took %v", elapsed)
+	}
+
+	// later blocking pops fail at once, everything else keeps working
+	status, reply := sendCommand(t, server.URL, "BQPOP jobs 30")
+	if status != http.StatusServiceUnavailable || reply.Code != "SHUTTING_DOWN" {
+		t.Errorf("BQPOP after Close: expected 503 SHUTTING_DOWN, got %d %+v", status, reply)
+	}
+	if status, _ := sendCommand(t, server.URL, "QPUSH jobs a"); status != http.StatusOK {
+		t.Errorf("QPUSH after Close: expected 200, got %d", status)
+	}
+	if status, reply := sendCommand(t, server.URL, "BQPOP jobs 30"); status != http.StatusOK || reply.Value != "a" {
+		t.Errorf("BQPOP of a pushed item after Close: expected a, got %d %+v", status, reply)
+	}
+	if _, err := db.BQPop("jobs", time.Minute); !errors.Is(err, database.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	// closing twice is harmless, namespaces created afterwards are closed too
+	namespaces.Close()
+	other, _ := namespaces.Get("other")
+	other.QPush("jobs", []string{"a"})
+	other.QPop("jobs")
+	if _, err := other.BQPop("jobs", time.Minute); !errors.Is(err, database.ErrClosed) {
+		t.Errorf("Expected a new namespace to be closed, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	namespaces := database.NewNamespaces(database.NewDatabase())
+	db, _ := namespaces.Get(database.DefaultNamespace)
+	team, _ := namespaces.Get("team")
+
+	db.SetItem("flagged", database.KeyValuePair{Value: "x", Flags: 42}, "")
+	db.Set("volatile", "soon", time.Hour, "")
+	db.Set("gone", "now", 50*time.Millisecond, "")
+	db.QPush("jobs", []string{"a", "b"})
+	team.Set("key", "team value", 0, "")
+	time.Sleep(100 * time.Millisecond)
+
+	path := filepath.Join(t.TempDir(), "kvs.snapshot")
+	if err := namespaces.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be renamed, got %v", err)
+	}
+
+	restored := database.NewNamespaces(database.NewDatabase())
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	restoredDB, _ := restored.Get(database.DefaultNamespace)
+	restoredTeam, _ := restored.Get("team")
+
+	for _, key := range []string{"flagged", "volatile", "jobs"} {
+		original, _ := db.GetItem(key)
+		item, err := restoredDB.GetItem(key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if item.String() != original.String() || item.Flags != original.Flags || item.Revision != original.Revision ||
+			!item.Expiration.Equal(original.Expiration) || (item.Queue == nil) != (original.Queue == nil) {
+			t.Errorf("%s: expected %+v, got %+v", key, original, item)
+		}
+	}
+	if _, err := restoredDB.Get("gone"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("Expected the expired key to be skipped, got %v", err)
+	}
+	if value, _ := restoredTeam.Get("key"); value != "team value" {
+		t.Errorf("Expected the team namespace to be restored, got %q", value)
+	}
+
+	// revisions keep increasing after a restart
+	restoredDB.Set("new", "value", 0, "")
+	if item, _ := restoredDB.GetItem("new"); item.Revision <= db.Stats().Revision {
+		t.Errorf("Expected a revision above %d, got %d", db.Stats().Revision, item.Revision)
+	}
+
+	if err := restored.LoadSnapshot(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("Expected a missing snapshot to be ignored, got %v", err)
+	}
+	err := restored.ReadSnapshot(strings.NewReader(`{"version": 99}`))
+	if !errors.Is(err, database.ErrInvalidSnapshot) {
+		t.Errorf("Expected ErrInvalidSnapshot, got %v", err)
+	}
+}
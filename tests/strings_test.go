@@ -0,0 +1,143 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestStringCommands(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	db.QPush("jobs", []string{"a"})
+
+	steps := []struct {
+		Command  string
+		Args     []string
+		Status   int
+		Response string
+	}{
+		{"APPEND log hello", nil, http.StatusOK, `{"type":"integer","value":5}`},
+		{"APPEND log", []string{"log", " world"}, http.StatusOK, `{"type":"integer","value":11}`},
+		{"GET log", nil, http.StatusOK, `{"type":"string","value":"hello world"}`},
+		{"STRLEN log", nil, http.StatusOK, `{"type":"integer","value":11}`},
+		{"STRLEN missing", nil, http.StatusOK, `{"type":"integer","value":0}`},
+
+		{"GETRANGE log 0 4", nil, http.StatusOK, `{"type":"string","value":"hello"}`},
+		{"GETRANGE log -5 -1", nil, http.StatusOK, `{"type":"string","value":"world"}`},
+		{"GETRANGE log 6 100", nil, http.StatusOK, `{"type":"string","value":"world"}`},
+		{"GETRANGE log 5 2", nil, http.StatusOK, `{"type":"string","value":""}`},
+		{"GETRANGE missing 0 -1", nil, http.StatusOK, `{"type":"string","value":""}`},
+		{"GETRANGE log a 1", nil, http.StatusBadRequest, `{"type":"error","error":"invalid start","code":"INVALID_ARGUMENT"}`},
+
+		{"SETRANGE log 6 there", nil, http.StatusOK, `{"type":"integer","value":11}`},
+		{"GET log", nil, http.StatusOK, `{"type":"string","value":"hello there"}`},
+		{"SETRANGE padded 3 x", nil, http.StatusOK, `{"type":"integer","value":4}`},
+		{"GET padded", nil, http.StatusOK, `{"type":"string","value":"\u0000\u0000\u0000x"}`},
+		{"SETRANGE log -1 x", nil, http.StatusBadRequest, `{"type":"error","error":"offset is out of range","code":"OUT_OF_RANGE"}`},
+
+		{"GETDEL log", nil, http.StatusOK, `{"type":"string","value":"hello there"}`},
+		{"GETDEL log", nil, http.StatusNotFound, `{"type":"error","error":"key not found","code":"NOT_FOUND"}`},
+
+		{"GETEX padded", nil, http.StatusOK, `{"type":"string","value":"\u0000\u0000\u0000x"}`},
+		{"GETEX padded EX 100", nil, http.StatusOK, `{"type":"string","value":"\u0000\u0000\u0000x"}`},
+		{"GETEX padded PERSIST", nil, http.StatusOK, `{"type":"string","value":"\u0000\u0000\u0000x"}`},
+		{"GETEX padded EX 0", nil, http.StatusBadRequest, `{"type":"error","error":"invalid expire time","code":"INVALID_ARGUMENT"}`},
+		{"GETEX padded SOON 1", nil, http.StatusBadRequest, `{"type":"error","error":"invalid command","code":"INVALID_COMMAND"}`},
+		{"GETEX missing PX 100", nil, http.StatusNotFound, `{"type":"error","error":"key not found","code":"NOT_FOUND"}`},
+
+		// string commands refuse queues
+		{"APPEND jobs b", nil, http.StatusBadRequest, `{"type":"error","error":"operation against a key holding the wrong kind of value","code":"WRONG_TYPE"}`},
+		{"GETDEL jobs", nil, http.StatusBadRequest, `{"type":"error","error":"operation against a key holding the wrong kind of value","code":"WRONG_TYPE"}`},
+		{"GETEX jobs", nil, http.StatusBadRequest, `{"type":"error","error":"operation against a key holding the wrong kind of value","code":"WRONG_TYPE"}`},
+	}
+	for _, step := range steps {
+		request := handlers.RequestBody{Command: step.Command}
+		if step.Args != nil {
+			request = handlers.RequestBody{Command: strings.Fields(step.Command)[0], Args: step.Args}
+		}
+		body, _ := json.Marshal(request)
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.TrimSpace(string(raw)); resp.StatusCode != step.Status || got != step.Response {
+			t.Errorf("%q: expected %d %s, got %d %s", step.Command, step.Status, step.Response, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestStringCommandsKeepExpiration(t *testing.T) {
+	db := database.NewDatabase()
+	db.Set("session", "a", time.Hour, "")
+	db.Append("session", "b")
+	db.SetRange("session", 0, "c")
+
+	item, err := db.GetItem("session")
+	if err != nil || item.Value != "cb" || item.Expiration.IsZero() {
+		t.Errorf("Expected cb with an expiration, got %+v %v", item, err)
+	}
+
+	db.GetEx("session", time.Time{})
+	if item, _ := db.GetItem("session"); !item.Expiration.IsZero() {
+		t.Errorf("Expected GETEX PERSIST to remove the expiration, got %v", item.Expiration)
+	}
+}
+
+func TestSetRangeBounds(t *testing.T) {
+	db := database.NewDatabase()
+	db.Set("k", "v", 0, "")
+
+	for _, offset := range []int{math.MaxInt64, database.MaxStringLength - len("ab") + 1, -1} {
+		if _, err := db.SetRange("k", offset, "ab"); err != database.ErrOffsetTooLong {
+			t.Errorf("Offset %d: expected %v, got %v", offset, database.ErrOffsetTooLong, err)
+		}
+	}
+	// an empty value reaches the exact limit without allocating it
+	if length, err := db.SetRange("k", database.MaxStringLength, ""); length != 1 || err != nil {
+		t.Errorf("Expected the limit itself to be allowed, got %d %v", length, err)
+	}
+	if _, err := db.SetRange("k", database.MaxStringLength+1, ""); err != database.ErrOffsetTooLong {
+		t.Errorf("Expected an offset past the limit to fail, got %v", err)
+	}
+	if value, _ := db.Get("k"); value != "v" {
+		t.Errorf("Expected k to be unchanged, got %q", value)
+	}
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	db := database.NewDatabase()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				db.Append("log", "x")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if length, _ := db.Strlen("log"); length != 1000 {
+		t.Errorf("Expected no append to be lost, got length %d", length)
+	}
+}
@@ -0,0 +1,247 @@
+package handlers_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/acl"
+	"github.com/7dpk/keyvaluestore/certs"
+	"github.com/7dpk/keyvaluestore/config"
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+// a certificate and its key, and their PEM encodings
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// create a certificate with the common name signed by the parent, or a self
+// signed CA if parent is nil
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write the certificate and key to the files, marking them as changed at the time
+func writeTestCert(t *testing.T, c *testCert, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	for path, data := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+}
+
+// create a client trusting the CA and authenticating with the certificate, if
+// any, even if the server does not name its CA as acceptable
+func tlsClient(ca *testCert, cert *testCert) *http.Client {
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AddCert(ca.cert)
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}, nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+// send WHOAMI with the client and return the status and the user
+func whoami(t *testing.T, client *http.Client, url, token string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(`{"command": "WHOAMI"}`))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply handlers.Reply
+	json.NewDecoder(resp.Body).Decode(&reply)
+	user, _ := reply.Value.(string)
+	return resp.StatusCode, user
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, "test CA", nil)
+	if err := os.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA: %v", err)
+	}
+	writeTestCert(t, newTestCert(t, "server", ca), certFile, keyFile, time.Now().Add(-time.Minute))
+
+	reloader, err := certs.NewReloader(certFile, keyFile, caFile, certs.ClientAuthOptional)
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	users := acl.New()
+	users.SetUser("worker", "on", "allkeys", "allcommands")
+	users.SetUser("retired", "off", "allkeys", "allcommands")
+	users.SetUser("admin", "on", ">admin-token", "allkeys", "allcommands")
+	handler := &handlers.HTTPHandler{Database: database.NewDatabase(), Config: config.Default(), ACL: users}
+	server := httptest.NewUnstartedServer(handlers.NewRouter(handler))
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	// the subject of a verified certificate names the user, a token overrides
+	// it, and only requests without a certificate fall back to the default user
+	worker := newTestCert(t, "worker", ca)
+	for _, test := range []struct {
+		Name   string
+		Client *http.Client
+		Token  string
+		Status int
+		User   string
+	}{
+		{"no certificate", tlsClient(ca, nil), "", http.StatusOK, "default"},
+		{"certificate", tlsClient(ca, worker), "", http.StatusOK, "worker"},
+		{"certificate and token", tlsClient(ca, worker), "admin-token", http.StatusOK, "admin"},
+		{"unknown subject", tlsClient(ca, newTestCert(t, "stranger", ca)), "", http.StatusUnauthorized, ""},
+		{"disabled subject", tlsClient(ca, newTestCert(t, "retired", ca)), "", http.StatusUnauthorized, ""},
+	} {
+		if status, user := whoami(t, test.Client, server.URL, test.Token); status != test.Status || user != test.User {
+			t.Errorf("%s: expected %d %q, got %d %q", test.Name, test.Status, test.User, status, user)
+		}
+	}
+
+	// a certificate of another CA fails the handshake
+	other := newTestCert(t, "other CA", nil)
+	if _, err := tlsClient(ca, newTestCert(t, "worker", other)).Get(server.URL + "/keys"); err == nil {
+		t.Errorf("Expected a certificate of an unknown CA to be refused")
+	}
+
+	// the certificate is reloaded when its files change
+	if reloaded, err := reloader.Reload(); reloaded || err != nil {
+		t.Errorf("Expected unchanged files to not reload, got %v %v", reloaded, err)
+	}
+	writeTestCert(t, newTestCert(t, "renewed", ca), certFile, keyFile, time.Now())
+	if reloaded, err := reloader.Reload(); !reloaded || err != nil {
+		t.Fatalf("Expected the changed files to reload, got %v %v", reloaded, err)
+	}
+	resp, err := tlsClient(ca, nil).Get(server.URL + "/keys")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if name := resp.TLS.PeerCertificates[0].Subject.CommonName; name != "renewed" {
+		t.Errorf("Expected the renewed certificate to be served, got %s", name)
+	}
+
+	// files that fail to load keep the previous certificate in use
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if _, err := reloader.Reload(); err == nil {
+		t.Errorf("Expected an invalid key to fail to reload")
+	}
+	if status, _ := whoami(t, tlsClient(ca, nil), server.URL, ""); status != http.StatusOK {
+		t.Errorf("Expected the previous certificate to stay in use, got %d", status)
+	}
+}
+
+func TestTLSRequireClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, "test CA", nil)
+	os.WriteFile(caFile, ca.certPEM, 0600)
+	writeTestCert(t, newTestCert(t, "server", ca), certFile, keyFile, time.Now())
+
+	reloader, err := certs.NewReloader(certFile, keyFile, caFile, certs.ClientAuthRequire)
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	server := httptest.NewUnstartedServer(handlers.NewRouter(&handlers.HTTPHandler{Database: database.NewDatabase()}))
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	if _, err := tlsClient(ca, nil).Get(server.URL + "/keys"); err == nil {
+		t.Errorf("Expected a client without a certificate to be refused")
+	}
+	if status, user := whoami(t, tlsClient(ca, newTestCert(t, "default", ca)), server.URL, ""); status != http.StatusOK || user != "default" {
+		t.Errorf("Expected a client with a certificate to be served, got %d %q", status, user)
+	}
+}
+
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	ca := newTestCert(t, "test CA", nil)
+	writeTestCert(t, newTestCert(t, "server", ca), certFile, keyFile, time.Now())
+
+	reloader, err := certs.NewReloader(certFile, keyFile, "", certs.ClientAuthOptional)
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	server := httptest.NewUnstartedServer(handlers.NewRouter(&handlers.HTTPHandler{Database: database.NewDatabase()}))
+	server.EnableHTTP2 = true
+	server.TLS = reloader.TLSConfig("h2", "http/1.1")
+	server.StartTLS()
+	defer server.Close()
+
+	client := tlsClient(ca, nil)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	resp, err := client.Get(server.URL + "/keys")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.TLS.NegotiatedProtocol != "h2" {
+		t.Errorf("Expected HTTP/2, got %s negotiating %q", resp.Proto, resp.TLS.NegotiatedProtocol)
+	}
+}
@@ -0,0 +1,223 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func TestTransactions(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send a command within the session and return the status code and raw response
+	send := func(token, command string) (int, json.RawMessage) {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"command": "`+command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("X-Session-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		var raw json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return resp.StatusCode, raw
+	}
+
+	// create a session and return its token
+	newSession := func() string {
+		resp, err := http.Post(server.URL+"/sessions", "application/json", nil)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status Created; got %v", resp.Status)
+		}
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return response.Value
+	}
+
+	db.Set("source", "payload", 0, "")
+
+	// a successful transaction moves the value and sets the flag together
+	token := newSession()
+	steps := []struct {
+		Command  string
+		Status   int
+		Response string
+	}{
+		{"WATCH source", http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"MULTI", http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"GET source", http.StatusOK, `{"type":"string","value":"QUEUED"}`},
+		{"DEL source", http.StatusOK, `{"type":"string","value":"QUEUED"}`},
+		{"SET moved 1", http.StatusOK, `{"type":"string","value":"QUEUED"}`},
+		{"EXEC", http.StatusOK, `{"type":"array","value":[{"type":"string","value":"payload"},{"type":"string","value":"OK"},{"type":"string","value":"OK"}]}`},
+		{"EXEC", http.StatusBadRequest, `{"type":"error","error":"EXEC without MULTI","code":"INVALID_STATE"}`},
+	}
+	for _, step := range steps {
+		status, raw := send(token, step.Command)
+		if status != step.Status || string(raw) != step.Response {
+			t.Errorf("%s: expected %d %s, got %d %s", step.Command, step.Status, step.Response, status, raw)
+		}
+	}
+	if _, err := db.Get("source"); err != database.ErrNotFound {
+		t.Errorf("Expected source to be deleted, got %v", err)
+	}
+
+	// a watched key modified by another client aborts EXEC
+	steps = []struct {
+		Command  string
+		Status   int
+		Response string
+	}{
+		{"WATCH moved", http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"MULTI", http.StatusOK, `{"type":"string","value":"OK"}`},
+		{"SET moved 2", http.StatusOK, `{"type":"string","value":"QUEUED"}`},
+	}
+	for _, step := range steps {
+		status, raw := send(token, step.Command)
+		if status != step.Status || string(raw) != step.Response {
+			t.Errorf("%s: expected %d %s, got %d %s", step.Command, step.Status, step.Response, status, raw)
+		}
+	}
+	send("", "SET moved 3")
+	status, raw := send(token, "EXEC")
+	if status != http.StatusConflict || string(raw) != `{"type":"error","error":"transaction aborted: watched key changed","code":"TX_ABORTED"}` {
+		t.Errorf("Expected aborted EXEC, got %d %s", status, raw)
+	}
+	if value, _ := db.Get("moved"); value != "3" {
+		t.Errorf("Expected moved to keep the concurrent write, got %q", value)
+	}
+
+	// a queued command with invalid arguments discards the transaction
+	send(token, "MULTI")
+	send(token, "SET x 1")
+	send(token, "GET")
+	status, raw = send(token, "EXEC")
+	if status != http.StatusBadRequest || string(raw) != `{"type":"error","error":"transaction discarded because of previous errors","code":"TX_DISCARDED"}` {
+		t.Errorf("Expected discarded EXEC, got %d %s", status, raw)
+	}
+	if _, err := db.Get("x"); err != database.ErrNotFound {
+		t.Errorf("Expected x to never be written, got %v", err)
+	}
+
+	// a whole transaction also fits in a single batch request
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(
+		`[{"command": "MULTI"}, {"command": "QPUSH q a"}, {"command": "QPOP q"}, {"command": "EXEC"}]`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var responses []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+	if len(responses) != 4 || string(responses[3]) != `{"type":"array","value":[{"type":"string","value":"OK"},{"type":"string","value":"a"}]}` {
+		t.Errorf("Unexpected batch transaction responses %s", responses)
+	}
+
+	// unknown sessions are rejected
+	if status, _ := send("nope", "GET moved"); status != http.StatusNotFound {
+		t.Errorf("Expected unknown session to be rejected, got %d", status)
+	}
+}
+
+func TestTransactionStaysInItsNamespace(t *testing.T) {
+	handler := &handlers.HTTPHandler{
+		Database: database.NewDatabase(),
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	// send a command within the session to the namespace and return the status code and raw response
+	send := func(token, namespace, command string) (int, json.RawMessage) {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"command": "`+command+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		req.Header.Set("X-Namespace", namespace)
+		if token != "" {
+			req.Header.Set("X-Session-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+		var raw json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+			t.Fatalf("Could not decode JSON response: %v", err)
+		}
+		return resp.StatusCode, raw
+	}
+	resp, err := http.Post(server.URL+"/sessions", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	var session Response
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		t.Fatalf("Could not decode JSON response: %v", err)
+	}
+	resp.Body.Close()
+	token := session.Value
+
+	// EXEC in another namespace would check the watched keys of the wrong one
+	send("", "a", "SET k 1")
+	send(token, "a", "WATCH k")
+	send(token, "a", "MULTI")
+	send(token, "a", "SET k 2")
+	send("", "a", "SET k 3")
+	status, raw := send(token, "b", "EXEC")
+	if status != http.StatusBadRequest || !strings.Contains(string(raw), `"code":"INVALID_STATE"`) {
+		t.Errorf("Expected EXEC in another namespace to be rejected, got %d %s", status, raw)
+	}
+	status, raw = send(token, "a", "EXEC")
+	if status != http.StatusBadRequest || !strings.Contains(string(raw), `"code":"TX_DISCARDED"`) {
+		t.Errorf("Expected the transaction to be discarded, got %d %s", status, raw)
+	}
+	if _, raw := send("", "a", "GET k"); string(raw) != `{"type":"string","value":"3"}` {
+		t.Errorf("Expected k to keep the concurrent write, got %s", raw)
+	}
+
+	// watching in another namespace is rejected too, until UNWATCH
+	send(token, "a", "WATCH k")
+	if status, _ := send(token, "b", "WATCH k"); status != http.StatusBadRequest {
+		t.Errorf("Expected WATCH in another namespace to be rejected, got %d", status)
+	}
+	send(token, "a", "UNWATCH")
+	if status, raw := send(token, "b", "WATCH k"); status != http.StatusOK {
+		t.Errorf("Expected WATCH after UNWATCH to succeed, got %d %s", status, raw)
+	}
+	send(token, "b", "UNWATCH")
+
+	// commands that do not run against the database cannot be queued
+	send(token, "a", "MULTI")
+	status, raw = send(token, "a", "WHOAMI")
+	if status != http.StatusBadRequest || !strings.Contains(string(raw), `"code":"INVALID_STATE"`) {
+		t.Errorf("Expected WHOAMI inside MULTI to be rejected, got %d %s", status, raw)
+	}
+	status, raw = send(token, "a", "EXEC")
+	if status != http.StatusBadRequest || !strings.Contains(string(raw), `"code":"TX_DISCARDED"`) {
+		t.Errorf("Expected the transaction to be discarded, got %d %s", status, raw)
+	}
+}
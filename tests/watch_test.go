@@ -0,0 +1,198 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/7dpk/keyvaluestore/database"
+	"github.com/7dpk/keyvaluestore/handlers"
+)
+
+func watch(t *testing.T, url string) (int, handlers.ResponseWatch) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response handlers.ResponseWatch
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Could not decode watch response: %v", err)
+		}
+	}
+	return resp.StatusCode, response
+}
+
+func TestWatch(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	start := db.CurrentRevision() + 1
+	db.Set("app/a", "1", 0, "")
+	db.Set("other", "x", 0, "")
+	db.Set("app/b", "2", 0, "")
+	db.Delete("app/a")
+
+	status, response := watch(t, fmt.Sprintf("%s/watch?key=app/&prefix=true&revision=%d", server.URL, start))
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	expected := []struct{ Key, Op, Value string }{
+		{"app/a", "set", "1"},
+		{"app/b", "set", "2"},
+		{"app/a", "del", ""},
+	}
+	if len(response.Events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), response.Events)
+	}
+	for i, want := range expected {
+		got := response.Events[i]
+		if got.Key != want.Key || got.Op != want.Op || got.Value != want.Value {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want, got)
+		}
+		if i > 0 && got.Revision <= response.Events[i-1].Revision {
+			t.Errorf("Expected revisions in order, got %+v", response.Events)
+		}
+	}
+	if response.Revision != db.CurrentRevision() {
+		t.Errorf("Expected revision %d, got %d", db.CurrentRevision(), response.Revision)
+	}
+
+	// a single key only sees its own changes
+	_, response = watch(t, fmt.Sprintf("%s/watch?key=other&revision=%d", server.URL, start))
+	if len(response.Events) != 1 || response.Events[0].Key != "other" {
+		t.Errorf("Expected one change of other, got %+v", response.Events)
+	}
+
+	// without changes the watch waits for the next one
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.Set("app/c", "3", 0, "")
+	}()
+	status, response = watch(t, server.URL+"/watch?key=app/&prefix=true&timeout=5")
+	if status != http.StatusOK || len(response.Events) != 1 || response.Events[0].Key != "app/c" {
+		t.Errorf("Expected the watch to wake up on app/c, got %d %+v", status, response.Events)
+	}
+
+	// and returns no events once the timeout passes
+	status, response = watch(t, server.URL+"/watch?key=quiet&timeout=0.1")
+	if status != http.StatusOK || response.Events == nil || len(response.Events) != 0 {
+		t.Errorf("Expected an empty list of events after the timeout, got %d %+v", status, response.Events)
+	}
+
+	if status, _ := watch(t, server.URL+"/watch?key=app/&revision=abc"); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid revision to be rejected, got %d", status)
+	}
+	if status, _ := watch(t, server.URL+"/watch"); status != http.StatusBadRequest {
+		t.Errorf("Expected a watch without key to be rejected, got %d", status)
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	db := database.NewDatabase()
+	handler := &handlers.HTTPHandler{
+		Database: db,
+	}
+	server := httptest.NewServer(handlers.NewRouter(handler))
+	defer server.Close()
+
+	for i := 0; i <= database.DefaultHistorySize; i++ {
+		db.Set("counter", fmt.Sprint(i), 0, "")
+	}
+
+	resp, err := http.Get(server.URL + "/watch?key=counter&revision=1")
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("Expected status 410, got %d", resp.StatusCode)
+	}
+	var response handlers.ResponseCompacted
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if response.CompactRevision == 0 || response.Error != database.ErrCompacted.Error() {
+		t.Errorf("Unexpected compacted response %+v", response)
+	}
+
+	// watching right after the compacted revision still works
+	status, watched := watch(t, fmt.Sprintf("%s/watch?key=counter&revision=%d", server.URL, response.CompactRevision+1))
+	if status != http.StatusOK || len(watched.Events) != database.DefaultHistorySize {
+		t.Errorf("Expected %d retained changes, got %d %d", database.DefaultHistorySize, status, len(watched.Events))
+	}
+}
+
+func TestWatchFromZero(t *testing.T) {
+	db := database.NewDatabase()
+	server := httptest.NewServer(handlers.NewRouter(&handlers.HTTPHandler{Database: db}))
+	defer server.Close()
+
+	// nothing has been compacted on an empty database
+	status, watched := watch(t, server.URL+"/watch?key=greeting&revision=0&timeout=0.05")
+	if status != http.StatusOK || len(watched.Events) != 0 {
+		t.Fatalf("Expected an empty watch from revision 0, got %d %+v", status, watched)
+	}
+
+	db.Set("greeting", "hello", 0, "")
+	status, watched = watch(t, server.URL+"/watch?key=greeting&revision=0")
+	if status != http.StatusOK || len(watched.Events) != 1 || watched.Events[0].Value != "hello" {
+		t.Errorf("Expected every retained change from revision 0, got %d %+v", status, watched)
+	}
+}
+
+func TestWatchAfterFlush(t *testing.T) {
+	db := database.NewDatabase()
+	server := httptest.NewServer(handlers.NewRouter(&handlers.HTTPHandler{Database: db}))
+	defer server.Close()
+
+	db.Set("greeting", "hello", 0, "")
+	start := db.CurrentRevision()
+
+	// a waiting watch learns that the keys are gone
+	done := make(chan int)
+	go func() {
+		status, _ := watch(t, fmt.Sprintf("%s/watch?key=greeting&revision=%d&timeout=5", server.URL, start+1))
+		done <- status
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sendCommand(t, server.URL, "FLUSHDB")
+	select {
+	case status := <-done:
+		if status != http.StatusGone {
+			t.Errorf("Expected the waiting watch to get 410 after FLUSHDB, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The watch did not return")
+	}
+	if status, _ := watch(t, fmt.Sprintf("%s/watch?key=greeting&revision=%d", server.URL, start)); status != http.StatusGone {
+		t.Errorf("Expected a watch from before FLUSHDB to get 410, got %d", status)
+	}
+
+	// the same goes for both namespaces of a swap
+	db.Set("greeting", "hi", 0, "")
+	start = db.CurrentRevision()
+	sendCommand(t, server.URL+"/ns/other/", "SET greeting hey")
+	sendCommand(t, server.URL, "SWAPDB default other")
+	for _, path := range []string{"", "/ns/other"} {
+		if status, _ := watch(t, fmt.Sprintf("%s%s/watch?key=greeting&revision=%d", server.URL, path, start)); status != http.StatusGone {
+			t.Errorf("%s: expected a watch from before SWAPDB to get 410, got %d", path, status)
+		}
+	}
+
+	// watching from after them works again
+	status, watched := watch(t, fmt.Sprintf("%s/watch?key=greeting&revision=%d&timeout=0.05", server.URL, db.CurrentRevision()+1))
+	if status != http.StatusOK || len(watched.Events) != 0 {
+		t.Errorf("Expected an empty watch after SWAPDB, got %d %+v", status, watched)
+	}
+}